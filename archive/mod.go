@@ -0,0 +1,250 @@
+// Package archive keeps a local copy of the posted works: the original
+// files, the ugoira zip and the details, in a directory per artist and
+// illust. index.jsonl lists the archived works for searching.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+)
+
+const INDEX_FILE = "index.jsonl"
+
+const DETAILS_FILE = "details.json"
+
+// Entry is a line of the index
+type Entry struct {
+	Illust   string    `json:"illust"`
+	User     string    `json:"user"`
+	UserName string    `json:"user_name"`
+	Title    string    `json:"title"`
+	Tags     []string  `json:"tags,omitempty"`
+	Files    []string  `json:"files"`
+	Archived time.Time `json:"archived"`
+	// Path is the directory of the work relative to the archive
+	Path string `json:"path"`
+}
+
+// Archive stores the works under Dir, Open fetches the files and defaults to
+// downloader.Open
+type Archive struct {
+	Dir   string
+	Open  func(ctx context.Context, source string) (io.ReadCloser, error)
+	Now   func() time.Time
+	mutex sync.Mutex
+}
+
+func New(dir string) *Archive {
+	return &Archive{Dir: dir, Open: downloader.Open, Now: time.Now}
+}
+
+// Sources returns the urls of the files of the work, the originals of every
+// page and the ugoira zip
+func Sources(details *pixiv.DetailsApi) []string {
+	illust := details.IllustDetails
+	var result []string
+	if len(illust.MangaA) > 0 {
+		for _, page := range illust.MangaA {
+			result = append(result, page.URLOriginal)
+		}
+	} else if illust.URLOriginal != "" {
+		result = append(result, illust.URLOriginal)
+	}
+	if illust.UgoiraMeta.Src != "" {
+		result = append(result, illust.UgoiraMeta.Src)
+	}
+	return result
+}
+
+// writeFile writes through a temporary file, so an interrupted download
+// doesn't leave a partial file
+func writeFile(name string, write func(w io.Writer) error) error {
+	temp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	err = write(temp)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), name)
+}
+
+func (archive *Archive) download(ctx context.Context, source string, name string) error {
+	reader, err := archive.Open(ctx, source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeFile(name, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+}
+
+// writeDetails writes the details as pixiv returned them, details without
+// the response are encoded again
+func writeDetails(w io.Writer, details *pixiv.DetailsApi) error {
+	if len(details.Raw) == 0 {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(details)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, details.Raw, "", "  "); err != nil {
+		return err
+	}
+	indented.WriteByte('\n')
+	_, err := indented.WriteTo(w)
+	return err
+}
+
+// isID checks that the pixiv id is only digits
+func isID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Save archives the work, files already archived are kept. The details are
+// written again as they may have changed.
+func (archive *Archive) Save(ctx context.Context, details *pixiv.DetailsApi) (entry Entry, err error) {
+	illust := details.IllustDetails
+	if illust.ID == "" || illust.UserID == "" {
+		return entry, fmt.Errorf("incomplete details")
+	}
+	// the ids name the directories, anything else could leave the archive
+	if !isID(illust.ID) || !isID(illust.UserID) {
+		return entry, fmt.Errorf("invalid id %q of user %q", illust.ID, illust.UserID)
+	}
+	entry = Entry{
+		Illust:   illust.ID,
+		User:     illust.UserID,
+		UserName: details.AuthorDetails.UserName,
+		Title:    illust.Title,
+		Tags:     illust.Tags,
+		Archived: archive.Now(),
+		Path:     path.Join(illust.UserID, illust.ID),
+	}
+	dir := filepath.Join(archive.Dir, filepath.FromSlash(entry.Path))
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	for _, source := range Sources(details) {
+		name := path.Base(source)
+		target := filepath.Join(dir, name)
+		if _, statErr := os.Stat(target); statErr != nil {
+			if err = archive.download(ctx, source, target); err != nil {
+				return
+			}
+		}
+		entry.Files = append(entry.Files, name)
+	}
+	err = writeFile(filepath.Join(dir, DETAILS_FILE), func(w io.Writer) error {
+		return writeDetails(w, details)
+	})
+	if err != nil {
+		return
+	}
+	err = archive.appendIndex(entry)
+	return
+}
+
+func (archive *Archive) appendIndex(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+	file, err := os.OpenFile(filepath.Join(archive.Dir, INDEX_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// matches checks every word of the query against the id, title, author and
+// tags, ignoring case
+func (entry Entry) matches(words []string) bool {
+	fields := append([]string{entry.Illust, entry.User, entry.UserName, entry.Title}, entry.Tags...)
+	text := strings.ToLower(strings.Join(fields, "\n"))
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns up to limit entries matching the query, newest first. A
+// work archived again is only returned once.
+func (archive *Archive) Search(query string, limit int) ([]Entry, error) {
+	archive.mutex.Lock()
+	defer archive.mutex.Unlock()
+	file, err := os.Open(filepath.Join(archive.Dir, INDEX_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	words := strings.Fields(strings.ToLower(query))
+	var matched []Entry
+	latest := map[string]int{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if index, ok := latest[entry.Illust]; ok {
+			matched[index] = Entry{}
+		}
+		if entry.matches(words) {
+			latest[entry.Illust] = len(matched)
+			matched = append(matched, entry)
+		} else {
+			delete(latest, entry.Illust)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var result []Entry
+	for i := len(matched) - 1; i >= 0 && len(result) < limit; i-- {
+		if matched[i].Illust != "" {
+			result = append(result, matched[i])
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codehz/pixivbot/pixiv"
+)
+
+func TestArchive(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://www.pixiv.net/" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	archive := New(t.TempDir())
+
+	details := &pixiv.DetailsApi{}
+	details.IllustDetails.ID = "1002"
+	details.IllustDetails.UserID = "12"
+	details.IllustDetails.Title = "三枚の漫画"
+	details.IllustDetails.Tags = []string{"漫画", "オリジナル"}
+	details.IllustDetails.MangaA = []pixiv.MangaA{
+		{URLOriginal: server.URL + "/img-original/img/1002_p0.png"},
+		{URLOriginal: server.URL + "/img-original/img/1002_p1.png"},
+	}
+	details.AuthorDetails.UserName = "漫画家"
+	entry, err := archive.Save(context.Background(), details)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Path != "12/1002" || len(entry.Files) != 2 {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	data, err := os.ReadFile(filepath.Join(archive.Dir, "12", "1002", "1002_p1.png"))
+	if err != nil || string(data) != "/img-original/img/1002_p1.png" {
+		t.Errorf("unexpected file %q %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(archive.Dir, "12", "1002", DETAILS_FILE)); err != nil {
+		t.Error(err)
+	}
+
+	other := &pixiv.DetailsApi{}
+	other.IllustDetails.ID = "1001"
+	other.IllustDetails.UserID = "11"
+	other.IllustDetails.Title = "夏の空"
+	other.IllustDetails.URLOriginal = server.URL + "/img-original/img/1001_p0.png"
+	if _, err := archive.Save(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	details.IllustDetails.Title = "改題"
+	if _, err := archive.Save(context.Background(), details); err != nil {
+		t.Fatal(err)
+	}
+
+	results, _ := archive.Search("", 10)
+	if len(results) != 2 || results[0].Illust != "1002" || results[1].Illust != "1001" {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if results, _ := archive.Search("三枚", 10); len(results) != 0 {
+		t.Errorf("expected the old title to be replaced, got %+v", results)
+	}
+	if results, _ := archive.Search("オリジナル 漫画家", 10); len(results) != 1 || results[0].Title != "改題" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	broken := &pixiv.DetailsApi{}
+	broken.IllustDetails.ID = "1003"
+	broken.IllustDetails.UserID = "11"
+	broken.IllustDetails.URLOriginal = server.URL + "/missing.png"
+	archive.Open = func(ctx context.Context, source string) (io.ReadCloser, error) {
+		return nil, os.ErrNotExist
+	}
+	if _, err := archive.Save(context.Background(), broken); err == nil {
+		t.Errorf("expected the failed download to be reported")
+	}
+
+	for _, user := range []string{"..", "11/../..", ""} {
+		escaped := &pixiv.DetailsApi{}
+		escaped.IllustDetails.ID = "1004"
+		escaped.IllustDetails.UserID = user
+		if _, err := archive.Save(context.Background(), escaped); err == nil {
+			t.Errorf("expected user %q to be rejected", user)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// chatInfo is what the admin api shows about a chat
+type chatInfo struct {
+	ID       int64                 `json:"id"`
+	Type     tb.ChatType           `json:"type,omitempty"`
+	Title    string                `json:"title,omitempty"`
+	Username string                `json:"username,omitempty"`
+	LastSeen *time.Time            `json:"last_seen,omitempty"`
+	Settings *storage.ChatSettings `json:"settings,omitempty"`
+}
+
+// chatRegistry remembers the chats the bot has seen since start
+type chatRegistry struct {
+	mutex sync.Mutex
+	clock Clock
+	chats map[int64]chatInfo
+}
+
+func (registry *chatRegistry) seen(chat *tb.Chat) {
+	if chat == nil {
+		return
+	}
+	now := registry.clock.Now()
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.chats[chat.ID] = chatInfo{
+		ID:       chat.ID,
+		Type:     chat.Type,
+		Title:    chat.Title,
+		Username: chat.Username,
+		LastSeen: &now,
+	}
+}
+
+func (registry *chatRegistry) forget(id int64) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	delete(registry.chats, id)
+}
+
+// listChats returns the seen chats and the chats with settings, ordered by id
+func (b *Bot) listChats() []chatInfo {
+	b.chats.mutex.Lock()
+	merged := make(map[int64]chatInfo, len(b.chats.chats))
+	for id, info := range b.chats.chats {
+		merged[id] = info
+	}
+	b.chats.mutex.Unlock()
+	for _, id := range b.Store.Chats() {
+		if _, ok := merged[id]; !ok {
+			merged[id] = chatInfo{ID: id}
+		}
+	}
+	result := make([]chatInfo, 0, len(merged))
+	for _, info := range merged {
+		current := b.Store.Get(info.ID)
+		info.Settings = &current
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// trackUpdate remembers the chat of the update, the bot leaving a chat
+// forgets it
+func (b *Bot) trackUpdate(upd *tb.Update) {
+	switch {
+	case upd.Message != nil:
+		b.chats.seen(upd.Message.Chat)
+	case upd.ChannelPost != nil:
+		b.chats.seen(upd.ChannelPost.Chat)
+	case upd.Callback != nil && upd.Callback.Message != nil:
+		b.chats.seen(upd.Callback.Message.Chat)
+	case upd.MyChatMember != nil:
+		member := upd.MyChatMember.NewChatMember
+		if member != nil && (member.Role == tb.Left || member.Role == tb.Kicked) {
+			b.chats.forget(upd.MyChatMember.Chat.ID)
+		} else {
+			b.chats.seen(&upd.MyChatMember.Chat)
+		}
+	}
+}
+
+// job is a preview or post in progress
+type job struct {
+	Request string    `json:"request"`
+	Action  string    `json:"action"`
+	Illust  int       `json:"illust"`
+	Chat    int64     `json:"chat"`
+	Started time.Time `json:"started"`
+}
+
+type jobTracker struct {
+	mutex sync.Mutex
+	clock Clock
+	jobs  map[*job]struct{}
+}
+
+// begin registers the job, the returned function removes it
+func (tracker *jobTracker) begin(req *request, action string, illust int, chat int64) func() {
+	current := &job{Request: req.id, Action: action, Illust: illust, Chat: chat, Started: tracker.clock.Now()}
+	tracker.mutex.Lock()
+	tracker.jobs[current] = struct{}{}
+	tracker.mutex.Unlock()
+	return func() {
+		tracker.mutex.Lock()
+		delete(tracker.jobs, current)
+		tracker.mutex.Unlock()
+	}
+}
+
+func (tracker *jobTracker) list() []job {
+	tracker.mutex.Lock()
+	result := make([]job, 0, len(tracker.jobs))
+	for current := range tracker.jobs {
+		result = append(result, *current)
+	}
+	tracker.mutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+const HEALTH_TIMEOUT = 10 * time.Second
+
+// AdminServer serves the health checks and the json admin api, the probes
+// are functions so they can be faked in tests
+type AdminServer struct {
+	// Token authenticates /api/ as a bearer token, the api is disabled if empty
+	Token     string
+	Bot       *Bot
+	GetMe     func() error
+	PingPixiv func(ctx context.Context) error
+	ready     int32
+}
+
+type postRequest struct {
+	Chat   string `json:"chat"`
+	Illust int    `json:"illust"`
+	Album  bool   `json:"album"`
+}
+
+func (server *AdminServer) SetReady() {
+	atomic.StoreInt32(&server.ready, 1)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func probe(ctx context.Context, check func(ctx context.Context) error) string {
+	result := make(chan error, 1)
+	go func() { result <- check(ctx) }()
+	select {
+	case err := <-result:
+		if err != nil {
+			return err.Error()
+		}
+		return "ok"
+	case <-ctx.Done():
+		return ctx.Err().Error()
+	}
+}
+
+func (server *AdminServer) healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HEALTH_TIMEOUT)
+	defer cancel()
+	var telegram, pixiv string
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		telegram = probe(ctx, func(context.Context) error { return server.GetMe() })
+	}()
+	go func() {
+		defer wg.Done()
+		pixiv = probe(ctx, server.PingPixiv)
+	}()
+	wg.Wait()
+	status := http.StatusOK
+	if telegram != "ok" || pixiv != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"telegram": telegram, "pixiv": pixiv})
+}
+
+func (server *AdminServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&server.ready) == 0 {
+		writeJSONError(w, http.StatusServiceUnavailable, "not ready")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+func (server *AdminServer) authorized(r *http.Request) bool {
+	if server.Token == "" {
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(server.Token)) == 1
+}
+
+// api is the json admin api, every request needs the bearer token. /reload
+// only reads the tag dictionary again and drops the chat cache, changes to
+// the flags need a restart.
+func (server *AdminServer) api(w http.ResponseWriter, r *http.Request) {
+	if !server.authorized(r) {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	switch {
+	case path == "/chats" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, server.Bot.listChats())
+	case strings.HasPrefix(path, "/chats/") && r.Method == "GET":
+		id, err := strconv.ParseInt(strings.TrimPrefix(path, "/chats/"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid chat id")
+			return
+		}
+		for _, info := range server.Bot.listChats() {
+			if info.ID == id {
+				writeJSON(w, http.StatusOK, info)
+				return
+			}
+		}
+		writeJSONError(w, http.StatusNotFound, "chat not found")
+	case strings.HasPrefix(path, "/posts/") && r.Method == "GET":
+		illust, err := strconv.Atoi(strings.TrimPrefix(path, "/posts/"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid illust id")
+			return
+		}
+		posts, err := server.Bot.Store.Posts(illust)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, append([]storage.Post{}, posts...))
+	case (path == "/backup" || path == "/export") && r.Method == "GET":
+		db, ok := server.Bot.Store.(*storage.DB)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no database configured")
+			return
+		}
+		var err error
+		if path == "/export" {
+			w.Header().Set("Content-Type", "application/json")
+			err = db.Export(w)
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="pixivbot.db"`)
+			_, err = db.Backup(w)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("backup failed", "error", err)
+		}
+	case path == "/subscriptions" && r.Method == "GET":
+		var chat int64
+		if value := r.URL.Query().Get("chat"); value != "" {
+			var err error
+			chat, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid chat id")
+				return
+			}
+		}
+		subs, err := server.Bot.Store.Subscriptions(chat)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, append([]storage.Subscription{}, subs...))
+	case path == "/queue" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, server.Bot.jobs.list())
+	case path == "/post" && r.Method == "POST":
+		var input postRequest
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil || input.Chat == "" || input.Illust <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "expected {\"chat\": string, \"illust\": number, \"album\": bool}")
+			return
+		}
+		err = server.Bot.Post(input.Chat, input.Illust, input.Album)
+		if err != nil {
+			writeJSONError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	case path == "/reload" && r.Method == "POST":
+		err := server.Bot.Reload()
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		logging.FromContext(r.Context()).Info("configuration reloaded")
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (server *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.healthz)
+	mux.HandleFunc("/readyz", server.readyz)
+	mux.Handle("/metrics", metrics.Default)
+	mux.HandleFunc("/api/", server.api)
+	return mux
+}
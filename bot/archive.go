@@ -0,0 +1,75 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const ARCHIVE_SEARCH_LIMIT = 10
+
+var archivedTotal = metrics.NewCounter("pixivbot_archived_total", "Works archived after channel posts by result.", "result")
+
+// archivePost archives the work in the background if it was posted to a
+// channel, failures are only logged as the post is already sent
+func (b *Bot) archivePost(req *request, chat *tb.Chat, details *pixiv.DetailsApi) {
+	if b.Archive == nil || (chat.Type != tb.ChatChannel && chat.Type != tb.ChatChannelPrivate) {
+		return
+	}
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		entry, err := b.Archive.Save(req.ctx, details)
+		if err != nil {
+			archivedTotal.Inc("error")
+			req.log.Warn("archiving failed", "error", err)
+			return
+		}
+		archivedTotal.Inc("ok")
+		req.log.Info("archived", "path", entry.Path, "files", len(entry.Files))
+	}()
+}
+
+// handleArchive searches the archive, which has the works of every chat so
+// it is only for bot admins
+func (b *Bot) handleArchive(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if !b.isBotAdmin(m.Sender) {
+		req.send(b.Telegram, m.Chat, req.tr(NOT_BOT_ADMIN))
+		return
+	}
+	if b.Archive == nil {
+		req.send(b.Telegram, m.Chat, req.tr(ARCHIVE_DISABLED), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 || args[0] != "search" {
+		req.send(b.Telegram, m.Chat, req.tr(ARCHIVE_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	results, err := b.Archive.Search(strings.Join(args[1:], " "), ARCHIVE_SEARCH_LIMIT)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	if len(results) == 0 {
+		req.send(b.Telegram, m.Chat, req.tr(ARCHIVE_NOT_FOUND), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	var builder strings.Builder
+	builder.WriteString(req.tr(ARCHIVE_RESULTS, len(results)))
+	for _, entry := range results {
+		fmt.Fprintf(&builder, "\n<a href=\"https://www.pixiv.net/artworks/%s\">%s</a> - %s\n%s <code>%s</code>",
+			entry.Illust, html.EscapeString(entry.Title), html.EscapeString(entry.UserName),
+			entry.Archived.Format("2006-01-02"), html.EscapeString(entry.Path))
+	}
+	req.send(b.Telegram, m.Chat, builder.String(), &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               m,
+	})
+}
@@ -0,0 +1,103 @@
+package bot
+
+import (
+	"errors"
+
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// blockedError is returned when the work matches the blocklist of the chat
+type blockedError struct {
+	reason string
+	// silent errors are not reported to the chat
+	silent bool
+}
+
+func (err blockedError) Error() string {
+	return err.reason
+}
+
+func containsTag(list []string, tags ...string) (string, bool) {
+	for _, blocked := range list {
+		key := normalizeTag(blocked)
+		for _, tag := range tags {
+			if tag != "" && normalizeTag(tag) == key {
+				return blocked, true
+			}
+		}
+	}
+	return "", false
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlocked matches the work against the blocklist of the chat where the
+// request comes from
+func (b *Bot) checkBlocked(req *request, details *pixiv.DetailsApi) error {
+	current := req.settings
+	if len(current.BlockedTags) == 0 && len(current.BlockedUsers) == 0 {
+		return nil
+	}
+	if containsString(current.BlockedUsers, details.AuthorDetails.UserID) {
+		return blockedError{reason: req.tr(BLOCKED_USER), silent: current.BlockSilent}
+	}
+	for _, tag := range details.IllustDetails.DisplayTags {
+		canonical := b.Tags.canonical(tag.Tag, tag.Translation)
+		if blocked, ok := containsTag(current.BlockedTags, tag.Tag, tag.Translation, canonical); ok {
+			return blockedError{reason: req.tr(BLOCKED_TAG, blocked), silent: current.BlockSilent}
+		}
+	}
+	if blocked, ok := containsTag(current.BlockedTags, details.IllustDetails.Tags...); ok {
+		return blockedError{reason: req.tr(BLOCKED_TAG, blocked), silent: current.BlockSilent}
+	}
+	return nil
+}
+
+// sendError reports the error to the chat unless it should be dropped
+// silently
+func (b *Bot) sendError(req *request, chat *tb.Chat, err error) {
+	var blocked blockedError
+	if errors.As(err, &blocked) && blocked.silent {
+		return
+	}
+	req.send(b.Telegram, chat, errorMessage(req, err))
+}
+
+func appendUnique(list []string, value string, equal func(a, b string) bool) []string {
+	for _, item := range list {
+		if equal(item, value) {
+			return list
+		}
+	}
+	// never append in place, the backing array is shared with readers
+	return append(list[:len(list):len(list)], value)
+}
+
+func removeItem(list []string, value string, equal func(a, b string) bool) ([]string, bool) {
+	result := make([]string, 0, len(list))
+	found := false
+	for _, item := range list {
+		if equal(item, value) {
+			found = true
+			continue
+		}
+		result = append(result, item)
+	}
+	return result, found
+}
+
+func sameTag(a, b string) bool {
+	return normalizeTag(a) == normalizeTag(b)
+}
+
+func sameString(a, b string) bool {
+	return a == b
+}
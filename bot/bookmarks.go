@@ -0,0 +1,296 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// BOOKMARKS_PAGE_SIZE is how many bookmarks are listed per message, one
+// preview button each
+const BOOKMARKS_PAGE_SIZE = 10
+
+var bookmarksAdded = metrics.NewCounter("pixivbot_bookmarks_added_total", "Works bookmarked from telegram by result.", "result")
+
+// bookmarkTarget is the payload of the bookmark buttons, the illust and the
+// visibility of the bookmark
+type bookmarkTarget struct {
+	illust  int
+	private bool
+}
+
+func (target bookmarkTarget) String() string {
+	if target.private {
+		return fmt.Sprintf("%d|private", target.illust)
+	}
+	return strconv.Itoa(target.illust)
+}
+
+func parseBookmarkTarget(data string) (target bookmarkTarget, err error) {
+	parts := strings.SplitN(data, "|", 2)
+	target.illust, err = strconv.Atoi(parts[0])
+	target.private = len(parts) == 2 && parts[1] == "private"
+	return
+}
+
+// bookmarksPage is the payload of the paging buttons of /bookmarks
+type bookmarksPage struct {
+	offset  int
+	private bool
+}
+
+func (page bookmarksPage) String() string {
+	if page.private {
+		return fmt.Sprintf("%d|private", page.offset)
+	}
+	return strconv.Itoa(page.offset)
+}
+
+func parseBookmarksPage(data string) (page bookmarksPage, err error) {
+	target, err := parseBookmarkTarget(data)
+	return bookmarksPage{offset: target.illust, private: target.private}, err
+}
+
+// canBookmark tells if the bookmark buttons are shown to the user of the
+// request, the pixiv account belongs to the bot admins
+func (b *Bot) canBookmark(req *request) bool {
+	return b.Bookmarks != nil && b.isBotAdmin(req.user)
+}
+
+// addBookmark bookmarks the work to the pixiv account, without tags the
+// tags of the work are used like the pixiv bookmark dialog suggests
+func (b *Bot) addBookmark(req *request, target bookmarkTarget, tags []string) (err error) {
+	req = req.with("illust", target.illust, "private", target.private)
+	defer func() { req.done("bookmark", err) }()
+	if tags == nil {
+		var details *pixiv.DetailsApi
+		details, err = b.Details.GetDetails(req.ctx, target.illust, req.lang)
+		if err != nil {
+			return
+		}
+		tags = details.IllustDetails.Tags
+	}
+	err = b.Bookmarks.AddBookmark(req.ctx, target.illust, target.private, tags)
+	if err != nil {
+		bookmarksAdded.Inc("error")
+		if errors.Is(err, pixiv.ErrRestricted) {
+			err = req.wrapf(err, BOOKMARK_EXPIRED)
+		}
+		return
+	}
+	bookmarksAdded.Inc("ok")
+	return
+}
+
+// bookmarkedMessage confirms the bookmark with its visibility
+func bookmarkedMessage(req *request, target bookmarkTarget) string {
+	if target.private {
+		return req.tr(BOOKMARKED_PRIVATE)
+	}
+	return req.tr(BOOKMARKED)
+}
+
+// formatBookmarks lists the works of the page, masked works were deleted or
+// hidden since they were bookmarked
+func formatBookmarks(req *request, page bookmarksPage, bookmarks *pixiv.BookmarksApi) string {
+	var builder strings.Builder
+	if page.private {
+		builder.WriteString(req.tr(BOOKMARKS_PRIVATE, bookmarks.Total))
+	} else {
+		builder.WriteString(req.tr(BOOKMARKS_HEADER, bookmarks.Total))
+	}
+	for i, work := range bookmarks.Works {
+		if work.IsMasked {
+			fmt.Fprintf(&builder, "\n%d. %s", page.offset+i+1, req.tr(BOOKMARK_MASKED))
+			continue
+		}
+		fmt.Fprintf(&builder, "\n%d. <a href=\"https://www.pixiv.net/artworks/%s\">%s</a> - %s",
+			page.offset+i+1, work.ID, html.EscapeString(work.Title), html.EscapeString(work.UserName))
+	}
+	return builder.String()
+}
+
+// makeBookmarksMenu has a preview button per work, the previews have the post
+// buttons, and the paging buttons
+func makeBookmarksMenu(page bookmarksPage, bookmarks *pixiv.BookmarksApi) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	var rows []tb.Row
+	var buttons []tb.Btn
+	for i, work := range bookmarks.Works {
+		if work.IsMasked {
+			continue
+		}
+		buttons = append(buttons, menu.Data(strconv.Itoa(page.offset+i+1), "preview", work.ID.String()))
+		if len(buttons) == 5 {
+			rows = append(rows, menu.Row(buttons...))
+			buttons = nil
+		}
+	}
+	if len(buttons) > 0 {
+		rows = append(rows, menu.Row(buttons...))
+	}
+	var paging []tb.Btn
+	if page.offset > 0 {
+		previous := page
+		previous.offset -= BOOKMARKS_PAGE_SIZE
+		if previous.offset < 0 {
+			previous.offset = 0
+		}
+		paging = append(paging, menu.Data("◀", "bookmarks-page", previous.String()))
+	}
+	if page.offset+len(bookmarks.Works) < bookmarks.Total {
+		next := page
+		next.offset += BOOKMARKS_PAGE_SIZE
+		paging = append(paging, menu.Data("▶", "bookmarks-page", next.String()))
+	}
+	if len(paging) > 0 {
+		rows = append(rows, menu.Row(paging...))
+	}
+	menu.Inline(rows...)
+	return menu
+}
+
+// showBookmarks sends the page of the bookmarks, or edits the list when
+// paging
+func (b *Bot) showBookmarks(req *request, msg *tb.Message, page bookmarksPage, edit bool) (err error) {
+	req = req.with("offset", page.offset, "private", page.private)
+	defer func() { req.done("bookmarks", err) }()
+	bookmarks, err := b.Bookmarks.GetBookmarks(req.ctx, page.offset, BOOKMARKS_PAGE_SIZE, page.private, req.lang)
+	if errors.Is(err, pixiv.ErrRestricted) {
+		return req.wrapf(err, BOOKMARK_EXPIRED)
+	} else if err != nil {
+		return
+	}
+	if len(bookmarks.Works) == 0 && page.offset == 0 {
+		return req.errorf(BOOKMARKS_EMPTY)
+	}
+	options := &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyMarkup:           makeBookmarksMenu(page, bookmarks),
+	}
+	text := formatBookmarks(req, page, bookmarks)
+	if edit {
+		_, err = b.Telegram.Edit(msg, text, options)
+	} else {
+		_, err = b.Telegram.Send(msg.Chat, text, options)
+	}
+	return
+}
+
+// handleBookmark is the bookmark button of the previews
+func (b *Bot) handleBookmark(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	target, err := parseBookmarkTarget(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if !b.canBookmark(req) {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(NO_PERMISSION), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.addBookmark(req, target, nil)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c, &tb.CallbackResponse{Text: bookmarkedMessage(req, target)})
+}
+
+// handleBookmarkCommand bookmarks the work with the given tags, like the
+// button without them
+func (b *Bot) handleBookmarkCommand(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if b.Bookmarks == nil {
+		req.send(b.Telegram, m.Chat, req.tr(BOOKMARK_DISABLED), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.canBookmark(req) {
+		req.send(b.Telegram, m.Chat, req.tr(NO_PERMISSION), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		req.send(b.Telegram, m.Chat, req.tr(BOOKMARK_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	illust, err := parseIllustId(args[0])
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(BOOKMARK_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	target := bookmarkTarget{illust: illust}
+	args = args[1:]
+	if len(args) > 0 && args[0] == "private" {
+		target.private = true
+		args = args[1:]
+	}
+	var tags []string
+	if len(args) > 0 {
+		tags = args
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.addBookmark(req, target, tags)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	req.send(b.Telegram, m.Chat, bookmarkedMessage(req, target), &tb.SendOptions{ReplyTo: m})
+}
+
+// handleBookmarks lists the bookmarks of the account, the previews of the
+// works can be posted like any other
+func (b *Bot) handleBookmarks(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if b.Bookmarks == nil {
+		req.send(b.Telegram, m.Chat, req.tr(BOOKMARK_DISABLED), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.canBookmark(req) {
+		req.send(b.Telegram, m.Chat, req.tr(NO_PERMISSION), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	page := bookmarksPage{private: strings.TrimSpace(m.Payload) == "private"}
+	err := b.limit(req)
+	if err == nil {
+		err = b.showBookmarks(req, m, page, false)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+	}
+}
+
+func (b *Bot) handleBookmarksPage(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	page, err := parseBookmarksPage(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if !b.canBookmark(req) {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(NO_PERMISSION), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.showBookmarks(req, c.Message, page, true)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
@@ -0,0 +1,230 @@
+// Package bot implements the telegram handlers of pixivbot, the dependencies
+// are interfaces so the handlers can be tested with fakes.
+package bot
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/codehz/pixivbot/archive"
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/source"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// Sender is the part of the telegram bot api used by the handlers,
+// implemented by *tb.Bot
+type Sender interface {
+	Send(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error)
+	SendAlbum(to tb.Recipient, a tb.Album, options ...interface{}) ([]tb.Message, error)
+	Respond(c *tb.Callback, resp ...*tb.CallbackResponse) error
+	Delete(msg tb.Editable) error
+	Notify(to tb.Recipient, action tb.ChatAction) error
+	Answer(query *tb.Query, resp *tb.QueryResponse) error
+	Edit(msg tb.Editable, what interface{}, options ...interface{}) (*tb.Message, error)
+	EditCaption(msg tb.Editable, caption string, options ...interface{}) (*tb.Message, error)
+	EditReplyMarkup(msg tb.Editable, markup *tb.ReplyMarkup) (*tb.Message, error)
+	EditMedia(msg tb.Editable, media tb.InputMedia, options ...interface{}) (*tb.Message, error)
+	ChatByID(id string) (*tb.Chat, error)
+	AdminsOf(chat *tb.Chat) ([]tb.ChatMember, error)
+	GetFile(file *tb.File) (io.ReadCloser, error)
+}
+
+// Router registers handlers, implemented by *tb.Bot
+type Router interface {
+	Handle(endpoint interface{}, handler interface{})
+}
+
+// DetailsProvider fetches the details of illusts
+type DetailsProvider interface {
+	GetDetails(ctx context.Context, id int, lang string) (*pixiv.DetailsApi, error)
+	GetRelated(ctx context.Context, id int, limit int, lang string) ([]pixiv.RelatedIllust, error)
+	GetSeries(ctx context.Context, id int, lang string) (*pixiv.Series, error)
+	GetComments(ctx context.Context, id int, offset int, limit int, lang string) (*pixiv.CommentsApi, error)
+	GetReplies(ctx context.Context, comment string, page int, lang string) (*pixiv.CommentsApi, error)
+	GetUserWorks(ctx context.Context, user int, lang string) ([]int, error)
+}
+
+// ImageFetcher turns images into files for uploading, implemented by
+// downloader.ImageFetcher
+type ImageFetcher interface {
+	FetchImage(ctx context.Context, source downloader.ImageSource) (tb.File, error)
+}
+
+// InlineImageFetcher returns the image urls for inline results, implemented
+// by downloader.InlineImageFetcher
+type InlineImageFetcher interface {
+	GetImageUrl(source downloader.ImageSource) (string, error)
+}
+
+// Archiver keeps a copy of the posted works, implemented by
+// archive.Archive
+type Archiver interface {
+	Save(ctx context.Context, details *pixiv.DetailsApi) (archive.Entry, error)
+	Search(query string, limit int) ([]archive.Entry, error)
+}
+
+// SourceFinder finds the pixiv works images come from, implemented by
+// source.SauceNAO
+type SourceFinder interface {
+	Find(ctx context.Context, image io.Reader) ([]source.Match, error)
+}
+
+// Bookmarker is the pixiv account of the bookmark buttons, implemented by
+// pixiv.Session
+type Bookmarker interface {
+	AddBookmark(ctx context.Context, illust int, private bool, tags []string) error
+	GetBookmarks(ctx context.Context, offset int, limit int, private bool, lang string) (*pixiv.BookmarksApi, error)
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+// PixivAPI is the DetailsProvider of the pixiv package
+type PixivAPI struct{}
+
+func (PixivAPI) GetDetails(ctx context.Context, id int, lang string) (*pixiv.DetailsApi, error) {
+	return pixiv.GetDetils(ctx, id, lang)
+}
+
+func (PixivAPI) GetRelated(ctx context.Context, id int, limit int, lang string) ([]pixiv.RelatedIllust, error) {
+	return pixiv.GetRelated(ctx, id, limit, lang)
+}
+
+func (PixivAPI) GetSeries(ctx context.Context, id int, lang string) (*pixiv.Series, error) {
+	return pixiv.GetSeries(ctx, id, lang)
+}
+
+func (PixivAPI) GetComments(ctx context.Context, id int, offset int, limit int, lang string) (*pixiv.CommentsApi, error) {
+	return pixiv.GetComments(ctx, id, offset, limit, lang)
+}
+
+func (PixivAPI) GetReplies(ctx context.Context, comment string, page int, lang string) (*pixiv.CommentsApi, error) {
+	return pixiv.GetReplies(ctx, comment, page, lang)
+}
+
+func (PixivAPI) GetUserWorks(ctx context.Context, user int, lang string) ([]int, error) {
+	return pixiv.GetUserWorks(ctx, user, lang)
+}
+
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+const DEFAULT_CACHE_TTL = 10 * time.Minute
+
+// Options are the dependencies of the Bot, Telegram, Me, Images and Inline
+// are required
+type Options struct {
+	Telegram Sender
+	// Me is the bot user, it is looked up in admin lists
+	Me      *tb.User
+	Details DetailsProvider
+	Images  ImageFetcher
+	Inline  InlineImageFetcher
+	Store   storage.Storage
+	Clock   Clock
+	Tags    *TagDictionary
+	// Admins are the users allowed to edit the tag dictionary
+	Admins   map[int]bool
+	CacheTTL time.Duration
+	Limits   Limits
+	// Archive is optional, the works posted to channels are archived
+	Archive Archiver
+	// Sources is optional, it enables /source and the search of the photos
+	// sent in private chats
+	Sources SourceFinder
+	// Bookmarks is optional, it enables the bookmark buttons and
+	// /bookmarks for the bot admins
+	Bookmarks Bookmarker
+}
+
+type Bot struct {
+	Options
+	cache       *chatCache
+	chats       *chatRegistry
+	jobs        *jobTracker
+	userLimiter *limiter
+	chatLimiter *limiter
+	downloads   downloadSlots
+	// background tracks the archiving and hashing started by posts
+	background sync.WaitGroup
+}
+
+// New creates the bot, missing optional dependencies are replaced by the
+// pixiv api, the system clock and in memory storage
+func New(options Options) *Bot {
+	if options.Details == nil {
+		options.Details = PixivAPI{}
+	}
+	if options.Store == nil {
+		options.Store = storage.NewMemory()
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock{}
+	}
+	if options.Tags == nil {
+		options.Tags = NewTagDictionary()
+	}
+	if options.Admins == nil {
+		options.Admins = map[int]bool{}
+	}
+	if options.CacheTTL == 0 {
+		options.CacheTTL = DEFAULT_CACHE_TTL
+	}
+	if options.Limits.ZipWorks == 0 {
+		options.Limits.ZipWorks = ZIP_WORKS
+	}
+	if options.Limits.ZipPartSize == 0 {
+		options.Limits.ZipPartSize = ZIP_PART_SIZE
+	}
+	var downloads downloadSlots
+	if options.Limits.Downloads > 0 {
+		downloads = make(downloadSlots, options.Limits.Downloads)
+		options.Images = limitedImageFetcher{fetcher: options.Images, slots: downloads}
+	}
+	b := &Bot{Options: options, downloads: downloads}
+	b.Images = hashingImageFetcher{fetcher: b.Images}
+	b.cache = newChatCache(options.Telegram, options.Clock, options.CacheTTL)
+	b.chats = &chatRegistry{clock: options.Clock, chats: map[int64]chatInfo{}}
+	b.jobs = &jobTracker{clock: options.Clock, jobs: map[*job]struct{}{}}
+	b.userLimiter = newLimiter(options.Clock, options.Limits.User)
+	b.chatLimiter = newLimiter(options.Clock, options.Limits.Chat)
+	return b
+}
+
+// Filter is the middleware of the poller, it counts the update, remembers
+// its chat and drops it if the user or chat is denied
+func (b *Bot) Filter(upd *tb.Update) bool {
+	b.trackUpdate(upd)
+	return countUpdate(upd) && b.allowUpdate(upd)
+}
+
+// Reload reads the tag dictionary again and drops the cache
+func (b *Bot) Reload() error {
+	if err := b.Tags.Reload(); err != nil {
+		return err
+	}
+	b.cache.clear()
+	return nil
+}
+
+// Post sends the illust to the chat, target is a chat id or @username
+func (b *Bot) Post(target string, illust int, album bool) error {
+	chat, err := b.cache.chatByID(target)
+	if err != nil {
+		return err
+	}
+	req := b.newRequest(chat, nil).with("source", "api")
+	if album {
+		return b.makeAlbum(req, chat, illust)
+	}
+	return b.makePixiv(req, chat, illust, nil)
+}
@@ -0,0 +1,401 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func assertEqual(t *testing.T, a interface{}, b interface{}) {
+	if a != b {
+		t.Fatalf("%s != %s", a, b)
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+}
+
+func expectError(t *testing.T, err error, message string) {
+	if err != nil {
+		if err.Error() == message {
+			return
+		}
+		t.Fatalf("expected error with message `%s`, but got `%s`", message, err.Error())
+	}
+	t.Fatalf("expected error but not")
+}
+
+func TestParseIllust(t *testing.T) {
+	value, err := parseIllustId("92065303")
+	assertNoError(t, err)
+	assertEqual(t, value, 92065303)
+	value, err = parseIllustId("https://www.pixiv.net/artworks/92065303")
+	assertNoError(t, err)
+	assertEqual(t, value, 92065303)
+	value, err = parseIllustId("https://www.pixiv.net/member_illust.php?mode=medium&illust_id=92065303")
+	assertNoError(t, err)
+	assertEqual(t, value, 92065303)
+	_, err = parseIllustId("http://www.pixiv.net")
+	expectError(t, err, "not a pixiv link")
+	_, err = parseIllustId("https://www.pixiv.net/invalid")
+	expectError(t, err, "not a illust link")
+	_, err = parseIllustUrl(" ")
+	expectError(t, err, "not a pixiv link")
+}
+
+func TestParseImagePage(t *testing.T) {
+	for source, expected := range map[string][2]int{
+		"https://i.pximg.net/c/540x540_70/img-master/img/2021/08/21/00/00/02/1002_p2_master1200.jpg": {1002, 2},
+		"https://i.pximg.net/img-original/img/2021/08/20/00/00/01/1001_p0.png":                       {1001, 0},
+		"https://i.pximg.net/c/540x540_70/img-master/img/2021/08/22/00/00/03/1003_master1200.jpg":    {1003, 0},
+	} {
+		illust, page, ok := parseImagePage(source)
+		assertEqual(t, ok, true)
+		assertEqual(t, [2]int{illust, page}, expected)
+	}
+	_, _, ok := parseImagePage("https://i.pximg.net/user-profile/img/avatar.jpg")
+	assertEqual(t, ok, false)
+}
+
+func TestIsAscii(t *testing.T) {
+	assertEqual(t, isAscii("background"), true)
+	assertEqual(t, isAscii("风景"), false)
+}
+
+func TestRenderCaption(t *testing.T) {
+	data := captionData{
+		Title:  "title",
+		URL:    "https://www.pixiv.net/artworks/1",
+		Author: captionUser{Name: "author", URL: "https://www.pixiv.net/users/1"},
+		Tags: []captionTag{
+			{Hashtag: "#a", Display: "#a"},
+			{Hashtag: "#b", Display: "#b"},
+		},
+		Stats:       captionStats{Likes: 1, Bookmarks: 2, Views: 3},
+		Description: "<b>desc</b>",
+	}
+	caption, err := renderCaption(defaultTemplates["zh-CN"], data)
+	assertNoError(t, err)
+	assertEqual(t, caption, "#a <a href=\"https://www.pixiv.net/artworks/1\"><b>title</b></a> - <a href=\"https://www.pixiv.net/users/1\"><i>author</i></a>的插画\n👏 1 ❤️ 2 👁️ 3\n<b>desc</b>\n#a #b ")
+
+	data.Description = strings.Repeat("很长的说明", 300)
+	caption, err = renderCaption(defaultTemplates["zh-CN"], data)
+	assertNoError(t, err)
+	assertEqual(t, captionLength(caption) <= MAX_CAPTION_LENGTH, true)
+	assertEqual(t, strings.Contains(caption, "<b>title</b>"), true)
+	assertEqual(t, strings.HasSuffix(caption, "…\n#a #b "), true)
+
+	data.Description = ""
+	data.Title = strings.Repeat("长", 2000)
+	caption, err = renderCaption(defaultTemplates["zh-CN"], data)
+	assertNoError(t, err)
+	assertEqual(t, captionLength(caption) <= MAX_CAPTION_LENGTH, true)
+	assertEqual(t, strings.Contains(caption, "author"), true)
+}
+
+func TestValidateTemplate(t *testing.T) {
+	for _, lang := range locales {
+		assertNoError(t, validateTemplate(getDefaultTemplate(lang)))
+	}
+	assertEqual(t, validateTemplate("{{.Title") != nil, true)
+	assertEqual(t, validateTemplate("{{.Unknown}}") != nil, true)
+	// works without tags fail the index
+	assertEqual(t, validateTemplate("{{(index .Tags 0).Tag}}") != nil, true)
+	assertNoError(t, validateTemplate("{{range .Tags}}{{.Tag}}{{end}}"))
+}
+
+func TestHashtagify(t *testing.T) {
+	assertEqual(t, hashtagify("風景"), "風景")
+	assertEqual(t, hashtagify("Fate/Grand Order"), "Fate_Grand_Order")
+	assertEqual(t, hashtagify(" hello,  world! "), "hello_world")
+	assertEqual(t, hashtagify("東方Project"), "東方Project")
+	assertEqual(t, hashtagify("10000users入り"), "10000users入り")
+	assertEqual(t, hashtagify("2021"), "_2021")
+	assertEqual(t, hashtagify("・"), "")
+}
+
+func TestTagDictionary(t *testing.T) {
+	dict, err := LoadTagDictionary(t.TempDir() + "/tags.json")
+	assertNoError(t, err)
+	assertNoError(t, dict.add("landscape", "風景", "Scenery"))
+	assertEqual(t, dict.canonical("風景", ""), "landscape")
+	assertEqual(t, dict.canonical("scenery", ""), "landscape")
+	assertEqual(t, dict.canonical("LANDSCAPE", ""), "landscape")
+	assertEqual(t, dict.canonical("空", "scenery"), "landscape")
+	assertEqual(t, dict.canonical("空", ""), "")
+	assertNoError(t, dict.add("scenery", "Scenery"))
+	assertEqual(t, dict.canonical("scenery", ""), "scenery")
+	assertEqual(t, dict.canonical("風景", ""), "landscape")
+	reloaded, err := LoadTagDictionary(dict.path)
+	assertNoError(t, err)
+	assertEqual(t, reloaded.canonical("風景", ""), "landscape")
+	assertNoError(t, reloaded.remove("landscape"))
+	assertEqual(t, reloaded.canonical("風景", ""), "")
+
+	// a canonical hashtag is no longer the synonym of another entry
+	assertNoError(t, dict.add("scenery", "landscape"))
+	assertNoError(t, dict.add("landscape", "風景"))
+	assertEqual(t, dict.canonical("landscape", ""), "landscape")
+	canonical, synonyms := dict.synonyms("scenery")
+	assertEqual(t, canonical, "scenery")
+	assertEqual(t, len(synonyms), 0)
+	// synonyms like the canonical hashtag are ignored
+	assertNoError(t, dict.add("landscape", "Landscape", "山"))
+	assertEqual(t, dict.canonical("風景", ""), "landscape")
+	assertEqual(t, dict.canonical("山", ""), "landscape")
+	canonical, synonyms = dict.synonyms("landscape")
+	assertEqual(t, strings.Join(synonyms, ","), "山,風景")
+	// a canonical hashtag differing only by case replaces the entry
+	assertNoError(t, dict.add("Landscape", "海"))
+	canonical, synonyms = dict.synonyms("landscape")
+	assertEqual(t, canonical, "Landscape")
+	assertEqual(t, strings.Join(synonyms, ","), "山,海,風景")
+	_, ok := dict.entries["landscape"]
+	assertEqual(t, ok, false)
+
+	tag := tagData{titleWithURL: titleWithURL{title: "風景", url: "u"}, translation: "scenery", canonical: "landscape"}
+	assertEqual(t, tag.display(TAG_STYLE_ORIGINAL), "#風景")
+	assertEqual(t, tag.display(TAG_STYLE_TRANSLATION), "#scenery")
+	assertEqual(t, tag.display(TAG_STYLE_CANONICAL), "#landscape")
+	assertEqual(t, tag.display(TAG_STYLE_AUTO), tag.get())
+}
+
+func TestParseUser(t *testing.T) {
+	value, err := parseUserId("11")
+	assertNoError(t, err)
+	assertEqual(t, value, 11)
+	value, err = parseUserId("https://www.pixiv.net/users/11")
+	assertNoError(t, err)
+	assertEqual(t, value, 11)
+	value, err = parseUserId("https://www.pixiv.net/en/users/11")
+	assertNoError(t, err)
+	assertEqual(t, value, 11)
+	value, err = parseUserId("https://www.pixiv.net/member.php?id=11")
+	assertNoError(t, err)
+	assertEqual(t, value, 11)
+	_, err = parseUserId("https://www.pixiv.net/artworks/11")
+	expectError(t, err, "not a user link")
+}
+
+func TestCheckBlocked(t *testing.T) {
+	tags := &TagDictionary{entries: map[string][]string{"landscape": {"風景"}}}
+	tags.rebuild()
+	b := New(Options{Tags: tags})
+	chat := &tb.Chat{ID: 1}
+	details := &pixiv.DetailsApi{}
+	details.AuthorDetails.UserID = "11"
+	details.IllustDetails.Tags = []string{"オリジナル"}
+	details.IllustDetails.DisplayTags = []pixiv.DisplayTags{{Tag: "風景", Translation: "scenery"}}
+	assertNoError(t, b.checkBlocked(b.newRequest(chat, nil), details))
+
+	b.Store.Update(1, func(s *storage.ChatSettings) { s.BlockedTags = []string{"Landscape"} })
+	err := b.checkBlocked(b.newRequest(chat, nil), details)
+	expectError(t, err, tr(DEFAULT_LOCALE, BLOCKED_TAG, "Landscape"))
+
+	b.Store.Update(1, func(s *storage.ChatSettings) {
+		s.BlockedTags = []string{"オリジナル"}
+		s.BlockSilent = true
+	})
+	err = b.checkBlocked(b.newRequest(chat, nil), details)
+	assertEqual(t, err.(blockedError).silent, true)
+
+	b.Store.Update(1, func(s *storage.ChatSettings) {
+		s.BlockedTags = nil
+		s.BlockedUsers = []string{"11"}
+	})
+	expectError(t, b.checkBlocked(b.newRequest(chat, nil), details), tr(DEFAULT_LOCALE, BLOCKED_USER))
+}
+
+func TestPostTarget(t *testing.T) {
+	input, target := splitTarget("92065303 -> @channel")
+	assertEqual(t, input, "92065303")
+	assertEqual(t, target, "@channel")
+	input, target = splitTarget("92065303")
+	assertEqual(t, input, "92065303")
+	assertEqual(t, target, "")
+
+	data := postTarget{illust: 92065303, chat: -1001234567890, album: true}.String()
+	parsed, err := parsePostTarget(data)
+	assertNoError(t, err)
+	assertEqual(t, parsed, postTarget{illust: 92065303, chat: -1001234567890, album: true})
+
+	destinations := []*tb.Chat{{ID: -1001, Username: "First"}, {ID: -1002}}
+	assertEqual(t, matchDestination(destinations, "@first"), destinations[0])
+	assertEqual(t, matchDestination(destinations, "-1002"), destinations[1])
+	assertEqual(t, matchDestination(destinations, "@other"), (*tb.Chat)(nil))
+}
+
+func TestAdminServer(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	h.telegram.addChat(tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel"})
+	server := &AdminServer{
+		Token:     "secret",
+		Bot:       h.app,
+		GetMe:     func() error { return nil },
+		PingPixiv: func(ctx context.Context) error { return errors.New("unreachable") },
+	}
+	handler := server.Handler()
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	assertEqual(t, do("GET", "/readyz", "", "").Code, http.StatusServiceUnavailable)
+	server.SetReady()
+	assertEqual(t, do("GET", "/readyz", "", "").Code, http.StatusOK)
+
+	health := do("GET", "/healthz", "", "")
+	assertEqual(t, health.Code, http.StatusServiceUnavailable)
+	var status map[string]string
+	assertNoError(t, json.Unmarshal(health.Body.Bytes(), &status))
+	assertEqual(t, status["telegram"], "ok")
+	assertEqual(t, status["pixiv"], "unreachable")
+
+	assertEqual(t, do("GET", "/api/chats", "", "").Code, http.StatusUnauthorized)
+	assertEqual(t, do("GET", "/api/chats", "wrong", "").Code, http.StatusUnauthorized)
+
+	h.app.chats.seen(&tb.Chat{ID: -1005, Type: tb.ChatGroup, Title: "group"})
+	chats := do("GET", "/api/chats", "secret", "")
+	assertEqual(t, chats.Code, http.StatusOK)
+	var list []chatInfo
+	assertNoError(t, json.Unmarshal(chats.Body.Bytes(), &list))
+	found := false
+	for _, info := range list {
+		found = found || (info.ID == -1005 && info.Title == "group")
+	}
+	assertEqual(t, found, true)
+	assertEqual(t, do("GET", "/api/chats/-1005", "secret", "").Code, http.StatusOK)
+	assertEqual(t, do("GET", "/api/chats/-1", "secret", "").Code, http.StatusNotFound)
+
+	assertNoError(t, h.app.Store.Subscribe(storage.Subscription{Chat: -1005, Kind: "user", Target: "11"}))
+	assertNoError(t, h.app.Store.Subscribe(storage.Subscription{Chat: -1006, Kind: "tag", Target: "風景"}))
+	var subs []storage.Subscription
+	assertNoError(t, json.Unmarshal(do("GET", "/api/subscriptions", "secret", "").Body.Bytes(), &subs))
+	assertEqual(t, len(subs), 2)
+	assertNoError(t, json.Unmarshal(do("GET", "/api/subscriptions?chat=-1006", "secret", "").Body.Bytes(), &subs))
+	assertEqual(t, len(subs), 1)
+	assertEqual(t, subs[0].Target, "風景")
+	assertEqual(t, do("GET", "/api/subscriptions?chat=x", "secret", "").Code, http.StatusBadRequest)
+
+	done := h.app.jobs.begin(h.app.newRequest(nil, nil), "preview", 42, -1005)
+	var queue []job
+	assertNoError(t, json.Unmarshal(do("GET", "/api/queue", "secret", "").Body.Bytes(), &queue))
+	assertEqual(t, len(queue), 1)
+	assertEqual(t, queue[0].Illust, 42)
+	done()
+	assertNoError(t, json.Unmarshal(do("GET", "/api/queue", "secret", "").Body.Bytes(), &queue))
+	assertEqual(t, len(queue), 0)
+
+	assertEqual(t, do("POST", "/api/post", "secret", `{"chat": "@channel"}`).Code, http.StatusBadRequest)
+	assertEqual(t, do("POST", "/api/post", "secret", `{"chat": "-1002", "illust": 1002, "album": true}`).Code, http.StatusOK)
+	album := h.expectCalls("sendMediaGroup", 1)[0]
+	assertEqual(t, album.params["chat_id"], "-1002")
+	assertEqual(t, do("POST", "/api/reload", "secret", "").Code, http.StatusOK)
+}
+
+func TestErrorMessage(t *testing.T) {
+	req := New(Options{}).newRequest(&tb.Chat{ID: 2}, nil)
+	deleted := fmt.Errorf("preview: %w", &pixiv.Error{Kind: pixiv.ErrDeleted, Message: "該当作品は削除されました"})
+	assertEqual(t, errorMessage(req, deleted), tr(DEFAULT_LOCALE, ERROR_DELETED))
+	tooLarge := &downloader.Error{Kind: downloader.ErrTooLarge, URL: "https://i.pximg.net/a.png"}
+	assertEqual(t, errorMessage(req, tooLarge), tr(DEFAULT_LOCALE, ERROR_TOO_LARGE))
+	assertEqual(t, errorMessage(req, &tb.APIError{Code: 400, Description: "Bad Request: chat not found"}), tr(DEFAULT_LOCALE, ERROR_TELEGRAM))
+	assertEqual(t, errorMessage(req, errors.New("boom")), tr(DEFAULT_LOCALE, ERROR_UNKNOWN))
+	wrapped := req.wrapf(errors.New("boom"), NO_ADMIN)
+	assertEqual(t, errorMessage(req, wrapped), tr(DEFAULT_LOCALE, NO_ADMIN))
+	assertEqual(t, errors.Unwrap(wrapped).Error(), "boom")
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	return clock.now
+}
+
+func TestLimiter(t *testing.T) {
+	rate, err := ParseRate("2/1m")
+	assertNoError(t, err)
+	assertEqual(t, rate, Rate{Count: 2, Per: time.Minute})
+	_, err = ParseRate("0/1m")
+	expectError(t, err, `invalid rate "0/1m", expected a positive count`)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := newLimiter(clock, rate)
+	wait, _ := l.take(1)
+	assertEqual(t, wait, time.Duration(0))
+	wait, _ = l.take(1)
+	assertEqual(t, wait, time.Duration(0))
+	wait, warned := l.take(1)
+	assertEqual(t, wait, 30*time.Second)
+	assertEqual(t, warned, false)
+	_, warned = l.take(1)
+	assertEqual(t, warned, true)
+	wait, _ = l.take(2)
+	assertEqual(t, wait, time.Duration(0))
+
+	clock.now = clock.now.Add(30 * time.Second)
+	wait, _ = l.take(1)
+	assertEqual(t, wait, time.Duration(0))
+	clock.now = clock.now.Add(time.Hour)
+	l.take(3)
+	assertEqual(t, len(l.buckets), 1)
+
+	// a refund can't fill the bucket over its capacity
+	l.take(4)
+	l.refund(4)
+	l.refund(4)
+	assertEqual(t, l.buckets[4].tokens, 2.0)
+	l.refund(5)
+	assertEqual(t, len(l.buckets), 2)
+
+	// the user keeps the token of a request the chat limit rejects
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Limits.User = Rate{Count: 2, Per: time.Hour}
+		options.Limits.Chat = Rate{Count: 1, Per: time.Hour}
+	})
+	group := &tb.Chat{ID: -1001, Type: tb.ChatGroup}
+	assertNoError(t, h.app.limit(h.app.newRequest(group, testUser)))
+	assertEqual(t, h.app.limit(h.app.newRequest(group, testUser)) != nil, true)
+	assertNoError(t, h.app.limit(h.app.newRequest(privateChat(testUser), testUser)))
+	assertEqual(t, h.app.limit(h.app.newRequest(privateChat(testUser), testUser)) != nil, true)
+}
+
+func TestDownloadSlots(t *testing.T) {
+	slots := make(downloadSlots, 1)
+	release, err := slots.acquire(context.Background())
+	assertNoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = slots.acquire(ctx)
+	assertEqual(t, err, context.Canceled)
+	release()
+	release()
+	assertEqual(t, len(slots), 0)
+	_, err = slots.acquire(context.Background())
+	assertNoError(t, err)
+
+	var unlimited downloadSlots
+	_, err = unlimited.acquire(ctx)
+	assertNoError(t, err)
+}
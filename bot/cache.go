@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// PRUNE_INTERVAL is how often the expired entries of the pixiv cache are
+// deleted, they are only skipped on reads
+const PRUNE_INTERVAL = time.Hour
+
+var cacheRequests = metrics.NewCounter("pixivbot_cache_requests_total", "Chat cache lookups by cache and result.", "cache", "result")
+
+func countLookup(name string, hit bool) {
+	if hit {
+		cacheRequests.Inc(name, "hit")
+	} else {
+		cacheRequests.Inc(name, "miss")
+	}
+}
+
+type cachedChat struct {
+	chat    *tb.Chat
+	expires time.Time
+}
+
+type cachedAdmins struct {
+	members []tb.ChatMember
+	expires time.Time
+}
+
+// chatCache caches chat lookups and admin lists to stay below the flood
+// limits, entries expire after ttl or when a member update of the chat comes
+type chatCache struct {
+	mutex    sync.Mutex
+	telegram Sender
+	clock    Clock
+	ttl      time.Duration
+	chats    map[string]cachedChat
+	admins   map[int64]cachedAdmins
+}
+
+func newChatCache(telegram Sender, clock Clock, ttl time.Duration) *chatCache {
+	return &chatCache{
+		telegram: telegram,
+		clock:    clock,
+		ttl:      ttl,
+		chats:    map[string]cachedChat{},
+		admins:   map[int64]cachedAdmins{},
+	}
+}
+
+func (cache *chatCache) chatByID(id string) (*tb.Chat, error) {
+	now := cache.clock.Now()
+	cache.mutex.Lock()
+	entry, ok := cache.chats[id]
+	cache.mutex.Unlock()
+	hit := ok && now.Before(entry.expires)
+	countLookup("chat", hit)
+	if hit {
+		return entry.chat, nil
+	}
+	chat, err := cache.telegram.ChatByID(id)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	cache.chats[id] = cachedChat{chat: chat, expires: now.Add(cache.ttl)}
+	cache.mutex.Unlock()
+	return chat, nil
+}
+
+func (cache *chatCache) adminsOf(chat *tb.Chat) ([]tb.ChatMember, error) {
+	now := cache.clock.Now()
+	cache.mutex.Lock()
+	entry, ok := cache.admins[chat.ID]
+	cache.mutex.Unlock()
+	hit := ok && now.Before(entry.expires)
+	countLookup("admins", hit)
+	if hit {
+		return entry.members, nil
+	}
+	members, err := cache.telegram.AdminsOf(chat)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	cache.admins[chat.ID] = cachedAdmins{members: members, expires: now.Add(cache.ttl)}
+	cache.mutex.Unlock()
+	return members, nil
+}
+
+// invalidate drops everything cached about the chat
+func (cache *chatCache) invalidate(id int64) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	delete(cache.admins, id)
+	delete(cache.chats, strconv.FormatInt(id, 10))
+	for key, entry := range cache.chats {
+		if entry.chat.ID == id || entry.chat.LinkedChatID == id {
+			delete(cache.chats, key)
+		}
+	}
+}
+
+// clear drops all entries
+func (cache *chatCache) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.chats = map[string]cachedChat{}
+	cache.admins = map[int64]cachedAdmins{}
+}
+
+// PruneLoop deletes the expired entries of the stored cache every interval,
+// it never returns
+func (b *Bot) PruneLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		count, err := b.Store.PruneCache()
+		if err != nil {
+			logging.Default.Error("pruning the cache failed", "error", err)
+			continue
+		}
+		logging.Default.Debug("cache pruned", "deleted", count)
+	}
+}
@@ -0,0 +1,297 @@
+package bot
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	"github.com/codehz/pixivbot/pixiv"
+)
+
+// Telegram rejects captions longer than this (counted after entity parsing)
+const MAX_CAPTION_LENGTH = 1024
+
+// DEFAULT_TEMPLATE is completed with the localized CAPTION_BY and
+// CAPTION_SERIES lines
+const DEFAULT_TEMPLATE = `{{if .Tags}}{{(index .Tags 0).Hashtag}} {{end}}<a href="{{.URL}}"><b>{{html .Title}}</b></a> - %s
+{{if .Series}}%s
+{{end}}👏 {{.Stats.Likes}} ❤️ {{.Stats.Bookmarks}} 👁️ {{.Stats.Views}}
+{{.Description}}
+{{range .Tags}}{{.Display}} {{end}}`
+
+const DEFAULT_AUTHOR = `<a href="{{.Author.URL}}"><i>{{html .Author.Name}}</i></a>`
+
+const DEFAULT_SERIES = `<a href="{{.Series.URL}}">{{html .Series.Title}}</a> #{{.Series.Order}}`
+
+// captionUser describes the author of the work
+type captionUser struct {
+	ID      string
+	Name    string
+	Account string
+	URL     string
+}
+
+// captionTag describes a single tag of the work
+type captionTag struct {
+	Tag         string
+	Translation string
+	// Canonical is the hashtag from the tag dictionary, empty if not found
+	Canonical string
+	URL       string
+	// Hashtag is the tag itself rendered in the tag style of the chat
+	Hashtag string
+	// Display is the tag rendered in the tag style of the chat, with its
+	// translation in the auto style
+	Display string
+}
+
+type captionStats struct {
+	Likes     int
+	Bookmarks int
+	Views     int
+}
+
+// captionSeries describes the series of the work
+type captionSeries struct {
+	ID    string
+	Title string
+	// Order is the position in the series, starting from 1
+	Order int
+	URL   string
+}
+
+// captionData is the data model exposed to caption templates
+type captionData struct {
+	ID    string
+	Title string
+	URL   string
+	// Original is the url of the original image of the first page
+	Original string
+	Author   captionUser
+	// Series is nil if the work is not in a series
+	Series *captionSeries
+	Tags   []captionTag
+	Stats  captionStats
+	// Description is sanitized html
+	Description string
+	Created     time.Time
+	PageCount   int
+	// Restrict is 0 for public works
+	Restrict int
+	// XRestrict is 0 for all ages, 1 for R-18 and 2 for R-18G
+	XRestrict int
+	// Rating is the human readable form of XRestrict, empty for all ages
+	Rating string
+}
+
+func atoi(s string) int {
+	value, _ := strconv.Atoi(s)
+	return value
+}
+
+func getRating(xrestrict int) string {
+	switch xrestrict {
+	case 0:
+		return ""
+	case 1:
+		return "R-18"
+	case 2:
+		return "R-18G"
+	}
+	return fmt.Sprintf("R-%d", xrestrict)
+}
+
+func makeCaptionData(style string, extracted extractedInfo, details *pixiv.DetailsApi) (data captionData) {
+	illust := details.IllustDetails
+	data.ID = illust.ID
+	data.Title = illust.Title
+	data.URL = extracted.artwork.url
+	data.Original = illust.URLOriginal
+	data.Author = captionUser{
+		ID:      details.AuthorDetails.UserID,
+		Name:    details.AuthorDetails.UserName,
+		Account: details.AuthorDetails.UserAccount,
+		URL:     extracted.author.url,
+	}
+	if series := illust.SeriesNavData; series != nil && series.ID != "" {
+		data.Series = &captionSeries{
+			ID:    series.ID,
+			Title: series.Title,
+			Order: series.Order,
+			URL:   getSeriesURL(details.AuthorDetails.UserID, series.ID),
+		}
+	}
+	data.Tags = make([]captionTag, 0, len(extracted.tags))
+	seen := map[string]bool{}
+	for _, tag := range extracted.tags {
+		display := tag.display(style)
+		if seen[display] {
+			// synonyms merged by the dictionary
+			continue
+		}
+		seen[display] = true
+		hashtag := tag.getLink("#")
+		if style != "" && style != TAG_STYLE_AUTO {
+			hashtag = display
+		}
+		data.Tags = append(data.Tags, captionTag{
+			Tag:         tag.title,
+			Translation: tag.translation,
+			Canonical:   hashtagify(tag.canonical),
+			URL:         tag.url,
+			Hashtag:     hashtag,
+			Display:     display,
+		})
+	}
+	data.Stats = captionStats{
+		Likes:     atoi(illust.RatingCount),
+		Bookmarks: illust.BookmarkUserTotal,
+		Views:     atoi(illust.RatingView),
+	}
+	data.Description = htmlPolicy.Sanitize(fixString(illust.CommentHTML))
+	data.Created = time.Unix(int64(illust.UploadTimestamp), 0)
+	data.PageCount = atoi(illust.PageCount)
+	data.Restrict = atoi(illust.Restrict)
+	data.XRestrict = atoi(illust.XRestrict)
+	data.Rating = getRating(data.XRestrict)
+	return
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("caption").Parse(text)
+}
+
+func executeTemplate(tmpl *template.Template, data captionData) (string, error) {
+	var buffer bytes.Buffer
+	err := tmpl.Execute(&buffer, data)
+	return buffer.String(), err
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func stripHTML(s string) string {
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+}
+
+// captionLength counts the visible length of the html caption like telegram
+// does, in utf-16 code units
+func captionLength(s string) int {
+	return len(utf16.Encode([]rune(stripHTML(s))))
+}
+
+// fitCaption finds the largest n in [0, max] that renders a short enough
+// caption, returns -1 if even n = 0 is too long
+func fitCaption(max int, render func(n int) (string, error)) (string, int, error) {
+	low, high, best := 0, max, -1
+	var result string
+	for low <= high {
+		mid := (low + high) / 2
+		caption, err := render(mid)
+		if err != nil {
+			return "", -1, err
+		}
+		if captionLength(caption) <= MAX_CAPTION_LENGTH {
+			result, best = caption, mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	return result, best, nil
+}
+
+func truncateText(text []rune, n int) string {
+	if n >= len(text) {
+		return html.EscapeString(string(text))
+	}
+	if n == 0 {
+		return ""
+	}
+	return html.EscapeString(string(text[:n])) + "…"
+}
+
+// renderCaption executes the template and shortens the caption to fit in
+// MAX_CAPTION_LENGTH, the description is dropped first, then the tags, and
+// the title is only shortened as the last resort.
+func renderCaption(tmpl *template.Template, data captionData) (string, error) {
+	caption, err := executeTemplate(tmpl, data)
+	if err != nil || captionLength(caption) <= MAX_CAPTION_LENGTH {
+		return caption, err
+	}
+	description := []rune(stripHTML(data.Description))
+	caption, best, err := fitCaption(len(description), func(n int) (string, error) {
+		data.Description = truncateText(description, n)
+		return executeTemplate(tmpl, data)
+	})
+	if err != nil || best >= 0 {
+		return caption, err
+	}
+	data.Description = ""
+	tags := data.Tags
+	caption, best, err = fitCaption(len(tags), func(n int) (string, error) {
+		data.Tags = tags[:n]
+		return executeTemplate(tmpl, data)
+	})
+	if err != nil || best >= 0 {
+		return caption, err
+	}
+	data.Tags = nil
+	title := []rune(data.Title)
+	caption, best, err = fitCaption(len(title), func(n int) (string, error) {
+		data.Title = string(title[:n])
+		return executeTemplate(tmpl, data)
+	})
+	if err != nil || best >= 0 {
+		return caption, err
+	}
+	data.Title = ""
+	caption, err = executeTemplate(tmpl, data)
+	return truncateText([]rune(stripHTML(caption)), MAX_CAPTION_LENGTH-1), err
+}
+
+func getTemplate(req *request) *template.Template {
+	text := req.settings.Template
+	if text == "" {
+		return defaultTemplates[req.lang]
+	}
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return defaultTemplates[req.lang]
+	}
+	return tmpl
+}
+
+func getCaption(req *request, extracted extractedInfo, details *pixiv.DetailsApi) (string, error) {
+	style := req.settings.TagStyle
+	return renderCaption(getTemplate(req), makeCaptionData(style, extracted, details))
+}
+
+// validateTemplate checks the template against a sample work and an empty
+// one, as renderCaption drops the tags and title to fit, so broken templates
+// are rejected before they are saved
+func validateTemplate(text string) error {
+	tmpl, err := parseTemplate(text)
+	if err != nil {
+		return err
+	}
+	sample := captionData{
+		ID:          "0",
+		Title:       "title",
+		Author:      captionUser{ID: "0", Name: "author"},
+		Tags:        []captionTag{{Tag: "tag"}},
+		Description: "description",
+		Created:     time.Unix(0, 0),
+		PageCount:   1,
+	}
+	if _, err = executeTemplate(tmpl, sample); err != nil {
+		return err
+	}
+	empty := captionData{ID: "0", Author: captionUser{ID: "0"}, Created: time.Unix(0, 0), PageCount: 1}
+	_, err = executeTemplate(tmpl, empty)
+	return err
+}
@@ -0,0 +1,224 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// COMMENTS_PAGE_SIZE is how many root comments are shown per page
+const COMMENTS_PAGE_SIZE = 5
+
+// COMMENT_REPLIES_LIMIT caps the replies shown under a root comment, the
+// replies of the artist are shown first
+const COMMENT_REPLIES_LIMIT = 3
+
+const COMMENTS_CACHE_TTL = 10 * time.Minute
+
+// commentsPage is the callback data of the comments buttons, the author is
+// kept so their replies can be marked without fetching the details again
+type commentsPage struct {
+	illust int
+	author string
+	page   int
+}
+
+func (page commentsPage) String() string {
+	return fmt.Sprintf("%d:%s:%d", page.illust, page.author, page.page)
+}
+
+func parseCommentsPage(data string) (page commentsPage, err error) {
+	parts := strings.SplitN(data, ":", 3)
+	if len(parts) != 3 {
+		return page, fmt.Errorf("invalid page %q", data)
+	}
+	page.illust, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	page.author = parts[1]
+	page.page, err = strconv.Atoi(parts[2])
+	if err == nil && page.page < 0 {
+		err = fmt.Errorf("invalid page %q", data)
+	}
+	return
+}
+
+// commentThread is a root comment with some of its replies
+type commentThread struct {
+	Comment pixiv.Comment   `json:"comment"`
+	Replies []pixiv.Comment `json:"replies,omitempty"`
+}
+
+type commentsData struct {
+	Threads []commentThread `json:"threads"`
+	HasNext bool            `json:"has_next"`
+}
+
+// pickReplies keeps the replies of the author and fills the rest with the
+// others, in their original order
+func pickReplies(replies []pixiv.Comment, author string) []pixiv.Comment {
+	keep := map[int]bool{}
+	for i, reply := range replies {
+		if len(keep) < COMMENT_REPLIES_LIMIT && reply.UserID == author {
+			keep[i] = true
+		}
+	}
+	for i := range replies {
+		if len(keep) < COMMENT_REPLIES_LIMIT {
+			keep[i] = true
+		}
+	}
+	result := make([]pixiv.Comment, 0, len(keep))
+	for i, reply := range replies {
+		if keep[i] {
+			result = append(result, reply)
+		}
+	}
+	return result
+}
+
+// getComments fetches the page with the replies of its comments, failing
+// replies are only logged so the page is still shown
+func (b *Bot) getComments(req *request, page commentsPage) (*commentsData, error) {
+	key := fmt.Sprintf("comments:%d:%d:%s", page.illust, page.page, req.lang)
+	result := &commentsData{}
+	data, ok := b.Store.CacheGet(key)
+	if ok && json.Unmarshal(data, result) == nil {
+		return result, nil
+	}
+	roots, err := b.Details.GetComments(req.ctx, page.illust, page.page*COMMENTS_PAGE_SIZE, COMMENTS_PAGE_SIZE, req.lang)
+	if err != nil {
+		return nil, err
+	}
+	result.HasNext = roots.HasNext
+	for _, root := range roots.Comments {
+		thread := commentThread{Comment: root}
+		if root.HasReplies {
+			replies, err := b.Details.GetReplies(req.ctx, root.ID, 1, req.lang)
+			if err != nil {
+				req.log.Warn("failed to fetch replies", "comment", root.ID, "error", err)
+			} else {
+				thread.Replies = pickReplies(replies.Comments, page.author)
+			}
+		}
+		result.Threads = append(result.Threads, thread)
+	}
+	data, _ = json.Marshal(result)
+	if err := b.Store.CachePut(key, data, COMMENTS_CACHE_TTL); err != nil {
+		req.log.Warn("failed to cache comments", "error", err)
+	}
+	return result, nil
+}
+
+// formatComment renders the comment as html, emoji placeholders like
+// (heart) are kept as text
+func formatComment(req *request, comment pixiv.Comment, author string) string {
+	name := html.EscapeString(comment.UserName)
+	if comment.UserID == author {
+		name += " " + req.tr(COMMENT_AUTHOR)
+	}
+	text := html.EscapeString(comment.Comment)
+	if text == "" && comment.StampID != "" {
+		text = req.tr(COMMENT_STAMP)
+	}
+	return fmt.Sprintf("<b>%s</b>: %s", name, text)
+}
+
+func formatComments(req *request, page commentsPage, data *commentsData) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, `<a href="https://www.pixiv.net/artworks/%d">%s</a>`, page.illust, req.tr(COMMENTS_HEADER, page.page+1))
+	for _, thread := range data.Threads {
+		builder.WriteString("\n\n" + formatComment(req, thread.Comment, page.author))
+		for _, reply := range thread.Replies {
+			builder.WriteString("\n  ↳ " + formatComment(req, reply, page.author))
+		}
+	}
+	return builder.String()
+}
+
+func makeCommentsMenu(req *request, page commentsPage, hasNext bool) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	var buttons []tb.Btn
+	if page.page > 0 {
+		previous := page
+		previous.page--
+		buttons = append(buttons, menu.Data("◀", "comments-page", previous.String()))
+	}
+	if hasNext {
+		next := page
+		next.page++
+		buttons = append(buttons, menu.Data("▶", "comments-page", next.String()))
+	}
+	rows := []tb.Row{menu.Row(menu.Data(req.tr(BUTTON_CLOSE), "comments-close"))}
+	if len(buttons) > 0 {
+		rows = append([]tb.Row{menu.Row(buttons...)}, rows...)
+	}
+	menu.Inline(rows...)
+	return menu
+}
+
+// showComments sends the page as a reply to the preview, or edits the
+// comments message when paging
+func (b *Bot) showComments(req *request, msg *tb.Message, page commentsPage, edit bool) (err error) {
+	req = req.with("illust", page.illust, "page", page.page)
+	defer func() { req.done("comments", err) }()
+	data, err := b.getComments(req, page)
+	if err != nil {
+		return
+	}
+	if len(data.Threads) == 0 && page.page == 0 {
+		return req.errorf(COMMENTS_EMPTY)
+	}
+	options := &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyMarkup:           makeCommentsMenu(req, page, data.HasNext),
+	}
+	text := formatComments(req, page, data)
+	if edit {
+		_, err = b.Telegram.Edit(msg, text, options)
+	} else {
+		options.ReplyTo = msg
+		_, err = b.Telegram.Send(msg.Chat, text, options)
+	}
+	return
+}
+
+func (b *Bot) respondComments(c *tb.Callback, edit bool) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	page, err := parseCommentsPage(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.showComments(req, c.Message, page, edit)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
+
+func (b *Bot) handleComments(c *tb.Callback) {
+	b.respondComments(c, false)
+}
+
+func (b *Bot) handleCommentsPage(c *tb.Callback) {
+	b.respondComments(c, true)
+}
+
+func (b *Bot) handleCommentsClose(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	req.delete(b.Telegram, c.Message)
+	req.respond(b.Telegram, c)
+}
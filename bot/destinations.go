@@ -0,0 +1,158 @@
+package bot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// getDestinations lists the channels the chat can post to, the linked channel
+// comes first followed by the registered ones
+func (b *Bot) getDestinations(chat *tb.Chat) (result []*tb.Chat) {
+	seen := map[int64]bool{}
+	if linked := b.getLinkedChat(chat); linked != nil {
+		seen[linked.ID] = true
+		result = append(result, linked)
+	}
+	for _, id := range b.Store.Get(chat.ID).Channels {
+		if seen[id] {
+			continue
+		}
+		channel, err := b.cache.chatByID(strconv.FormatInt(id, 10))
+		if err != nil {
+			continue
+		}
+		seen[id] = true
+		result = append(result, channel)
+	}
+	return
+}
+
+// canPost checks both the user and the bot are admins of the destination
+func (b *Bot) canPost(req *request, chat *tb.Chat, user *tb.User) (bool, error) {
+	members, err := b.cache.adminsOf(chat)
+	if err != nil {
+		return false, req.wrapf(err, NO_ADMIN)
+	}
+	var userOk, botOk bool
+	for _, member := range members {
+		if member.User.ID == user.ID {
+			userOk = true
+		}
+		if member.User.ID == b.Me.ID {
+			botOk = member.Role == tb.Creator || member.Rights.CanPostMessages
+		}
+	}
+	return userOk && botOk, nil
+}
+
+// allowedDestinations filters the destinations of the chat by canPost
+func (b *Bot) allowedDestinations(req *request, chat *tb.Chat, user *tb.User) ([]*tb.Chat, error) {
+	destinations := b.getDestinations(chat)
+	if len(destinations) == 0 {
+		return nil, req.errorf(NO_LINK)
+	}
+	var result []*tb.Chat
+	for _, destination := range destinations {
+		ok, err := b.canPost(req, destination, user)
+		if err != nil || !ok {
+			continue
+		}
+		result = append(result, destination)
+	}
+	if len(result) == 0 {
+		return nil, req.errorf(NO_PERMISSION)
+	}
+	return result, nil
+}
+
+func chatName(chat *tb.Chat) string {
+	if chat.Username != "" {
+		return "@" + chat.Username
+	}
+	if chat.Title != "" {
+		return chat.Title
+	}
+	return strconv.FormatInt(chat.ID, 10)
+}
+
+// matchDestination finds the destination by @username or id
+func matchDestination(destinations []*tb.Chat, name string) *tb.Chat {
+	for _, destination := range destinations {
+		if strings.EqualFold("@"+destination.Username, name) || strconv.FormatInt(destination.ID, 10) == name {
+			return destination
+		}
+	}
+	return nil
+}
+
+// splitTarget splits `<illust> -> @channel` into the illust and the target
+func splitTarget(payload string) (string, string) {
+	parts := strings.SplitN(payload, "->", 2)
+	if len(parts) == 1 {
+		return strings.TrimSpace(payload), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// resolveTarget picks the destination of /post and /postalbum, the linked
+// channel is used when no target is given, explicit targets are permission
+// checked like the post buttons
+func (b *Bot) resolveTarget(req *request, m *tb.Message, target string) (*tb.Chat, error) {
+	if target == "" {
+		linked := b.getLinkedChat(m.Chat)
+		if linked == nil {
+			return nil, req.errorf(NO_LINK)
+		}
+		return linked, nil
+	}
+	destination := matchDestination(b.getDestinations(m.Chat), target)
+	if destination == nil {
+		return nil, req.errorf(CHANNEL_NOT_FOUND, target)
+	}
+	ok, err := b.canPost(req, destination, m.Sender)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, req.errorf(NO_PERMISSION)
+	}
+	return destination, nil
+}
+
+// postTarget is the payload of the buttons in the channel picker
+type postTarget struct {
+	illust int
+	chat   int64
+	album  bool
+}
+
+func (target postTarget) String() string {
+	album := 0
+	if target.album {
+		album = 1
+	}
+	return fmt.Sprintf("%d|%d|%d", target.illust, target.chat, album)
+}
+
+func parsePostTarget(data string) (target postTarget, err error) {
+	var album int
+	_, err = fmt.Sscanf(strings.ReplaceAll(data, "|", " "), "%d %d %d", &target.illust, &target.chat, &album)
+	target.album = album == 1
+	return
+}
+
+// makePicker builds the channel picker shown by the post buttons
+func makePicker(req *request, destinations []*tb.Chat, illust int, album bool) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	rows := make([]tb.Row, 0, len(destinations)+1)
+	for _, destination := range destinations {
+		target := postTarget{illust: illust, chat: destination.ID, album: album}
+		rows = append(rows, menu.Row(menu.Data("→ "+chatName(destination), "post-to", target.String())))
+	}
+	rows = append(rows, menu.Row(menu.Data(req.tr(BUTTON_BACK), "post-back", strconv.Itoa(illust))))
+	menu.Inline(rows...)
+	return menu
+}
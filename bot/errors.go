@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"errors"
+
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/source"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// userError is shown to the user as is, the cause is only logged
+type userError struct {
+	message string
+	err     error
+}
+
+func (err userError) Error() string {
+	return err.message
+}
+
+func (err userError) Unwrap() error {
+	return err.err
+}
+
+// errorf returns a localized error for the user
+func (req *request) errorf(key string, args ...interface{}) error {
+	return userError{message: req.tr(key, args...)}
+}
+
+// wrapf is errorf keeping the cause for errors.Is/As and the log
+func (req *request) wrapf(err error, key string, args ...interface{}) error {
+	return userError{message: req.tr(key, args...), err: err}
+}
+
+var friendlyErrors = []struct {
+	kind error
+	key  string
+}{
+	{pixiv.ErrDeleted, ERROR_DELETED},
+	{pixiv.ErrNotFound, ERROR_NOT_FOUND},
+	{downloader.ErrNotFound, ERROR_NOT_FOUND},
+	{pixiv.ErrRestricted, ERROR_RESTRICTED},
+	{pixiv.ErrRateLimited, ERROR_RATE_LIMITED},
+	{pixiv.ErrNetwork, ERROR_NETWORK},
+	{downloader.ErrNetwork, ERROR_NETWORK},
+	{downloader.ErrTooLarge, ERROR_TOO_LARGE},
+	{pixiv.ErrDecodeFailed, ERROR_DECODE_FAILED},
+	{downloader.ErrDecodeFailed, ERROR_DECODE_FAILED},
+	{pixiv.ErrServer, ERROR_SERVER},
+	{source.ErrRateLimited, SOURCE_RATE_LIMITED},
+	{source.ErrBackend, SOURCE_FAILED},
+}
+
+// errorMessage maps the error to a localized message for the user, the
+// details are logged instead of shown
+func errorMessage(req *request, err error) string {
+	var user userError
+	if errors.As(err, &user) {
+		if user.err != nil {
+			req.log.Warn("request failed", "error", user.err)
+		}
+		return user.message
+	}
+	var blocked blockedError
+	if errors.As(err, &blocked) {
+		return blocked.reason
+	}
+	key := ERROR_UNKNOWN
+	var apiError *tb.APIError
+	for _, friendly := range friendlyErrors {
+		if errors.Is(err, friendly.kind) {
+			key = friendly.key
+			break
+		}
+	}
+	if key == ERROR_UNKNOWN && errors.As(err, &apiError) {
+		key = ERROR_TELEGRAM
+	}
+	req.log.Warn("request failed", "error", err, "reply", key)
+	return req.tr(key)
+}
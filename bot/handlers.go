@@ -0,0 +1,704 @@
+package bot
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// commandText returns the full text after the command, including following
+// lines which are dropped from Message.Payload
+func commandText(m *tb.Message) string {
+	index := strings.IndexFunc(m.Text, unicode.IsSpace)
+	if index < 0 {
+		return ""
+	}
+	return strings.TrimSpace(m.Text[index:])
+}
+
+// Register adds the handlers of the commands, the buttons and the inline
+// mode to the router
+func (b *Bot) Register(router Router) {
+	router.Handle("/help", b.handleHelp)
+	router.Handle("/start", b.handleHelp)
+	router.Handle("/lang", b.handleLang)
+	router.Handle("/template", b.handleTemplate)
+	router.Handle("/tagstyle", b.handleTagStyle)
+	router.Handle("/tagmap", b.handleTagMap)
+	router.Handle("/tagunmap", b.handleTagUnmap)
+	router.Handle("/block", b.handleBlock)
+	router.Handle("/unblock", b.handleUnblock)
+	router.Handle("/blocklist", b.handleBlocklist)
+	router.Handle("/channels", b.handleChannels)
+	router.Handle(tb.OnChatMember, b.handleMemberUpdate)
+	router.Handle(tb.OnMyChatMember, b.handleMemberUpdate)
+	router.Handle("/refresh", b.handleRefresh)
+	router.Handle("/pixiv", b.handlePixiv)
+	router.Handle("/album", b.handleAlbum)
+	router.Handle("/post", b.handlePostCommand)
+	router.Handle("/postalbum", b.handlePostAlbumCommand)
+	router.Handle("/series", b.handleSeriesCommand)
+	router.Handle("/archive", b.handleArchive)
+	router.Handle("/zip", b.handleZip)
+	router.Handle("/source", b.handleSource)
+	router.Handle("/similar", b.handleSimilar)
+	router.Handle("/bookmark", b.handleBookmarkCommand)
+	router.Handle("/bookmarks", b.handleBookmarks)
+	router.Handle(&tb.InlineButton{Unique: "post"}, func(c *tb.Callback) {
+		b.handlePost(c, false)
+	})
+	router.Handle(&tb.InlineButton{Unique: "post-multi"}, func(c *tb.Callback) {
+		b.handlePost(c, true)
+	})
+	router.Handle(&tb.InlineButton{Unique: "post-to"}, b.handlePostTo)
+	router.Handle(&tb.InlineButton{Unique: "post-back"}, b.handlePostBack)
+	router.Handle(&tb.InlineButton{Unique: "related"}, b.handleRelated)
+	router.Handle(&tb.InlineButton{Unique: "related-page"}, b.handleRelatedPage)
+	// related-preview is kept for the carousels sent before the generic
+	// preview button
+	router.Handle(&tb.InlineButton{Unique: "related-preview"}, b.handlePreview)
+	router.Handle(&tb.InlineButton{Unique: "preview"}, b.handlePreview)
+	router.Handle(&tb.InlineButton{Unique: "related-back"}, b.handleRelatedBack)
+	router.Handle(&tb.InlineButton{Unique: "comments"}, b.handleComments)
+	router.Handle(&tb.InlineButton{Unique: "comments-page"}, b.handleCommentsPage)
+	router.Handle(&tb.InlineButton{Unique: "comments-close"}, b.handleCommentsClose)
+	router.Handle(&tb.InlineButton{Unique: "series"}, b.handleSeries)
+	router.Handle(&tb.InlineButton{Unique: "series-post"}, b.handleSeriesPost)
+	router.Handle(&tb.InlineButton{Unique: "series-to"}, b.handleSeriesTo)
+	router.Handle(&tb.InlineButton{Unique: "series-back"}, b.handleSeriesBack)
+	router.Handle(&tb.InlineButton{Unique: "bookmark"}, b.handleBookmark)
+	router.Handle(&tb.InlineButton{Unique: "bookmarks-page"}, b.handleBookmarksPage)
+	router.Handle(tb.OnText, b.handleText)
+	router.Handle(tb.OnPhoto, b.handlePhoto)
+	router.Handle(tb.OnQuery, b.handleQuery)
+}
+
+func (b *Bot) handleHelp(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	req.send(b.Telegram, m.Chat, helpMessages[req.lang], &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               m,
+	})
+}
+
+func (b *Bot) handleLang(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	text := strings.TrimSpace(m.Payload)
+	if text == "" {
+		req.send(b.Telegram, m.Chat, req.tr(LANG_CURRENT, req.lang, strings.Join(locales, ", ")), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	lang := ""
+	if text != "auto" {
+		lang = matchLocale(text)
+		if lang == "" {
+			req.send(b.Telegram, m.Chat, req.tr(INVALID_LANG, strings.Join(locales, ", ")))
+			return
+		}
+	}
+	err := b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+		s.Locale = lang
+	})
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req = b.newRequest(m.Chat, m.Sender)
+	req.send(b.Telegram, m.Chat, req.tr(LANG_SAVED, req.lang), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleTemplate(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	text := commandText(m)
+	if text == "" {
+		current := b.Store.Get(m.Chat.ID).Template
+		if current == "" {
+			current = getDefaultTemplate(req.lang)
+		}
+		req.send(b.Telegram, m.Chat, templateHelps[req.lang]+"\n<pre>"+html.EscapeString(current)+"</pre>", &tb.SendOptions{
+			DisableWebPagePreview: true,
+			ParseMode:             "html",
+			ReplyTo:               m,
+		})
+		return
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	reply := req.tr(TEMPLATE_SAVED)
+	if text == "reset" {
+		text = ""
+		reply = req.tr(TEMPLATE_RESET)
+	} else if err := validateTemplate(text); err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_TEMPLATE, err))
+		return
+	}
+	err := b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+		s.Template = text
+	})
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, reply, &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleTagStyle(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	style := strings.TrimSpace(m.Payload)
+	if style == "" {
+		current := b.Store.Get(m.Chat.ID).TagStyle
+		if current == "" {
+			current = TAG_STYLE_AUTO
+		}
+		req.send(b.Telegram, m.Chat, req.tr(TAG_STYLE_CURRENT, current, strings.Join(tagStyles, ", ")), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !isTagStyle(style) {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_TAG_STYLE, strings.Join(tagStyles, ", ")))
+		return
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	err := b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+		s.TagStyle = style
+	})
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, req.tr(TAG_STYLE_SAVED, style), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleTagMap(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		req.send(b.Telegram, m.Chat, req.tr(TAGMAP_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if len(args) == 1 {
+		canonical, synonyms := b.Tags.synonyms(args[0])
+		if canonical == "" {
+			req.send(b.Telegram, m.Chat, req.tr(TAGMAP_NOT_FOUND, args[0]), &tb.SendOptions{ReplyTo: m})
+			return
+		}
+		req.send(b.Telegram, m.Chat, req.tr(TAGMAP_ENTRY, hashtagify(canonical), strings.Join(synonyms, ", ")), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.isBotAdmin(m.Sender) {
+		req.send(b.Telegram, m.Chat, req.tr(NOT_BOT_ADMIN))
+		return
+	}
+	err := b.Tags.add(args[0], args[1:]...)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, req.tr(TAGMAP_SAVED, hashtagify(args[0])), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleTagUnmap(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	tag := strings.TrimSpace(m.Payload)
+	if tag == "" {
+		req.send(b.Telegram, m.Chat, req.tr(TAGMAP_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.isBotAdmin(m.Sender) {
+		req.send(b.Telegram, m.Chat, req.tr(NOT_BOT_ADMIN))
+		return
+	}
+	if canonical, _ := b.Tags.synonyms(tag); canonical == "" {
+		req.send(b.Telegram, m.Chat, req.tr(TAGMAP_NOT_FOUND, tag), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	err := b.Tags.remove(tag)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, req.tr(TAGMAP_REMOVED, tag), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleBlock(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	args := strings.SplitN(strings.TrimSpace(m.Payload), " ", 2)
+	if len(args) != 2 {
+		req.send(b.Telegram, m.Chat, req.tr(BLOCK_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	kind, value := args[0], strings.TrimSpace(args[1])
+	var update func(s *storage.ChatSettings)
+	reply := req.tr(BLOCK_ADDED, value)
+	switch kind {
+	case "tag":
+		update = func(s *storage.ChatSettings) {
+			s.BlockedTags = appendUnique(s.BlockedTags, value, sameTag)
+		}
+	case "user":
+		id, err := parseUserId(value)
+		if err != nil {
+			req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+			return
+		}
+		value = strconv.Itoa(id)
+		reply = req.tr(BLOCK_ADDED, value)
+		update = func(s *storage.ChatSettings) {
+			s.BlockedUsers = appendUnique(s.BlockedUsers, value, sameString)
+		}
+	case "mode":
+		if value != "silent" && value != "notice" {
+			req.send(b.Telegram, m.Chat, req.tr(BLOCK_USAGE), &tb.SendOptions{ReplyTo: m})
+			return
+		}
+		reply = req.tr(BLOCK_MODE_NOTICE)
+		if value == "silent" {
+			reply = req.tr(BLOCK_MODE_SILENT)
+		}
+		update = func(s *storage.ChatSettings) {
+			s.BlockSilent = value == "silent"
+		}
+	default:
+		req.send(b.Telegram, m.Chat, req.tr(BLOCK_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	err := b.Store.Update(m.Chat.ID, update)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, reply, &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleUnblock(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	args := strings.SplitN(strings.TrimSpace(m.Payload), " ", 2)
+	if len(args) != 2 || (args[0] != "tag" && args[0] != "user") {
+		req.send(b.Telegram, m.Chat, req.tr(BLOCK_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	kind, value := args[0], strings.TrimSpace(args[1])
+	if kind == "user" {
+		id, err := parseUserId(value)
+		if err != nil {
+			req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+			return
+		}
+		value = strconv.Itoa(id)
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	found := false
+	err := b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+		if kind == "tag" {
+			s.BlockedTags, found = removeItem(s.BlockedTags, value, sameTag)
+		} else {
+			s.BlockedUsers, found = removeItem(s.BlockedUsers, value, sameString)
+		}
+	})
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	if !found {
+		req.send(b.Telegram, m.Chat, req.tr(BLOCK_NOT_FOUND, value), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	req.send(b.Telegram, m.Chat, req.tr(BLOCK_REMOVED, value), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleBlocklist(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	current := b.Store.Get(m.Chat.ID)
+	mode := req.tr(BLOCK_MODE_NOTICE)
+	if current.BlockSilent {
+		mode = req.tr(BLOCK_MODE_SILENT)
+	}
+	req.send(b.Telegram, m.Chat, req.tr(BLOCK_LIST, strings.Join(current.BlockedTags, ", "), strings.Join(current.BlockedUsers, ", "), mode), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleChannels(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	args := strings.Fields(m.Payload)
+	if len(args) == 0 {
+		names := []string{}
+		for _, destination := range b.getDestinations(m.Chat) {
+			names = append(names, chatName(destination))
+		}
+		req.send(b.Telegram, m.Chat, req.tr(CHANNELS_LIST, strings.Join(names, "\n")), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if len(args) != 2 || (args[0] != "add" && args[0] != "remove") {
+		req.send(b.Telegram, m.Chat, req.tr(CHANNELS_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	channel, err := b.cache.chatByID(args[1])
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(CHANNEL_NOT_FOUND, args[1]))
+		return
+	}
+	if args[0] == "remove" {
+		err = b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+			channels := make([]int64, 0, len(s.Channels))
+			for _, id := range s.Channels {
+				if id != channel.ID {
+					channels = append(channels, id)
+				}
+			}
+			s.Channels = channels
+		})
+		if err != nil {
+			req.send(b.Telegram, m.Chat, errorMessage(req, err))
+			return
+		}
+		req.send(b.Telegram, m.Chat, req.tr(CHANNEL_REMOVED, chatName(channel)), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if channel.Type != tb.ChatChannel && channel.Type != tb.ChatChannelPrivate {
+		req.send(b.Telegram, m.Chat, req.tr(NOT_A_CHANNEL, args[1]))
+		return
+	}
+	ok, err := b.canPost(req, channel, m.Sender)
+	if err == nil && !ok {
+		err = req.errorf(NO_PERMISSION)
+	}
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	err = b.Store.Update(m.Chat.ID, func(s *storage.ChatSettings) {
+		for _, id := range s.Channels {
+			if id == channel.ID {
+				return
+			}
+		}
+		s.Channels = append(s.Channels[:len(s.Channels):len(s.Channels)], channel.ID)
+	})
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	req.send(b.Telegram, m.Chat, req.tr(CHANNEL_ADDED, chatName(channel)), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handleMemberUpdate(u *tb.ChatMemberUpdated) {
+	b.cache.invalidate(u.Chat.ID)
+}
+
+// handleRefresh drops the cached chat info, or refreshes the caption of the
+// post replied to
+func (b *Bot) handleRefresh(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if m.ReplyTo != nil {
+		b.handleRefreshPost(req, m)
+		return
+	}
+	b.cache.invalidate(m.Chat.ID)
+	for _, destination := range b.getDestinations(m.Chat) {
+		b.cache.invalidate(destination.ID)
+	}
+	// fetch again so the dropped destinations are cached again
+	b.getDestinations(m.Chat)
+	req.send(b.Telegram, m.Chat, req.tr(CACHE_REFRESHED), &tb.SendOptions{ReplyTo: m})
+}
+
+func (b *Bot) handlePixiv(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	value, err := parseIllustId(m.Payload)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+		return
+	}
+	if err = b.limit(req); err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	err = b.makePixiv(req, m.Chat, value, nil)
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	req.delete(b.Telegram, m)
+}
+
+func (b *Bot) handleAlbum(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	value, err := parseIllustId(m.Payload)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+		return
+	}
+	if err = b.limit(req); err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	err = b.makeAlbum(req, m.Chat, value)
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	req.delete(b.Telegram, m)
+}
+
+func (b *Bot) handlePostCommand(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	input, target := splitTarget(m.Payload)
+	value, err := parseIllustId(input)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+		return
+	}
+	if err = b.limit(req); err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	channel, err := b.resolveTarget(req, m, target)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	warning := b.duplicateWarning(req, channel, value)
+	err = b.makePixiv(req, channel, value, nil)
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	if warning != "" {
+		req.send(b.Telegram, m.Chat, warning)
+	}
+	req.delete(b.Telegram, m)
+}
+
+func (b *Bot) handlePostAlbumCommand(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	input, target := splitTarget(m.Payload)
+	value, err := parseIllustId(input)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(INVALID_INPUT))
+		return
+	}
+	if err = b.limit(req); err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	linked, err := b.resolveTarget(req, m, target)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return
+	}
+	warning := b.duplicateWarning(req, linked, value)
+	err = b.makeAlbum(req, linked, value)
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	if warning != "" {
+		req.send(b.Telegram, m.Chat, warning)
+	}
+	req.delete(b.Telegram, m)
+}
+
+func (b *Bot) handlePost(c *tb.Callback, album bool) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	value, err := parseIllustId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if err = b.limit(req); err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.notify(b.Telegram, chat, tb.Typing)
+	destinations, err := b.allowedDestinations(req, chat, c.Sender)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	if len(destinations) > 1 {
+		req.editMarkup(b.Telegram, c.Message, makePicker(req, destinations, value, album))
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(PICK_CHANNEL)})
+		return
+	}
+	warning := b.duplicateWarning(req, destinations[0], value)
+	if album {
+		err = b.makeAlbum(req, destinations[0], value)
+	} else {
+		err = b.makePixiv(req, destinations[0], value, nil)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c, postResponse(req, warning))
+	req.delete(b.Telegram, c.Message)
+}
+
+// postResponse answers the post buttons, the duplicate warning is shown as an
+// alert so it is not missed
+func postResponse(req *request, warning string) *tb.CallbackResponse {
+	if warning == "" {
+		return &tb.CallbackResponse{Text: req.tr(POST_SUCCESS)}
+	}
+	return &tb.CallbackResponse{Text: req.tr(POST_SUCCESS) + "\n" + warning, ShowAlert: true}
+}
+
+func (b *Bot) handlePostTo(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	target, err := parsePostTarget(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if err = b.limit(req); err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	destination := matchDestination(b.getDestinations(chat), strconv.FormatInt(target.chat, 10))
+	if destination == nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(CHANNEL_NOT_FOUND, target.chat), ShowAlert: true})
+		return
+	}
+	ok, err := b.canPost(req, destination, c.Sender)
+	if err == nil && !ok {
+		err = req.errorf(NO_PERMISSION)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	warning := b.duplicateWarning(req, destination, target.illust)
+	if target.album {
+		err = b.makeAlbum(req, destination, target.illust)
+	} else {
+		err = b.makePixiv(req, destination, target.illust, nil)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c, postResponse(req, warning))
+	req.delete(b.Telegram, c.Message)
+}
+
+func (b *Bot) handlePostBack(c *tb.Callback) {
+	req := b.newRequest(c.Message.Chat, c.Sender)
+	value, err := parseIllustId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if err = b.limit(req); err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	details, err := b.Details.GetDetails(req.ctx, value, req.lang)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.editMarkup(b.Telegram, c.Message, makeMenu(req, b.extractPixiv(details), details, true, b.canBookmark(req)))
+	req.respond(b.Telegram, c)
+}
+
+// handlePreview sends the preview of the work as a reply to the message of
+// the button, so the carousel or the series can be browsed further
+func (b *Bot) handlePreview(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	value, err := parseIllustId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.makePixiv(req, chat, value, c.Message)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
+
+func (b *Bot) handleText(m *tb.Message) {
+	value, err := parseIllustUrl(m.Text)
+	if err != nil {
+		return
+	}
+	req := b.newRequest(m.Chat, m.Sender)
+	if err = b.limit(req); err == nil {
+		err = b.makePixiv(req, m.Chat, value, m)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+}
+
+func (b *Bot) handleQuery(q *tb.Query) {
+	req := b.newRequest(&tb.Chat{ID: int64(q.From.ID), Type: tb.ChatPrivate}, &q.From)
+	value, err := parseIllustId(q.Text)
+	if err != nil {
+		req.answer(b.Telegram, q, &tb.QueryResponse{
+			Results:      tb.Results{},
+			CacheTime:    10,
+			SwitchPMText: req.tr(INVALID_INPUT),
+		})
+		return
+	}
+	req = req.with("illust", value)
+	err = b.limit(req)
+	var details *pixiv.DetailsApi
+	if err == nil {
+		details, err = b.Details.GetDetails(req.ctx, value, req.lang)
+	}
+	if err == nil {
+		err = b.checkBlocked(req, details)
+	}
+	if err != nil {
+		req.done("inline", err)
+		req.answer(b.Telegram, q, &tb.QueryResponse{
+			Results:      tb.Results{},
+			CacheTime:    10,
+			SwitchPMText: errorMessage(req, err),
+		})
+		return
+	}
+	extracted := b.extractPixiv(details)
+	result, err := b.getPhotoResult(req, extracted, details)
+	req.done("inline", err)
+	if err != nil {
+		req.answer(b.Telegram, q, &tb.QueryResponse{
+			Results:      tb.Results{},
+			CacheTime:    10,
+			SwitchPMText: errorMessage(req, err),
+		})
+		return
+	}
+	req.answer(b.Telegram, q, &tb.QueryResponse{
+		Results:   tb.Results{result},
+		CacheTime: 10,
+	})
+}
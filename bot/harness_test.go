@@ -0,0 +1,1093 @@
+package bot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codehz/pixivbot/archive"
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/source"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// pixivFixtures maps illust ids to the recorded responses in testdata/pixiv,
+// unknown ids are answered like deleted works
+var pixivFixtures = map[int]struct {
+	file   string
+	status int
+}{
+	1001: {"single.json", http.StatusOK},
+	1002: {"manga.json", http.StatusOK},
+	1003: {"ugoira.json", http.StatusOK},
+	1004: {"restricted.json", http.StatusForbidden},
+	1005: {"deleted.json", http.StatusNotFound},
+}
+
+// newFakePixiv serves the ajax api from the fixtures, image urls in the
+// fixtures are rewritten to imageHost. Every illust has the same related
+// works and comments, 1001 to 1003 are the series 77.
+func newFakePixiv(t *testing.T, imageHost string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			return
+		}
+		var fixture struct {
+			file   string
+			status int
+		}
+		switch {
+		case r.URL.Path == "/touch/ajax/illust/details":
+			id, _ := strconv.Atoi(r.URL.Query().Get("illust_id"))
+			var ok bool
+			fixture, ok = pixivFixtures[id]
+			if !ok {
+				fixture = pixivFixtures[1005]
+			}
+		case strings.HasPrefix(r.URL.Path, "/ajax/illust/") && strings.HasSuffix(r.URL.Path, "/recommend/init"):
+			fixture.file, fixture.status = "related.json", http.StatusOK
+		case r.URL.Path == "/ajax/series/77":
+			fixture.file, fixture.status = "series.json", http.StatusOK
+		case r.URL.Path == "/ajax/illusts/comments/roots":
+			fixture.file, fixture.status = "comments.json", http.StatusOK
+			if r.URL.Query().Get("offset") != "0" {
+				fixture.file = "comments_end.json"
+			}
+		case r.URL.Path == "/ajax/illusts/comments/replies":
+			fixture.file, fixture.status = "replies.json", http.StatusOK
+		case r.URL.Path == "/ajax/user/11/profile/all":
+			fixture.file, fixture.status = "profile.json", http.StatusOK
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", "pixiv", fixture.file))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data = bytes.ReplaceAll(data, []byte(downloader.DEFAULT_UPSTREAM), []byte(imageHost))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(fixture.status)
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// fakePximg serves a small png for every image path, like i.pximg.net it
+// refuses requests without the pixiv referer
+type fakePximg struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []string
+}
+
+// testImage is the png served for every image
+func testImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(1, 1, color.RGBA{R: 0xff, A: 0xff})
+	var encoded bytes.Buffer
+	png.Encode(&encoded, img)
+	return encoded.Bytes()
+}
+
+func newFakePximg(t *testing.T) *fakePximg {
+	fake := &fakePximg{}
+	encoded := testImage()
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		fake.requests = append(fake.requests, r.URL.Path)
+		fake.mutex.Unlock()
+		if r.Header.Get("Referer") != "https://www.pixiv.net/" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".zip") {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write([]byte("ugoira"))
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, ".png") && !strings.HasSuffix(r.URL.Path, ".jpg") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(encoded)
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (fake *fakePximg) paths() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string{}, fake.requests...)
+}
+
+// telegramCall is a recorded bot api request, non-string params are kept as
+// their json encoding
+type telegramCall struct {
+	method string
+	params map[string]string
+	files  map[string][]byte
+}
+
+// fakeTelegram is a bot api server answering every method with a plausible
+// result, getChat and getChatAdministrators answer from chats and admins
+type fakeTelegram struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	calls     []telegramCall
+	chats     map[int64]tb.Chat
+	admins    map[int64][]tb.ChatMember
+	messageID int
+	// files are the contents of the downloaded files by name, other files
+	// contain their name
+	files map[string][]byte
+}
+
+const FAKE_BOT_ID = 1
+
+func newFakeTelegram(t *testing.T) *fakeTelegram {
+	fake := &fakeTelegram{chats: map[int64]tb.Chat{}, admins: map[int64][]tb.ChatMember{}, files: map[string][]byte{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the files of getFile are downloaded from /file/bot<token>/<path>
+		if strings.HasPrefix(r.URL.Path, "/file/") {
+			name := path.Base(r.URL.Path)
+			fake.mutex.Lock()
+			data, ok := fake.files[name]
+			fake.mutex.Unlock()
+			if !ok {
+				data = []byte(name)
+			}
+			w.Write(data)
+			return
+		}
+		parts := strings.Split(r.URL.Path, "/")
+		call, err := readTelegramCall(r)
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		call.method = parts[len(parts)-1]
+		fake.mutex.Lock()
+		fake.calls = append(fake.calls, call)
+		fake.mutex.Unlock()
+		result, err := fake.answer(call)
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 400, "description": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+	}))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func readTelegramCall(r *http.Request) (call telegramCall, err error) {
+	call.params = map[string]string{}
+	call.files = map[string][]byte{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return call, err
+		}
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return call, nil
+			} else if err != nil {
+				return call, err
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return call, err
+			}
+			// telebot uploads readers without a file name, the content type
+			// tells them apart from the fields
+			if part.Header.Get("Content-Type") == "application/octet-stream" {
+				call.files[part.FormName()] = data
+			} else {
+				call.params[part.FormName()] = string(data)
+			}
+		}
+	}
+	var body map[string]interface{}
+	data, err := io.ReadAll(r.Body)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 || string(bytes.TrimSpace(data)) == "null" {
+		return
+	}
+	err = json.Unmarshal(data, &body)
+	for key, value := range body {
+		if text, ok := value.(string); ok {
+			call.params[key] = text
+		} else {
+			encoded, _ := json.Marshal(value)
+			call.params[key] = string(encoded)
+		}
+	}
+	return
+}
+
+func (fake *fakeTelegram) message(call telegramCall) map[string]interface{} {
+	fake.mutex.Lock()
+	fake.messageID++
+	id := fake.messageID
+	fake.mutex.Unlock()
+	chatID, _ := strconv.ParseInt(call.params["chat_id"], 10, 64)
+	message := map[string]interface{}{
+		"message_id": id,
+		"date":       time.Now().Unix(),
+		"chat":       map[string]interface{}{"id": chatID},
+		"caption":    call.params["caption"],
+		"text":       call.params["text"],
+		"photo":      []map[string]interface{}{{"file_id": fmt.Sprintf("photo-%d", id), "width": 4, "height": 4}},
+	}
+	if call.method == "sendDocument" {
+		message["document"] = map[string]interface{}{"file_id": fmt.Sprintf("document-%d", id)}
+	}
+	return message
+}
+
+func (fake *fakeTelegram) answer(call telegramCall) (interface{}, error) {
+	switch call.method {
+	case "getMe":
+		return tb.User{ID: FAKE_BOT_ID, IsBot: true, FirstName: "pixivbot", Username: "pixivbot"}, nil
+	case "getChat":
+		id, _ := strconv.ParseInt(call.params["chat_id"], 10, 64)
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		chat, ok := fake.chats[id]
+		if !ok {
+			return nil, fmt.Errorf("Bad Request: chat not found")
+		}
+		return chat, nil
+	case "getChatAdministrators":
+		id, _ := strconv.ParseInt(call.params["chat_id"], 10, 64)
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		return fake.admins[id], nil
+	case "getFile":
+		return tb.File{FileID: call.params["file_id"], FilePath: "photos/" + call.params["file_id"] + ".jpg"}, nil
+	case "sendPhoto", "sendMessage", "sendDocument", "editMessageReplyMarkup", "editMessageCaption", "editMessageMedia", "editMessageText":
+		return fake.message(call), nil
+	case "sendMediaGroup":
+		var media []interface{}
+		json.Unmarshal([]byte(call.params["media"]), &media)
+		result := make([]interface{}, len(media))
+		for i := range media {
+			result[i] = fake.message(call)
+		}
+		return result, nil
+	}
+	return true, nil
+}
+
+func (fake *fakeTelegram) addChat(chat tb.Chat, admins ...tb.ChatMember) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.chats[chat.ID] = chat
+	if len(admins) > 0 {
+		fake.admins[chat.ID] = admins
+	}
+}
+
+// recorded returns the calls of the method
+func (fake *fakeTelegram) recorded(method string) (result []telegramCall) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for _, call := range fake.calls {
+		if call.method == method {
+			result = append(result, call)
+		}
+	}
+	return
+}
+
+// harness runs the handlers against the fake servers, updates are processed
+// synchronously so the recorded calls can be checked right after
+type harness struct {
+	t        *testing.T
+	bot      *tb.Bot
+	app      *Bot
+	telegram *fakeTelegram
+	pximg    *fakePximg
+	update   int
+}
+
+// newHarness starts the bot with the upload method, configure changes the
+// options before the bot is created
+func newHarness(t *testing.T, upload downloader.UploadMethod, configure ...func(*Options)) *harness {
+	h := &harness{t: t, telegram: newFakeTelegram(t), pximg: newFakePximg(t)}
+	server := newFakePixiv(t, h.pximg.URL)
+	oldBaseURL, oldLogger := pixiv.BaseURL, logging.Default
+	t.Cleanup(func() {
+		pixiv.BaseURL, logging.Default = oldBaseURL, oldLogger
+	})
+	pixiv.BaseURL = server.URL
+	logging.Default = logging.New(io.Discard, logging.LOGFMT, logging.ERROR)
+	bot, err := tb.NewBot(tb.Settings{
+		URL:         h.telegram.URL,
+		Token:       "TOKEN",
+		Synchronous: true,
+		Poller:      &tb.LongPoller{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download, ok := upload.(downloader.Download); ok && download.OnHash == nil {
+		// like main, the uploaded images are hashed as they are decoded
+		download.OnHash = func(ctx context.Context, source string, hash downloader.ImageHash) {
+			h.app.RecordHash(ctx, source, hash)
+		}
+		upload = download
+	}
+	options := Options{
+		Telegram: bot,
+		Me:       bot.Me,
+		Images:   downloader.ImageFetcher{UploadMethod: upload},
+		Inline:   downloader.InlineImageFetcher{InlineImageSource: downloader.DirectURL{}},
+	}
+	for _, fn := range configure {
+		fn(&options)
+	}
+	h.app = New(options)
+	// the background work must not outlive the fake servers
+	t.Cleanup(h.app.background.Wait)
+	h.app.Register(bot)
+	h.bot = bot
+	return h
+}
+
+// process runs the update through the filter of the poller and the handlers
+func (h *harness) process(upd tb.Update) {
+	if h.app.Filter(&upd) {
+		h.bot.ProcessUpdate(upd)
+	}
+}
+
+// next returns a new id for the update and its message
+func (h *harness) next() int {
+	h.update++
+	return h.update
+}
+
+func (h *harness) message(chat *tb.Chat, user *tb.User, text string) {
+	id := h.next()
+	h.process(tb.Update{ID: id, Message: &tb.Message{ID: id, Chat: chat, Sender: user, Text: text, Unixtime: time.Now().Unix()}})
+}
+
+func (h *harness) callback(chat *tb.Chat, user *tb.User, unique string, data string) {
+	id := h.next()
+	// like telebot, buttons without data have no separator
+	if data != "" {
+		unique += "|" + data
+	}
+	h.process(tb.Update{ID: id, Callback: &tb.Callback{
+		ID:      strconv.Itoa(id),
+		Sender:  user,
+		Message: &tb.Message{ID: id, Chat: chat},
+		Data:    "\f" + unique,
+	}})
+}
+
+func (h *harness) query(user *tb.User, text string) {
+	id := h.next()
+	h.process(tb.Update{ID: id, Query: &tb.Query{ID: strconv.Itoa(id), From: *user, Text: text}})
+}
+
+// expectCalls fails unless the method was called count times
+func (h *harness) expectCalls(method string, count int) []telegramCall {
+	h.t.Helper()
+	calls := h.telegram.recorded(method)
+	if len(calls) != count {
+		h.t.Fatalf("expected %d %s calls, got %d", count, method, len(calls))
+	}
+	return calls
+}
+
+func assertContains(t *testing.T, text string, part string) {
+	t.Helper()
+	if !strings.Contains(text, part) {
+		t.Errorf("expected %q to contain %q", text, part)
+	}
+}
+
+var testUser = &tb.User{ID: 42, FirstName: "tester", LanguageCode: "zh-hans"}
+
+func privateChat(user *tb.User) *tb.Chat {
+	return &tb.Chat{ID: int64(user.ID), Type: tb.ChatPrivate, FirstName: user.FirstName}
+}
+
+func TestHandlePixiv(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	chat := privateChat(testUser)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, testUser, "/pixiv 1001")
+	photo := h.expectCalls("sendPhoto", 1)[0]
+	assertEqual(t, photo.params["chat_id"], "42")
+	assertEqual(t, photo.params["photo"], h.pximg.URL+"/c/540x540_70/img-master/img/2021/08/20/00/00/01/1001_p0_master1200.jpg")
+	assertContains(t, photo.params["caption"], "夏の空")
+	assertContains(t, photo.params["caption"], "画家")
+	assertContains(t, photo.params["reply_markup"], "https://www.pixiv.net/artworks/1001")
+	h.expectCalls("deleteMessage", 1)
+
+	h.message(chat, testUser, "https://www.pixiv.net/artworks/1003")
+	photo = h.expectCalls("sendPhoto", 2)[1]
+	assertContains(t, photo.params["caption"], "動く絵")
+	assertEqual(t, photo.params["reply_to_message_id"], strconv.Itoa(h.update))
+
+	h.message(chat, testUser, "/pixiv 1004")
+	h.message(chat, testUser, "/pixiv 1005")
+	replies := h.expectCalls("sendMessage", 2)
+	assertEqual(t, replies[0].params["text"], tr(DEFAULT_LOCALE, ERROR_RESTRICTED))
+	assertEqual(t, replies[1].params["text"], tr(DEFAULT_LOCALE, ERROR_DELETED))
+}
+
+func TestHandleAlbum(t *testing.T) {
+	h := newHarness(t, downloader.Download{})
+	chat := privateChat(testUser)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, testUser, "/album 1002")
+	album := h.expectCalls("sendMediaGroup", 1)[0]
+	assertEqual(t, len(album.files), 3)
+	var media []map[string]string
+	assertNoError(t, json.Unmarshal([]byte(album.params["media"]), &media))
+	assertEqual(t, len(media), 3)
+	assertContains(t, media[0]["caption"], "三枚の漫画")
+	assertEqual(t, media[1]["caption"], "")
+	assertEqual(t, len(h.pximg.paths()), 3)
+}
+
+func TestHandlePostCallback(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	group := &tb.Chat{ID: -1001, Type: tb.ChatSuperGroup, Title: "group"}
+	channel := tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel", Username: "pixivchannel"}
+	linked := *group
+	linked.LinkedChatID = channel.ID
+	botMember := tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}}
+	userMember := tb.ChatMember{User: testUser, Role: tb.Creator}
+	h.telegram.addChat(linked, userMember)
+	h.telegram.addChat(channel, botMember, userMember)
+
+	h.message(group, testUser, "/pixiv 1001")
+	preview := h.expectCalls("sendPhoto", 1)[0]
+	assertContains(t, preview.params["reply_markup"], "post|1001")
+
+	h.callback(group, testUser, "post", "1001")
+	posted := h.expectCalls("sendPhoto", 2)[1]
+	assertEqual(t, posted.params["chat_id"], "-1002")
+	assertEqual(t, posted.params["reply_markup"], "")
+	history, err := h.app.Store.Posts(1001)
+	assertNoError(t, err)
+	assertEqual(t, len(history), 2)
+	assertEqual(t, history[1].Chat, int64(-1002))
+	assertEqual(t, history[1].User, testUser.ID)
+	answer := h.expectCalls("answerCallbackQuery", 1)[0]
+	assertEqual(t, answer.params["text"], tr(DEFAULT_LOCALE, POST_SUCCESS))
+
+	stranger := &tb.User{ID: 7}
+	h.callback(group, stranger, "post", "1001")
+	h.expectCalls("sendPhoto", 2)
+	answer = h.expectCalls("answerCallbackQuery", 2)[1]
+	assertEqual(t, answer.params["text"], tr(DEFAULT_LOCALE, NO_PERMISSION))
+}
+
+func TestHandleInlineQuery(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+
+	h.query(testUser, "1001")
+	answer := h.expectCalls("answerInlineQuery", 1)[0]
+	var results []map[string]interface{}
+	assertNoError(t, json.Unmarshal([]byte(answer.params["results"]), &results))
+	assertEqual(t, len(results), 1)
+	assertEqual(t, results[0]["id"], "1001")
+	assertEqual(t, results[0]["photo_url"], h.pximg.URL+"/c/540x540_70/img-master/img/2021/08/20/00/00/01/1001_p0_master1200.jpg")
+	assertContains(t, results[0]["caption"].(string), "夏の空")
+
+	h.query(testUser, "1005")
+	answer = h.expectCalls("answerInlineQuery", 2)[1]
+	assertEqual(t, answer.params["results"], "[]")
+	assertEqual(t, answer.params["switch_pm_text"], tr(DEFAULT_LOCALE, ERROR_DELETED))
+}
+
+func TestRateLimits(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	spammer := &tb.User{ID: 7, FirstName: "spammer"}
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Clock = clock
+		options.Limits = Limits{User: Rate{Count: 1, Per: time.Minute}, DenyUsers: map[int]bool{13: true}}
+	})
+	chat := privateChat(spammer)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, spammer, "/pixiv 1001")
+	h.message(chat, spammer, "/pixiv 1001")
+	h.message(chat, spammer, "/pixiv 1001")
+	h.expectCalls("sendPhoto", 1)
+	replies := h.expectCalls("sendMessage", 1)
+	assertEqual(t, replies[0].params["text"], tr(DEFAULT_LOCALE, SLOW_DOWN, 60))
+
+	clock.now = clock.now.Add(time.Minute)
+	h.message(chat, spammer, "/pixiv 1001")
+	h.expectCalls("sendPhoto", 2)
+
+	denied := &tb.User{ID: 13}
+	h.message(privateChat(denied), denied, "/pixiv 1001")
+	h.expectCalls("sendPhoto", 2)
+	h.expectCalls("sendMessage", 1)
+}
+
+func TestRelatedCarousel(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	chat := privateChat(testUser)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, testUser, "/pixiv 1001")
+	preview := h.expectCalls("sendPhoto", 1)[0]
+	assertContains(t, preview.params["reply_markup"], "related|1001")
+
+	h.callback(chat, testUser, "related", "1001")
+	page := h.expectCalls("editMessageMedia", 1)[0]
+	var media map[string]string
+	assertNoError(t, json.Unmarshal([]byte(page.params["media"]), &media))
+	assertEqual(t, media["media"], h.pximg.URL+"/c/540x540_70/img-master/img/2021/08/20/00/00/02/1002_p0_master1200.jpg")
+	assertContains(t, media["caption"], "三枚の漫画")
+	assertContains(t, media["caption"], tr(DEFAULT_LOCALE, RELATED_POSITION, 1, 2))
+	assertContains(t, page.params["reply_markup"], "related-page|1001:1")
+
+	h.callback(chat, testUser, "related-page", "1001:1")
+	page = h.expectCalls("editMessageMedia", 2)[1]
+	assertNoError(t, json.Unmarshal([]byte(page.params["media"]), &media))
+	assertContains(t, media["caption"], "動く絵")
+	assertContains(t, page.params["reply_markup"], "\\fpreview|1003")
+
+	h.callback(chat, testUser, "preview", "1003")
+	assertContains(t, h.expectCalls("sendPhoto", 2)[1].params["caption"], "動く絵")
+
+	h.callback(chat, testUser, "related-back", "1001")
+	page = h.expectCalls("editMessageMedia", 3)[2]
+	assertNoError(t, json.Unmarshal([]byte(page.params["media"]), &media))
+	assertContains(t, media["caption"], "夏の空")
+	assertContains(t, page.params["reply_markup"], "https://www.pixiv.net/artworks/1001")
+
+	h.app.Store.Update(chat.ID, func(s *storage.ChatSettings) { s.BlockedUsers = []string{"12"} })
+	h.callback(chat, testUser, "related", "1001")
+	page = h.expectCalls("editMessageMedia", 4)[3]
+	assertNoError(t, json.Unmarshal([]byte(page.params["media"]), &media))
+	assertContains(t, media["caption"], tr(DEFAULT_LOCALE, RELATED_POSITION, 1, 1))
+
+	// the back button takes a token like the carousel pages
+	h = newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Limits.User = Rate{Count: 1, Per: time.Hour}
+	})
+	h.callback(chat, testUser, "related-back", "1001")
+	h.expectCalls("editMessageMedia", 1)
+	h.callback(chat, testUser, "related-back", "1001")
+	h.expectCalls("editMessageMedia", 1)
+	answer := h.expectCalls("answerCallbackQuery", 2)[1]
+	assertEqual(t, answer.params["text"], tr(DEFAULT_LOCALE, SLOW_DOWN, 3600))
+}
+
+func TestSeries(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	group := &tb.Chat{ID: -1001, Type: tb.ChatSuperGroup, Title: "group", LinkedChatID: -1002}
+	channel := tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel"}
+	botMember := tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}}
+	userMember := tb.ChatMember{User: testUser, Role: tb.Creator}
+	h.telegram.addChat(*group, userMember)
+	h.telegram.addChat(channel, botMember, userMember)
+
+	h.message(group, testUser, "/pixiv 1002")
+	preview := h.expectCalls("sendPhoto", 1)[0]
+	assertContains(t, preview.params["caption"], `<a href="https://www.pixiv.net/user/12/series/77">夏の連載</a> #2`)
+	assertContains(t, preview.params["reply_markup"], "\\fpreview|1001")
+	assertContains(t, preview.params["reply_markup"], "\\fseries|77")
+	assertContains(t, preview.params["reply_markup"], "\\fpreview|1003")
+
+	h.callback(group, testUser, "series", "77")
+	list := h.expectCalls("sendMessage", 1)[0]
+	assertContains(t, list.params["text"], tr(DEFAULT_LOCALE, SERIES_HEADER, `<a href="https://www.pixiv.net/user/12/series/77">夏の連載</a>`, 3))
+	if !strings.Contains(list.params["text"], "1. <a href=\"https://www.pixiv.net/artworks/1001\">夏の空</a>\n2.") {
+		t.Errorf("series not in order: %s", list.params["text"])
+	}
+	assertContains(t, list.params["reply_markup"], "series-post|77")
+
+	h.callback(group, testUser, "series-post", "77")
+	posted := h.expectCalls("sendPhoto", 3)
+	assertEqual(t, posted[1].params["chat_id"], "-1002")
+	assertContains(t, posted[1].params["caption"], "夏の空")
+	assertContains(t, posted[2].params["caption"], "動く絵")
+	album := h.expectCalls("sendMediaGroup", 1)[0]
+	assertEqual(t, album.params["chat_id"], "-1002")
+	assertEqual(t, h.expectCalls("sendMessage", 2)[1].params["text"], tr(DEFAULT_LOCALE, SERIES_POSTED, 3, 3))
+
+	h.message(group, testUser, "/series https://www.pixiv.net/user/12/series/77")
+	h.expectCalls("sendMessage", 3)
+	h.message(group, testUser, "/series")
+	assertEqual(t, h.expectCalls("sendMessage", 4)[3].params["text"], tr(DEFAULT_LOCALE, SERIES_USAGE))
+
+	// every posted work takes a token, the posting stops when they run out
+	h = newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Limits.User = Rate{Count: 2, Per: time.Hour}
+	})
+	h.telegram.addChat(*group, userMember)
+	h.telegram.addChat(channel, botMember, userMember)
+	h.callback(group, testUser, "series-post", "77")
+	h.expectCalls("sendPhoto", 1)
+	h.expectCalls("sendMediaGroup", 1)
+	messages := h.expectCalls("sendMessage", 2)
+	assertEqual(t, messages[0].params["text"], tr(DEFAULT_LOCALE, SLOW_DOWN, 1800))
+	assertEqual(t, messages[1].params["text"], tr(DEFAULT_LOCALE, SERIES_POSTED, 2, 3))
+}
+
+func TestComments(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	chat := privateChat(testUser)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, testUser, "/pixiv 1001")
+	preview := h.expectCalls("sendPhoto", 1)[0]
+	assertContains(t, preview.params["reply_markup"], "comments|1001:11:0")
+
+	h.callback(chat, testUser, "comments", "1001:11:0")
+	comments := h.expectCalls("sendMessage", 1)[0]
+	assertContains(t, comments.params["text"], "<b>ファン</b>: 素敵な空(heart)")
+	assertContains(t, comments.params["text"], "<b>通りすがり</b>: "+tr(DEFAULT_LOCALE, COMMENT_STAMP))
+	// the reply of the artist is kept over the later replies
+	assertContains(t, comments.params["text"], "↳ <b>画家 "+tr(DEFAULT_LOCALE, COMMENT_AUTHOR)+"</b>: ありがとうございます！")
+	if strings.Contains(comments.params["text"], "もう一度") {
+		t.Errorf("expected at most %d replies: %s", COMMENT_REPLIES_LIMIT, comments.params["text"])
+	}
+	assertContains(t, comments.params["reply_markup"], "comments-page|1001:11:1")
+
+	h.callback(chat, testUser, "comments-page", "1001:11:1")
+	page := h.expectCalls("editMessageText", 1)[0]
+	assertContains(t, page.params["text"], "&lt;最初のコメント&gt;")
+	assertContains(t, page.params["reply_markup"], "comments-page|1001:11:0")
+
+	h.callback(chat, testUser, "comments-close", "")
+	h.expectCalls("deleteMessage", 2)
+}
+
+func TestRefreshPosts(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	channel := tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel"}
+	group := &tb.Chat{ID: -1001, Type: tb.ChatSuperGroup, Title: "group", LinkedChatID: channel.ID}
+	botMember := tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}}
+	userMember := tb.ChatMember{User: testUser, Role: tb.Creator}
+	h.telegram.addChat(*group, userMember)
+	h.telegram.addChat(channel, botMember, userMember)
+
+	h.message(group, testUser, "/post 1001")
+	posted := h.expectCalls("sendPhoto", 1)[0]
+	history, _ := h.app.Store.Posts(1001)
+	assertEqual(t, history[0].Caption, posted.params["caption"])
+	h.app.Store.UpdatePosts(1001, func(post *storage.Post) { post.Caption = "stale" })
+	h.app.Store.AddPost(storage.Post{Illust: 1005, Chat: channel.ID, Messages: []int{900}, Caption: "old", Time: time.Now()})
+
+	checked, edited, err := h.app.RefreshPosts(time.Time{}, 0)
+	assertNoError(t, err)
+	assertEqual(t, checked, 2)
+	assertEqual(t, edited, 2)
+	edits := h.expectCalls("editMessageCaption", 2)
+	assertEqual(t, edits[0].params["caption"], posted.params["caption"])
+	assertEqual(t, edits[0].params["reply_markup"], "")
+	assertEqual(t, edits[1].params["message_id"], "900")
+	assertEqual(t, edits[1].params["caption"], tr(DEFAULT_LOCALE, POST_SOURCE_DELETED)+"\nold")
+	deleted, _ := h.app.Store.Posts(1005)
+	assertEqual(t, deleted[0].Deleted, true)
+
+	_, edited, _ = h.app.RefreshPosts(time.Time{}, 0)
+	assertEqual(t, edited, 0)
+	h.expectCalls("editMessageCaption", 2)
+
+	// the caption at the length limit is shortened to make room for the
+	// marker
+	full := "<b>title</b>\n" + strings.Repeat("説", MAX_CAPTION_LENGTH-6)
+	h.app.Store.AddPost(storage.Post{Illust: 1006, Chat: channel.ID, Messages: []int{901}, Caption: full, Time: time.Now()})
+	h.app.RefreshPosts(time.Time{}, 0)
+	caption := h.expectCalls("editMessageCaption", 3)[2].params["caption"]
+	assertEqual(t, captionLength(caption), MAX_CAPTION_LENGTH)
+	assertContains(t, caption, tr(DEFAULT_LOCALE, POST_SOURCE_DELETED)+"\ntitle\n説")
+	deleted, _ = h.app.Store.Posts(1006)
+	assertEqual(t, deleted[0].Deleted, true)
+
+	// the reply is to the automatic forward in the discussion group
+	id := h.next()
+	h.process(tb.Update{ID: id, Message: &tb.Message{ID: id, Chat: group, Sender: testUser, Text: "/refresh", ReplyTo: &tb.Message{
+		ID:                id - 1,
+		Chat:              group,
+		OriginalChat:      &channel,
+		OriginalMessageID: history[0].Messages[0],
+	}}})
+	assertEqual(t, h.expectCalls("sendMessage", 1)[0].params["text"], tr(DEFAULT_LOCALE, POST_UNCHANGED))
+}
+
+func TestRefreshKeepsOriginSettings(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	botMember := tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}}
+	userMember := tb.ChatMember{User: testUser, Role: tb.Creator}
+	// the first group has a template, the second the language of the user
+	var groups []*tb.Chat
+	for _, id := range []int64{1, 2} {
+		channel := tb.Chat{ID: -2000 - id, Type: tb.ChatChannel, Title: "channel"}
+		group := &tb.Chat{ID: -1000 - id, Type: tb.ChatSuperGroup, Title: "group", LinkedChatID: channel.ID}
+		h.telegram.addChat(*group, userMember)
+		h.telegram.addChat(channel, botMember, userMember)
+		h.app.Store.Update(channel.ID, func(settings *storage.ChatSettings) { settings.Locale = "en" })
+		groups = append(groups, group)
+	}
+	h.app.Store.Update(groups[0].ID, func(settings *storage.ChatSettings) { settings.Template = "custom {{html .Title}}" })
+	japanese := *testUser
+	japanese.LanguageCode = "ja"
+
+	h.message(groups[0], &japanese, "/post 1001")
+	h.message(groups[1], &japanese, "/post 1002")
+	posted := h.expectCalls("sendPhoto", 2)
+	assertEqual(t, posted[0].params["caption"], "custom 夏の空")
+	assertContains(t, posted[1].params["caption"], "のイラスト")
+	h.app.Store.UpdatePosts(1001, func(post *storage.Post) { post.Caption = "stale" })
+	h.app.Store.UpdatePosts(1002, func(post *storage.Post) { post.Caption = "stale" })
+
+	_, edited, err := h.app.RefreshPosts(time.Time{}, 0)
+	assertNoError(t, err)
+	assertEqual(t, edited, 2)
+	edits := h.expectCalls("editMessageCaption", 2)
+	assertEqual(t, edits[0].params["caption"], posted[0].params["caption"])
+	assertEqual(t, edits[1].params["caption"], posted[1].params["caption"])
+}
+
+func TestArchivePosts(t *testing.T) {
+	dir := t.TempDir()
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Archive = archive.New(dir)
+		options.Admins = map[int]bool{testUser.ID: true}
+	})
+	channel := tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel"}
+	h.telegram.addChat(channel, tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}})
+
+	assertNoError(t, h.app.Post("-1002", 1002, true))
+	h.expectCalls("sendMediaGroup", 1)
+	h.app.background.Wait()
+	for _, name := range []string{"1002_p0.png", "1002_p2.png", archive.DETAILS_FILE} {
+		if _, err := os.Stat(filepath.Join(dir, "12", "1002", name)); err != nil {
+			t.Error(err)
+		}
+	}
+	// the details are kept as pixiv returned them
+	data, err := os.ReadFile(filepath.Join(dir, "12", "1002", archive.DETAILS_FILE))
+	assertNoError(t, err)
+	assertContains(t, string(data), `"series_type": "manga"`)
+
+	// previews in private chats are not archived
+	private := &tb.Chat{ID: int64(testUser.ID), Type: tb.ChatPrivate}
+	h.message(private, testUser, "https://www.pixiv.net/artworks/1001")
+	h.expectCalls("sendPhoto", 1)
+	h.app.background.Wait()
+	results, _ := h.app.Archive.Search("", 10)
+	assertEqual(t, len(results), 1)
+
+	h.message(private, testUser, "/archive search 1002")
+	reply := h.expectCalls("sendMessage", 1)[0]
+	assertEqual(t, strings.Contains(reply.params["text"], "artworks/1002"), true)
+}
+
+func readZip(t *testing.T, data []byte) map[string][]byte {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assertNoError(t, err)
+	files := map[string][]byte{}
+	for _, file := range reader.File {
+		opened, err := file.Open()
+		assertNoError(t, err)
+		files[file.Name], _ = io.ReadAll(opened)
+		opened.Close()
+	}
+	return files
+}
+
+func TestZip(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Limits.ZipWorks = 3
+		options.Limits.ZipPartSize = int64(len(testImage()) * 2)
+	})
+	private := &tb.Chat{ID: int64(testUser.ID), Type: tb.ChatPrivate}
+
+	// the pages of the work don't fit in one part
+	h.message(private, testUser, "/zip https://www.pixiv.net/artworks/1002")
+	documents := h.expectCalls("sendDocument", 3)
+	assertContains(t, documents[2].params["caption"], tr(DEFAULT_LOCALE, ZIP_PART, 3, 3))
+	files := map[string][]byte{}
+	for _, document := range documents {
+		for name, data := range readZip(t, document.files["document"]) {
+			files[name] = data
+		}
+	}
+	assertEqual(t, len(files), 4)
+	assertEqual(t, len(readZip(t, documents[0].files["document"])), 2)
+	var metadata zipMetadata
+	assertNoError(t, json.Unmarshal(files["1002/"+ZIP_METADATA], &metadata))
+	assertEqual(t, metadata.UserID, "12")
+	assertEqual(t, strings.Join(metadata.Files, ","), "1002_p0.png,1002_p1.png,1002_p2.png")
+
+	// the deleted work is skipped
+	h.message(private, testUser, "/zip https://www.pixiv.net/users/11")
+	assertEqual(t, h.expectCalls("sendMessage", 1)[0].params["text"], tr(DEFAULT_LOCALE, ZIP_CAPPED, 3, 4))
+	parts := h.expectCalls("sendDocument", 8)[3:]
+	assertContains(t, parts[0].params["caption"], tr(DEFAULT_LOCALE, ZIP_CAPTION, 2))
+	assertEqual(t, string(readZip(t, parts[0].files["document"])["1003/1003_ugoira600x600.zip"]), "ugoira")
+
+	h.message(private, testUser, "/zip nothing")
+	assertEqual(t, h.expectCalls("sendMessage", 2)[1].params["text"], tr(DEFAULT_LOCALE, ZIP_USAGE))
+
+	// a file over the part size can't be sent at all
+	h.app.Limits.ZipPartSize = int64(len(testImage()) - 1)
+	h.message(private, testUser, "/zip https://www.pixiv.net/artworks/1001")
+	assertEqual(t, h.expectCalls("sendMessage", 3)[2].params["text"], tr(DEFAULT_LOCALE, ZIP_TOO_LARGE, "1001_p0.png", 0))
+	h.expectCalls("sendDocument", 8)
+
+	// every packed work takes a token, the works packed until they run out
+	// are still sent
+	h = newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Limits.User = Rate{Count: 2, Per: time.Hour}
+		options.Limits.Downloads = 1
+	})
+	h.message(private, testUser, "/zip https://www.pixiv.net/users/11")
+	document := h.expectCalls("sendDocument", 1)[0]
+	assertContains(t, document.params["caption"], tr(DEFAULT_LOCALE, ZIP_CAPTION, 1))
+	assertEqual(t, h.expectCalls("sendMessage", 1)[0].params["text"], tr(DEFAULT_LOCALE, SLOW_DOWN, 1800))
+}
+
+// newFakeSauceNAO answers every search from the fixture, the uploaded images
+// are recorded
+func newFakeSauceNAO(t *testing.T, uploads *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		*uploads = append(*uploads, string(data))
+		fixture, _ := os.ReadFile(filepath.Join("testdata", "source", "search.json"))
+		w.Write(fixture)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSource(t *testing.T) {
+	var uploads []string
+	sauce := newFakeSauceNAO(t, &uploads)
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Sources = source.NewSauceNAO(sauce.URL, "key")
+	})
+	private := &tb.Chat{ID: int64(testUser.ID), Type: tb.ChatPrivate}
+	group := &tb.Chat{ID: -1001, Type: tb.ChatSuperGroup, Title: "group"}
+	photo := func(chat *tb.Chat) *tb.Message {
+		id := h.next()
+		return &tb.Message{ID: id, Chat: chat, Sender: testUser, Photo: &tb.Photo{File: tb.File{FileID: "photo-1", UniqueID: "unique-1"}}}
+	}
+
+	h.process(tb.Update{ID: h.next(), Message: photo(private)})
+	reply := h.expectCalls("sendMessage", 1)[0]
+	assertEqual(t, strings.Join(uploads, ","), "photo-1.jpg")
+	assertContains(t, reply.params["text"], `<a href="https://www.pixiv.net/artworks/1001">夏の空</a> - 画家 (93.5%)`)
+	assertContains(t, reply.params["text"], "artworks/1002")
+	assertEqual(t, strings.Contains(reply.params["text"], "artworks/1003"), false)
+	assertContains(t, reply.params["reply_markup"], "\\fpreview|1001")
+
+	// photos in groups are only searched with /source, the result is cached
+	sent := photo(group)
+	h.process(tb.Update{ID: h.next(), Message: sent})
+	h.expectCalls("sendMessage", 1)
+	h.message(group, testUser, "/source")
+	assertEqual(t, h.expectCalls("sendMessage", 2)[1].params["text"], tr(DEFAULT_LOCALE, SOURCE_USAGE))
+	id := h.next()
+	h.process(tb.Update{ID: id, Message: &tb.Message{ID: id, Chat: group, Sender: testUser, Text: "/source", ReplyTo: sent}})
+	assertEqual(t, h.expectCalls("sendMessage", 3)[2].params["text"], reply.params["text"])
+	assertEqual(t, len(uploads), 1)
+
+	h.callback(private, testUser, "preview", "1001")
+	h.expectCalls("sendPhoto", 1)
+}
+
+func TestSimilar(t *testing.T) {
+	h := newHarness(t, downloader.DirectURL{})
+	group := &tb.Chat{ID: -1001, Type: tb.ChatSuperGroup, Title: "group"}
+	channel := tb.Chat{ID: -1002, Type: tb.ChatChannel, Title: "channel"}
+	linked := *group
+	linked.LinkedChatID = channel.ID
+	botMember := tb.ChatMember{User: &tb.User{ID: FAKE_BOT_ID}, Role: tb.Administrator, Rights: tb.Rights{CanPostMessages: true}}
+	userMember := tb.ChatMember{User: testUser, Role: tb.Creator}
+	h.telegram.addChat(linked, userMember)
+	h.telegram.addChat(channel, botMember, userMember)
+
+	h.callback(group, testUser, "post", "1002")
+	answer := h.expectCalls("answerCallbackQuery", 1)[0]
+	assertEqual(t, answer.params["text"], tr(DEFAULT_LOCALE, POST_SUCCESS))
+	h.app.background.Wait()
+	// only the first page was posted, it is hashed in the background as it
+	// was sent by url
+	_, ok, err := h.app.Store.Hash(1002, 0)
+	assertNoError(t, err)
+	assertEqual(t, ok, true)
+	_, ok, _ = h.app.Store.Hash(1002, 1)
+	assertEqual(t, ok, false)
+
+	// only works already in the index are compared, nothing is downloaded
+	// before posting
+	h.callback(group, testUser, "post", "1003")
+	h.expectCalls("sendPhoto", 2)
+	answer = h.expectCalls("answerCallbackQuery", 2)[1]
+	assertEqual(t, answer.params["text"], tr(DEFAULT_LOCALE, POST_SUCCESS))
+
+	// every fake image is the same, so 1001 previewed in the group looks like
+	// a repost of the latest post 1003
+	h.message(group, testUser, "https://www.pixiv.net/artworks/1001")
+	h.expectCalls("sendPhoto", 3)
+	h.app.background.Wait()
+	h.callback(group, testUser, "post", "1001")
+	h.expectCalls("sendPhoto", 4)
+	history, err := h.app.Store.Posts(1003)
+	assertNoError(t, err)
+	answer = h.expectCalls("answerCallbackQuery", 3)[2]
+	assertContains(t, answer.params["text"], tr(DEFAULT_LOCALE, POST_DUPLICATE, 1003, history[0].Time.Format("2006-01-02")))
+	assertEqual(t, answer.params["show_alert"], "true")
+
+	h.message(group, testUser, "/similar")
+	assertEqual(t, h.expectCalls("sendMessage", 1)[0].params["text"], tr(DEFAULT_LOCALE, SIMILAR_USAGE))
+	h.telegram.mutex.Lock()
+	h.telegram.files["photo-1.jpg"] = testImage()
+	h.telegram.mutex.Unlock()
+	id := h.next()
+	photo := &tb.Message{ID: id, Chat: group, Sender: testUser, Photo: &tb.Photo{File: tb.File{FileID: "photo-1"}}}
+	h.process(tb.Update{ID: id, Message: photo})
+	id = h.next()
+	h.process(tb.Update{ID: id, Message: &tb.Message{ID: id, Chat: group, Sender: testUser, Text: "/similar", ReplyTo: photo}})
+	reply := h.expectCalls("sendMessage", 2)[1]
+	assertContains(t, reply.params["text"], tr(DEFAULT_LOCALE, SIMILAR_HEADER))
+	assertContains(t, reply.params["text"], `<a href="https://www.pixiv.net/artworks/1002">1002</a> p1 (100%)`)
+	assertContains(t, reply.params["text"], "artworks/1001")
+	assertContains(t, reply.params["reply_markup"], "\\fpreview|1003")
+
+	// the uploaded images are hashed as they are decoded, previews in private
+	// chats are not indexed
+	h = newHarness(t, downloader.Download{})
+	h.message(privateChat(testUser), testUser, "https://www.pixiv.net/artworks/1001")
+	h.expectCalls("sendPhoto", 1)
+	_, ok, _ = h.app.Store.Hash(1001, 0)
+	assertEqual(t, ok, false)
+	h.message(group, testUser, "https://www.pixiv.net/artworks/1001")
+	h.expectCalls("sendPhoto", 2)
+	_, ok, _ = h.app.Store.Hash(1001, 0)
+	assertEqual(t, ok, true)
+	assertEqual(t, len(h.pximg.paths()), 2)
+}
+
+// fakeBookmarks records the bookmarks, the list has the fixtures
+type fakeBookmarks struct {
+	added []bookmarkTarget
+	tags  [][]string
+}
+
+func (fake *fakeBookmarks) AddBookmark(ctx context.Context, illust int, private bool, tags []string) error {
+	fake.added = append(fake.added, bookmarkTarget{illust: illust, private: private})
+	fake.tags = append(fake.tags, tags)
+	return nil
+}
+
+func (fake *fakeBookmarks) GetBookmarks(ctx context.Context, offset int, limit int, private bool, lang string) (*pixiv.BookmarksApi, error) {
+	works := []pixiv.BookmarkedWork{
+		{ID: "1001", Title: "夏の空", UserName: "画家"},
+		{ID: "1005", Title: "-----", IsMasked: true},
+	}
+	for i := 3; i <= 12; i++ {
+		works = append(works, pixiv.BookmarkedWork{ID: json.Number(strconv.Itoa(2000 + i)), Title: "work"})
+	}
+	result := &pixiv.BookmarksApi{Total: len(works)}
+	if offset < len(works) {
+		works = works[offset:]
+		if len(works) > limit {
+			works = works[:limit]
+		}
+		result.Works = works
+	}
+	return result, nil
+}
+
+func TestBookmarks(t *testing.T) {
+	bookmarks := &fakeBookmarks{}
+	h := newHarness(t, downloader.DirectURL{}, func(options *Options) {
+		options.Admins = map[int]bool{testUser.ID: true}
+		options.Bookmarks = bookmarks
+	})
+	chat := privateChat(testUser)
+	h.telegram.addChat(*chat)
+
+	h.message(chat, testUser, "/pixiv 1001")
+	preview := h.expectCalls("sendPhoto", 1)[0]
+	assertContains(t, preview.params["reply_markup"], "\\fbookmark|1001")
+	assertContains(t, preview.params["reply_markup"], "\\fbookmark|1001|private")
+	h.callback(chat, testUser, "bookmark", "1001|private")
+	assertEqual(t, h.expectCalls("answerCallbackQuery", 1)[0].params["text"], tr(DEFAULT_LOCALE, BOOKMARKED_PRIVATE))
+	h.message(chat, testUser, "/bookmark https://www.pixiv.net/artworks/1002 風景 夏")
+	assertEqual(t, h.expectCalls("sendMessage", 1)[0].params["text"], tr(DEFAULT_LOCALE, BOOKMARKED))
+	assertEqual(t, len(bookmarks.added), 2)
+	assertEqual(t, bookmarks.added[0], bookmarkTarget{illust: 1001, private: true})
+	assertEqual(t, bookmarks.added[1], bookmarkTarget{illust: 1002})
+	assertEqual(t, strings.Join(bookmarks.tags[1], ","), "風景,夏")
+	assertEqual(t, len(bookmarks.tags[0]) > 0, true)
+
+	h.message(chat, testUser, "/bookmarks")
+	list := h.expectCalls("sendMessage", 2)[1]
+	assertContains(t, list.params["text"], tr(DEFAULT_LOCALE, BOOKMARKS_HEADER, 12))
+	assertContains(t, list.params["text"], `1. <a href="https://www.pixiv.net/artworks/1001">夏の空</a> - 画家`)
+	assertContains(t, list.params["text"], "2. "+tr(DEFAULT_LOCALE, BOOKMARK_MASKED))
+	assertContains(t, list.params["reply_markup"], "\\fpreview|1001")
+	assertEqual(t, strings.Contains(list.params["reply_markup"], "preview|1005"), false)
+	assertContains(t, list.params["reply_markup"], "\\fbookmarks-page|10")
+	h.callback(chat, testUser, "bookmarks-page", "10")
+	page := h.expectCalls("editMessageText", 1)[0]
+	assertContains(t, page.params["text"], "11. <a")
+	assertContains(t, page.params["reply_markup"], "\\fbookmarks-page|0")
+
+	// only the bot admins use the account
+	stranger := &tb.User{ID: 7}
+	h.message(privateChat(stranger), stranger, "/pixiv 1001")
+	assertEqual(t, strings.Contains(h.expectCalls("sendPhoto", 2)[1].params["reply_markup"], "bookmark"), false)
+	h.callback(chat, stranger, "bookmark", "1001")
+	assertEqual(t, h.expectCalls("answerCallbackQuery", 3)[2].params["text"], tr(DEFAULT_LOCALE, NO_PERMISSION))
+	assertEqual(t, len(bookmarks.added), 2)
+}
@@ -0,0 +1,549 @@
+package bot
+
+import (
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const DEFAULT_LOCALE = "zh-CN"
+
+const (
+	INVALID_INPUT         = "invalid_input"
+	NO_LINK               = "no_link"
+	NO_ADMIN              = "no_admin"
+	POST_SUCCESS          = "post_success"
+	POST_TO_CHANNEL       = "post_to_channel"
+	POST_ALBUM_TO_CHANNEL = "post_album_to_channel"
+	NO_PERMISSION         = "no_permission"
+	NOT_ADMIN             = "not_admin"
+	INVALID_TEMPLATE      = "invalid_template"
+	TEMPLATE_SAVED        = "template_saved"
+	TEMPLATE_RESET        = "template_reset"
+	BUTTON_ARTWORK        = "button_artwork"
+	BUTTON_AUTHOR         = "button_author"
+	BUTTON_DOWNLOAD       = "button_download"
+	LANG_CURRENT          = "lang_current"
+	LANG_SAVED            = "lang_saved"
+	INVALID_LANG          = "invalid_lang"
+	CAPTION_BY            = "caption_by"
+	TAG_STYLE_CURRENT     = "tag_style_current"
+	TAG_STYLE_SAVED       = "tag_style_saved"
+	INVALID_TAG_STYLE     = "invalid_tag_style"
+	NOT_BOT_ADMIN         = "not_bot_admin"
+	TAGMAP_USAGE          = "tagmap_usage"
+	TAGMAP_ENTRY          = "tagmap_entry"
+	TAGMAP_SAVED          = "tagmap_saved"
+	TAGMAP_REMOVED        = "tagmap_removed"
+	TAGMAP_NOT_FOUND      = "tagmap_not_found"
+	BLOCKED_TAG           = "blocked_tag"
+	BLOCKED_USER          = "blocked_user"
+	BLOCK_USAGE           = "block_usage"
+	BLOCK_ADDED           = "block_added"
+	BLOCK_REMOVED         = "block_removed"
+	BLOCK_NOT_FOUND       = "block_not_found"
+	BLOCK_LIST            = "block_list"
+	BLOCK_MODE_SILENT     = "block_mode_silent"
+	BLOCK_MODE_NOTICE     = "block_mode_notice"
+	CHANNEL_NOT_FOUND     = "channel_not_found"
+	BUTTON_BACK           = "button_back"
+	PICK_CHANNEL          = "pick_channel"
+	CHANNELS_USAGE        = "channels_usage"
+	CHANNELS_LIST         = "channels_list"
+	CHANNEL_ADDED         = "channel_added"
+	CHANNEL_REMOVED       = "channel_removed"
+	NOT_A_CHANNEL         = "not_a_channel"
+	CACHE_REFRESHED       = "cache_refreshed"
+	ERROR_NOT_FOUND       = "error_not_found"
+	ERROR_DELETED         = "error_deleted"
+	ERROR_RESTRICTED      = "error_restricted"
+	ERROR_RATE_LIMITED    = "error_rate_limited"
+	ERROR_NETWORK         = "error_network"
+	ERROR_TOO_LARGE       = "error_too_large"
+	ERROR_DECODE_FAILED   = "error_decode_failed"
+	ERROR_SERVER          = "error_server"
+	ERROR_TELEGRAM        = "error_telegram"
+	ERROR_UNKNOWN         = "error_unknown"
+	SLOW_DOWN             = "slow_down"
+	BUTTON_RELATED        = "button_related"
+	BUTTON_PREVIEW        = "button_preview"
+	RELATED_POSITION      = "related_position"
+	RELATED_EMPTY         = "related_empty"
+	CAPTION_SERIES        = "caption_series"
+	BUTTON_SERIES         = "button_series"
+	BUTTON_POST_SERIES    = "button_post_series"
+	SERIES_HEADER         = "series_header"
+	SERIES_USAGE          = "series_usage"
+	SERIES_EMPTY          = "series_empty"
+	SERIES_POSTING        = "series_posting"
+	SERIES_POSTED         = "series_posted"
+	BUTTON_COMMENTS       = "button_comments"
+	BUTTON_CLOSE          = "button_close"
+	COMMENTS_HEADER       = "comments_header"
+	COMMENTS_EMPTY        = "comments_empty"
+	COMMENT_AUTHOR        = "comment_author"
+	COMMENT_STAMP         = "comment_stamp"
+	POST_SOURCE_DELETED   = "post_source_deleted"
+	POST_NOT_FOUND        = "post_not_found"
+	POST_REFRESHED        = "post_refreshed"
+	POST_UNCHANGED        = "post_unchanged"
+	POST_MARKED_DELETED   = "post_marked_deleted"
+	ARCHIVE_USAGE         = "archive_usage"
+	ARCHIVE_DISABLED      = "archive_disabled"
+	ARCHIVE_NOT_FOUND     = "archive_not_found"
+	ARCHIVE_RESULTS       = "archive_results"
+	ZIP_USAGE             = "zip_usage"
+	ZIP_EMPTY             = "zip_empty"
+	ZIP_CAPPED            = "zip_capped"
+	ZIP_CAPTION           = "zip_caption"
+	ZIP_PART              = "zip_part"
+	ZIP_TOO_LARGE         = "zip_too_large"
+	SOURCE_USAGE          = "source_usage"
+	SOURCE_DISABLED       = "source_disabled"
+	SOURCE_NOT_FOUND      = "source_not_found"
+	SOURCE_HEADER         = "source_header"
+	SOURCE_RATE_LIMITED   = "source_rate_limited"
+	SOURCE_FAILED         = "source_failed"
+	BUTTON_SHOW_SOURCE    = "button_show_source"
+	SIMILAR_USAGE         = "similar_usage"
+	SIMILAR_NOT_FOUND     = "similar_not_found"
+	SIMILAR_HEADER        = "similar_header"
+	POST_DUPLICATE        = "post_duplicate"
+	BUTTON_BOOKMARK       = "button_bookmark"
+	BUTTON_BOOKMARK_HIDE  = "button_bookmark_hide"
+	BOOKMARK_DISABLED     = "bookmark_disabled"
+	BOOKMARK_USAGE        = "bookmark_usage"
+	BOOKMARKED            = "bookmarked"
+	BOOKMARKED_PRIVATE    = "bookmarked_private"
+	BOOKMARK_EXPIRED      = "bookmark_expired"
+	BOOKMARK_MASKED       = "bookmark_masked"
+	BOOKMARKS_HEADER      = "bookmarks_header"
+	BOOKMARKS_PRIVATE     = "bookmarks_private"
+	BOOKMARKS_EMPTY       = "bookmarks_empty"
+)
+
+type messages map[string]string
+
+var catalog = map[string]messages{
+	"zh-CN": {
+		INVALID_INPUT:         "无效输入",
+		NO_LINK:               "找不到关联群组",
+		NO_ADMIN:              "无法读取管理员列表",
+		POST_SUCCESS:          "发送成功",
+		POST_TO_CHANNEL:       "发送到频道",
+		POST_ALBUM_TO_CHANNEL: "发送图集到频道（%d 张）",
+		NO_PERMISSION:         "用户没有发送权限",
+		NOT_ADMIN:             "仅限管理员使用",
+		INVALID_TEMPLATE:      "无效模板: %v",
+		TEMPLATE_SAVED:        "模板已保存",
+		TEMPLATE_RESET:        "已恢复默认模板",
+		BUTTON_ARTWORK:        "作品：%s",
+		BUTTON_AUTHOR:         "作者：%s",
+		BUTTON_DOWNLOAD:       "下载原图",
+		LANG_CURRENT:          "当前语言：%s\n可选：%s",
+		LANG_SAVED:            "语言已设置为 %s",
+		INVALID_LANG:          "不支持的语言，可选：%s",
+		CAPTION_BY:            "%s的插画",
+		TAG_STYLE_CURRENT:     "当前标签样式：%s\n可选：%s",
+		TAG_STYLE_SAVED:       "标签样式已设置为 %s",
+		INVALID_TAG_STYLE:     "不支持的标签样式，可选：%s",
+		NOT_BOT_ADMIN:         "仅限机器人管理员使用",
+		TAGMAP_USAGE:          "用法：/tagmap 规范标签 同义词...\n/tagmap 标签 查看所属条目\n/tagunmap 标签 删除",
+		TAGMAP_ENTRY:          "#%s: %s",
+		TAGMAP_SAVED:          "已合并到 #%s",
+		TAGMAP_REMOVED:        "已删除 %s",
+		TAGMAP_NOT_FOUND:      "词典中没有 %s",
+		BLOCKED_TAG:           "该作品包含已屏蔽的标签：%s",
+		BLOCKED_USER:          "该作品的作者已被屏蔽",
+		BLOCK_USAGE:           "用法：/block tag 标签、/block user 作者编号、/block mode silent|notice\n/unblock tag 标签、/unblock user 作者编号\n/blocklist 查看列表",
+		BLOCK_ADDED:           "已屏蔽 %s",
+		BLOCK_REMOVED:         "已取消屏蔽 %s",
+		BLOCK_NOT_FOUND:       "%s 不在屏蔽列表中",
+		BLOCK_LIST:            "屏蔽标签：%s\n屏蔽作者：%s\n模式：%s",
+		BLOCK_MODE_SILENT:     "静默丢弃",
+		BLOCK_MODE_NOTICE:     "提示",
+		CHANNEL_NOT_FOUND:     "找不到目标频道 %v",
+		BUTTON_BACK:           "返回",
+		PICK_CHANNEL:          "请选择频道",
+		CHANNELS_USAGE:        "用法：/channels add @频道、/channels remove @频道",
+		CHANNELS_LIST:         "目标频道：\n%s",
+		CHANNEL_ADDED:         "已添加 %s",
+		CHANNEL_REMOVED:       "已移除 %s",
+		NOT_A_CHANNEL:         "%s 不是频道",
+		CACHE_REFRESHED:       "已刷新群组与频道信息",
+		ERROR_NOT_FOUND:       "作品不存在",
+		ERROR_DELETED:         "作品已被删除",
+		ERROR_RESTRICTED:      "该作品需要登录才能查看",
+		ERROR_RATE_LIMITED:    "请求过于频繁，请稍后再试",
+		ERROR_NETWORK:         "无法连接 pixiv，请稍后再试",
+		ERROR_TOO_LARGE:       "图片过大，无法发送",
+		ERROR_DECODE_FAILED:   "无法解析 pixiv 返回的数据",
+		ERROR_SERVER:          "pixiv 返回了错误，请稍后再试",
+		ERROR_TELEGRAM:        "Telegram 拒绝了请求，请检查机器人的权限",
+		ERROR_UNKNOWN:         "发生了未知错误",
+		SLOW_DOWN:             "请求过于频繁，请在 %d 秒后再试",
+		BUTTON_RELATED:        "相关作品",
+		BUTTON_PREVIEW:        "预览",
+		RELATED_POSITION:      "相关作品 %d/%d",
+		RELATED_EMPTY:         "没有找到相关作品",
+		CAPTION_SERIES:        "系列：%s",
+		BUTTON_SERIES:         "系列目录",
+		BUTTON_POST_SERIES:    "全部发送到频道",
+		SERIES_HEADER:         "<b>%s</b>，共 %d 话",
+		SERIES_USAGE:          "用法：/series 系列 ID 或链接",
+		SERIES_EMPTY:          "该系列没有作品",
+		SERIES_POSTING:        "正在发送 %d 个作品",
+		SERIES_POSTED:         "已发送 %d/%d 个作品",
+		BUTTON_COMMENTS:       "评论",
+		BUTTON_CLOSE:          "关闭",
+		COMMENTS_HEADER:       "评论 第 %d 页",
+		COMMENTS_EMPTY:        "暂无评论",
+		COMMENT_AUTHOR:        "（作者）",
+		COMMENT_STAMP:         "[贴图]",
+		POST_SOURCE_DELETED:   "⚠️ 原作品已在 pixiv 删除",
+		POST_NOT_FOUND:        "没有找到这条消息的发送记录",
+		POST_REFRESHED:        "说明已更新",
+		POST_UNCHANGED:        "说明已是最新",
+		POST_MARKED_DELETED:   "原作品已删除，已在说明中标记",
+		ARCHIVE_USAGE:         "用法：/archive search 关键词（标题、作者、标签或 ID）",
+		ARCHIVE_DISABLED:      "未启用存档",
+		ARCHIVE_NOT_FOUND:     "存档中没有找到匹配的作品",
+		ARCHIVE_RESULTS:       "找到 %d 个存档作品：",
+		ZIP_USAGE:             "用法：/zip 作品或画师链接",
+		ZIP_EMPTY:             "没有可以打包的作品",
+		ZIP_CAPPED:            "画师共有 %[2]d 个作品，只打包最新的 %[1]d 个",
+		ZIP_CAPTION:           "%d 个作品的原图",
+		ZIP_PART:              "（第 %d/%d 部分）",
+		ZIP_TOO_LARGE:         "文件 %s 超过了 %dMB 的上传限制",
+		SOURCE_USAGE:          "请用 /source 回复一张图片",
+		SOURCE_DISABLED:       "未启用以图搜图",
+		SOURCE_NOT_FOUND:      "没有找到这张图片在 pixiv 上的出处",
+		SOURCE_HEADER:         "可能的出处：",
+		SOURCE_RATE_LIMITED:   "以图搜图太频繁了，请稍后再试",
+		SOURCE_FAILED:         "以图搜图失败，请稍后再试",
+		BUTTON_SHOW_SOURCE:    "查看最相似的作品",
+		SIMILAR_USAGE:         "请用 /similar 回复一张图片",
+		SIMILAR_NOT_FOUND:     "没有发过相似的作品",
+		SIMILAR_HEADER:        "发过的相似作品：",
+		POST_DUPLICATE:        "⚠️ 这个频道在 %[2]s 发过相似的作品 %[1]d",
+		BUTTON_BOOKMARK:       "❤ 收藏",
+		BUTTON_BOOKMARK_HIDE:  "🔒 非公开收藏",
+		BOOKMARK_DISABLED:     "未启用 pixiv 收藏",
+		BOOKMARK_USAGE:        "用法：/bookmark 作品链接 [private] [标签…]",
+		BOOKMARKED:            "已收藏",
+		BOOKMARKED_PRIVATE:    "已非公开收藏",
+		BOOKMARK_EXPIRED:      "机器人的 pixiv 登录已失效",
+		BOOKMARK_MASKED:       "（已删除或不可见）",
+		BOOKMARKS_HEADER:      "收藏（%d）：",
+		BOOKMARKS_PRIVATE:     "非公开收藏（%d）：",
+		BOOKMARKS_EMPTY:       "收藏夹是空的",
+	},
+	"en": {
+		INVALID_INPUT:         "Invalid input",
+		NO_LINK:               "No linked channel found",
+		NO_ADMIN:              "Failed to read the admin list",
+		POST_SUCCESS:          "Posted",
+		POST_TO_CHANNEL:       "Post to channel",
+		POST_ALBUM_TO_CHANNEL: "Post album to channel (%d pages)",
+		NO_PERMISSION:         "You are not allowed to post",
+		NOT_ADMIN:             "Only admins can do this",
+		INVALID_TEMPLATE:      "Invalid template: %v",
+		TEMPLATE_SAVED:        "Template saved",
+		TEMPLATE_RESET:        "Template restored to default",
+		BUTTON_ARTWORK:        "Artwork: %s",
+		BUTTON_AUTHOR:         "Author: %s",
+		BUTTON_DOWNLOAD:       "Download original",
+		LANG_CURRENT:          "Current language: %s\nAvailable: %s",
+		LANG_SAVED:            "Language set to %s",
+		INVALID_LANG:          "Unsupported language, available: %s",
+		CAPTION_BY:            "by %s",
+		TAG_STYLE_CURRENT:     "Current tag style: %s\nAvailable: %s",
+		TAG_STYLE_SAVED:       "Tag style set to %s",
+		INVALID_TAG_STYLE:     "Unsupported tag style, available: %s",
+		NOT_BOT_ADMIN:         "Only bot admins can do this",
+		TAGMAP_USAGE:          "Usage: /tagmap canonical synonyms...\n/tagmap tag to show its entry\n/tagunmap tag to remove it",
+		TAGMAP_ENTRY:          "#%s: %s",
+		TAGMAP_SAVED:          "Merged into #%s",
+		TAGMAP_REMOVED:        "Removed %s",
+		TAGMAP_NOT_FOUND:      "%s is not in the dictionary",
+		BLOCKED_TAG:           "This work has a blocked tag: %s",
+		BLOCKED_USER:          "The author of this work is blocked",
+		BLOCK_USAGE:           "Usage: /block tag TAG, /block user AUTHOR_ID, /block mode silent|notice\n/unblock tag TAG, /unblock user AUTHOR_ID\n/blocklist to show the lists",
+		BLOCK_ADDED:           "Blocked %s",
+		BLOCK_REMOVED:         "Unblocked %s",
+		BLOCK_NOT_FOUND:       "%s is not blocked",
+		BLOCK_LIST:            "Blocked tags: %s\nBlocked authors: %s\nMode: %s",
+		BLOCK_MODE_SILENT:     "drop silently",
+		BLOCK_MODE_NOTICE:     "notice",
+		CHANNEL_NOT_FOUND:     "Destination %v not found",
+		BUTTON_BACK:           "Back",
+		PICK_CHANNEL:          "Pick a channel",
+		CHANNELS_USAGE:        "Usage: /channels add @channel, /channels remove @channel",
+		CHANNELS_LIST:         "Destinations:\n%s",
+		CHANNEL_ADDED:         "Added %s",
+		CHANNEL_REMOVED:       "Removed %s",
+		NOT_A_CHANNEL:         "%s is not a channel",
+		CACHE_REFRESHED:       "Chat and channel info refreshed",
+		ERROR_NOT_FOUND:       "The work does not exist",
+		ERROR_DELETED:         "The work has been deleted",
+		ERROR_RESTRICTED:      "The work can only be viewed after logging in",
+		ERROR_RATE_LIMITED:    "Too many requests, please try again later",
+		ERROR_NETWORK:         "Cannot reach pixiv, please try again later",
+		ERROR_TOO_LARGE:       "The image is too large to send",
+		ERROR_DECODE_FAILED:   "Cannot read the data returned by pixiv",
+		ERROR_SERVER:          "pixiv returned an error, please try again later",
+		ERROR_TELEGRAM:        "Telegram rejected the request, please check the permissions of the bot",
+		ERROR_UNKNOWN:         "Something went wrong",
+		SLOW_DOWN:             "Slow down, please try again in %d seconds",
+		BUTTON_RELATED:        "Related works",
+		BUTTON_PREVIEW:        "Preview",
+		RELATED_POSITION:      "Related work %d/%d",
+		RELATED_EMPTY:         "No related works found",
+		CAPTION_SERIES:        "Series: %s",
+		BUTTON_SERIES:         "Series index",
+		BUTTON_POST_SERIES:    "Post all to channel",
+		SERIES_HEADER:         "<b>%s</b>, %d works",
+		SERIES_USAGE:          "Usage: /series series id or link",
+		SERIES_EMPTY:          "The series has no works",
+		SERIES_POSTING:        "Posting %d works",
+		SERIES_POSTED:         "Posted %d/%d works",
+		BUTTON_COMMENTS:       "Comments",
+		BUTTON_CLOSE:          "Close",
+		COMMENTS_HEADER:       "Comments page %d",
+		COMMENTS_EMPTY:        "No comments yet",
+		COMMENT_AUTHOR:        "(artist)",
+		COMMENT_STAMP:         "[sticker]",
+		POST_SOURCE_DELETED:   "⚠️ This work has been deleted on pixiv",
+		POST_NOT_FOUND:        "This message is not in the post history",
+		POST_REFRESHED:        "Caption updated",
+		POST_UNCHANGED:        "Caption is up to date",
+		POST_MARKED_DELETED:   "The work was deleted on pixiv, the caption is marked",
+		ARCHIVE_USAGE:         "Usage: /archive search keywords (title, author, tags or id)",
+		ARCHIVE_DISABLED:      "The archive is not enabled",
+		ARCHIVE_NOT_FOUND:     "No archived works found",
+		ARCHIVE_RESULTS:       "Found %d archived works:",
+		ZIP_USAGE:             "Usage: /zip work or artist link",
+		ZIP_EMPTY:             "There are no works to pack",
+		ZIP_CAPPED:            "The artist has %[2]d works, only the latest %[1]d are packed",
+		ZIP_CAPTION:           "Originals of %d works",
+		ZIP_PART:              "(part %d of %d)",
+		ZIP_TOO_LARGE:         "The file %s is over the %dMB upload limit",
+		SOURCE_USAGE:          "Reply /source to a picture",
+		SOURCE_DISABLED:       "The reverse image search is not enabled",
+		SOURCE_NOT_FOUND:      "No source of this picture was found on pixiv",
+		SOURCE_HEADER:         "Possible sources:",
+		SOURCE_RATE_LIMITED:   "Too many image searches, please try again later",
+		SOURCE_FAILED:         "The image search failed, please try again later",
+		BUTTON_SHOW_SOURCE:    "Show the best match",
+		SIMILAR_USAGE:         "Reply /similar to a picture",
+		SIMILAR_NOT_FOUND:     "No similar work was posted",
+		SIMILAR_HEADER:        "Similar posted works:",
+		POST_DUPLICATE:        "⚠️ A similar work %[1]d was posted to this channel on %[2]s",
+		BUTTON_BOOKMARK:       "❤ Bookmark",
+		BUTTON_BOOKMARK_HIDE:  "🔒 Private",
+		BOOKMARK_DISABLED:     "pixiv bookmarks are not enabled",
+		BOOKMARK_USAGE:        "Usage: /bookmark work link [private] [tags…]",
+		BOOKMARKED:            "Bookmarked",
+		BOOKMARKED_PRIVATE:    "Bookmarked privately",
+		BOOKMARK_EXPIRED:      "The pixiv login of the bot has expired",
+		BOOKMARK_MASKED:       "(deleted or hidden)",
+		BOOKMARKS_HEADER:      "Bookmarks (%d):",
+		BOOKMARKS_PRIVATE:     "Private bookmarks (%d):",
+		BOOKMARKS_EMPTY:       "No bookmarks yet",
+	},
+	"ja": {
+		INVALID_INPUT:         "無効な入力です",
+		NO_LINK:               "リンクされたチャンネルが見つかりません",
+		NO_ADMIN:              "管理者一覧を取得できません",
+		POST_SUCCESS:          "投稿しました",
+		POST_TO_CHANNEL:       "チャンネルに投稿",
+		POST_ALBUM_TO_CHANNEL: "アルバムをチャンネルに投稿（%d 枚）",
+		NO_PERMISSION:         "投稿する権限がありません",
+		NOT_ADMIN:             "管理者のみ使用できます",
+		INVALID_TEMPLATE:      "無効なテンプレート: %v",
+		TEMPLATE_SAVED:        "テンプレートを保存しました",
+		TEMPLATE_RESET:        "デフォルトのテンプレートに戻しました",
+		BUTTON_ARTWORK:        "作品：%s",
+		BUTTON_AUTHOR:         "作者：%s",
+		BUTTON_DOWNLOAD:       "原寸画像をダウンロード",
+		LANG_CURRENT:          "現在の言語：%s\n選択肢：%s",
+		LANG_SAVED:            "言語を %s に設定しました",
+		INVALID_LANG:          "対応していない言語です。選択肢：%s",
+		CAPTION_BY:            "%sのイラスト",
+		TAG_STYLE_CURRENT:     "現在のタグスタイル：%s\n選択肢：%s",
+		TAG_STYLE_SAVED:       "タグスタイルを %s に設定しました",
+		INVALID_TAG_STYLE:     "対応していないタグスタイルです。選択肢：%s",
+		NOT_BOT_ADMIN:         "ボット管理者のみ使用できます",
+		TAGMAP_USAGE:          "使い方：/tagmap 正規タグ 同義語...\n/tagmap タグ で所属を表示\n/tagunmap タグ で削除",
+		TAGMAP_ENTRY:          "#%s: %s",
+		TAGMAP_SAVED:          "#%s に統合しました",
+		TAGMAP_REMOVED:        "%s を削除しました",
+		TAGMAP_NOT_FOUND:      "%s は辞書にありません",
+		BLOCKED_TAG:           "この作品にはブロックされたタグがあります：%s",
+		BLOCKED_USER:          "この作品の作者はブロックされています",
+		BLOCK_USAGE:           "使い方：/block tag タグ、/block user 作者ID、/block mode silent|notice\n/unblock tag タグ、/unblock user 作者ID\n/blocklist で一覧を表示",
+		BLOCK_ADDED:           "%s をブロックしました",
+		BLOCK_REMOVED:         "%s のブロックを解除しました",
+		BLOCK_NOT_FOUND:       "%s はブロックされていません",
+		BLOCK_LIST:            "ブロックしたタグ：%s\nブロックした作者：%s\nモード：%s",
+		BLOCK_MODE_SILENT:     "通知せずに破棄",
+		BLOCK_MODE_NOTICE:     "通知",
+		CHANNEL_NOT_FOUND:     "投稿先 %v が見つかりません",
+		BUTTON_BACK:           "戻る",
+		PICK_CHANNEL:          "チャンネルを選んでください",
+		CHANNELS_USAGE:        "使い方：/channels add @チャンネル、/channels remove @チャンネル",
+		CHANNELS_LIST:         "投稿先：\n%s",
+		CHANNEL_ADDED:         "%s を追加しました",
+		CHANNEL_REMOVED:       "%s を削除しました",
+		NOT_A_CHANNEL:         "%s はチャンネルではありません",
+		CACHE_REFRESHED:       "グループとチャンネルの情報を更新しました",
+		ERROR_NOT_FOUND:       "作品が存在しません",
+		ERROR_DELETED:         "作品は削除されました",
+		ERROR_RESTRICTED:      "この作品はログインしないと閲覧できません",
+		ERROR_RATE_LIMITED:    "リクエストが多すぎます。しばらくしてから再度お試しください",
+		ERROR_NETWORK:         "pixiv に接続できません。しばらくしてから再度お試しください",
+		ERROR_TOO_LARGE:       "画像が大きすぎて送信できません",
+		ERROR_DECODE_FAILED:   "pixiv から返されたデータを読み取れません",
+		ERROR_SERVER:          "pixiv がエラーを返しました。しばらくしてから再度お試しください",
+		ERROR_TELEGRAM:        "Telegram にリクエストを拒否されました。ボットの権限を確認してください",
+		ERROR_UNKNOWN:         "不明なエラーが発生しました",
+		SLOW_DOWN:             "リクエストが多すぎます。%d 秒後に再度お試しください",
+		BUTTON_RELATED:        "関連作品",
+		BUTTON_PREVIEW:        "プレビュー",
+		RELATED_POSITION:      "関連作品 %d/%d",
+		RELATED_EMPTY:         "関連作品が見つかりません",
+		CAPTION_SERIES:        "シリーズ：%s",
+		BUTTON_SERIES:         "シリーズ一覧",
+		BUTTON_POST_SERIES:    "全てチャンネルに投稿",
+		SERIES_HEADER:         "<b>%s</b>（全%d話）",
+		SERIES_USAGE:          "使い方：/series シリーズIDまたはURL",
+		SERIES_EMPTY:          "このシリーズには作品がありません",
+		SERIES_POSTING:        "%d 作品を投稿中",
+		SERIES_POSTED:         "%d/%d 作品を投稿しました",
+		BUTTON_COMMENTS:       "コメント",
+		BUTTON_CLOSE:          "閉じる",
+		COMMENTS_HEADER:       "コメント %dページ目",
+		COMMENTS_EMPTY:        "コメントはまだありません",
+		COMMENT_AUTHOR:        "（作者）",
+		COMMENT_STAMP:         "[スタンプ]",
+		POST_SOURCE_DELETED:   "⚠️ この作品は pixiv で削除されました",
+		POST_NOT_FOUND:        "このメッセージの投稿記録が見つかりません",
+		POST_REFRESHED:        "キャプションを更新しました",
+		POST_UNCHANGED:        "キャプションは最新です",
+		POST_MARKED_DELETED:   "作品が削除されていたため、キャプションに印を付けました",
+		ARCHIVE_USAGE:         "使い方：/archive search キーワード（タイトル、作者、タグまたはID）",
+		ARCHIVE_DISABLED:      "アーカイブは有効になっていません",
+		ARCHIVE_NOT_FOUND:     "アーカイブに該当する作品がありません",
+		ARCHIVE_RESULTS:       "%d 件のアーカイブ作品が見つかりました：",
+		ZIP_USAGE:             "使い方：/zip 作品またはユーザーのリンク",
+		ZIP_EMPTY:             "まとめられる作品がありません",
+		ZIP_CAPPED:            "作品が %[2]d 件あるため、最新の %[1]d 件のみをまとめます",
+		ZIP_CAPTION:           "%d 件の作品の原寸画像",
+		ZIP_PART:              "（%d/%d）",
+		ZIP_TOO_LARGE:         "ファイル %s はアップロード上限の %dMB を超えています",
+		SOURCE_USAGE:          "画像に /source で返信してください",
+		SOURCE_DISABLED:       "画像検索は有効になっていません",
+		SOURCE_NOT_FOUND:      "この画像のpixivの出典は見つかりませんでした",
+		SOURCE_HEADER:         "出典の候補：",
+		SOURCE_RATE_LIMITED:   "画像検索が多すぎます。しばらくしてからお試しください",
+		SOURCE_FAILED:         "画像検索に失敗しました。しばらくしてからお試しください",
+		BUTTON_SHOW_SOURCE:    "最も近い作品を表示",
+		SIMILAR_USAGE:         "画像に /similar で返信してください",
+		SIMILAR_NOT_FOUND:     "似た作品は投稿されていません",
+		SIMILAR_HEADER:        "投稿済みの似た作品：",
+		POST_DUPLICATE:        "⚠️ このチャンネルには %[2]s に似た作品 %[1]d が投稿されています",
+		BUTTON_BOOKMARK:       "❤ ブックマーク",
+		BUTTON_BOOKMARK_HIDE:  "🔒 非公開",
+		BOOKMARK_DISABLED:     "pixivのブックマークは有効になっていません",
+		BOOKMARK_USAGE:        "使い方：/bookmark 作品のリンク [private] [タグ…]",
+		BOOKMARKED:            "ブックマークしました",
+		BOOKMARKED_PRIVATE:    "非公開でブックマークしました",
+		BOOKMARK_EXPIRED:      "ボットのpixivログインが切れました",
+		BOOKMARK_MASKED:       "（削除または非公開）",
+		BOOKMARKS_HEADER:      "ブックマーク（%d）：",
+		BOOKMARKS_PRIVATE:     "非公開ブックマーク（%d）：",
+		BOOKMARKS_EMPTY:       "ブックマークはまだありません",
+	},
+}
+
+var locales = []string{"zh-CN", "en", "ja"}
+
+//go:embed locales
+var localeFiles embed.FS
+
+var helpMessages = loadLocaleFile("help.txt")
+var templateHelps = loadLocaleFile("template.txt")
+var defaultTemplates = makeDefaultTemplates()
+
+func loadLocaleFile(name string) map[string]string {
+	result := map[string]string{}
+	for _, lang := range locales {
+		data, err := localeFiles.ReadFile("locales/" + lang + "/" + name)
+		if err != nil {
+			panic(err)
+		}
+		result[lang] = string(data)
+	}
+	return result
+}
+
+func getDefaultTemplate(lang string) string {
+	return fmt.Sprintf(DEFAULT_TEMPLATE, tr(lang, CAPTION_BY, DEFAULT_AUTHOR), tr(lang, CAPTION_SERIES, DEFAULT_SERIES))
+}
+
+func makeDefaultTemplates() map[string]*template.Template {
+	result := map[string]*template.Template{}
+	for _, lang := range locales {
+		result[lang] = template.Must(parseTemplate(getDefaultTemplate(lang)))
+	}
+	return result
+}
+
+// tr looks up the message in the catalog, falling back to DEFAULT_LOCALE
+func tr(lang string, key string, args ...interface{}) string {
+	message, ok := catalog[lang][key]
+	if !ok {
+		message = catalog[DEFAULT_LOCALE][key]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(message, args...)
+	}
+	return message
+}
+
+// matchLocale maps telegram language codes (IETF tags) to a supported locale
+func matchLocale(code string) string {
+	code = strings.ToLower(code)
+	for _, lang := range locales {
+		if strings.ToLower(lang) == code {
+			return lang
+		}
+	}
+	switch {
+	case strings.HasPrefix(code, "zh"):
+		return "zh-CN"
+	case strings.HasPrefix(code, "ja"):
+		return "ja"
+	case strings.HasPrefix(code, "en"):
+		return "en"
+	}
+	return ""
+}
+
+// getLocale resolves the locale of a request, the chat setting wins over the
+// language of the user
+func getLocale(settings storage.ChatSettings, user *tb.User) string {
+	if settings.Locale != "" {
+		return settings.Locale
+	}
+	if user != nil {
+		if lang := matchLocale(user.LanguageCode); lang != "" {
+			return lang
+		}
+	}
+	return DEFAULT_LOCALE
+}
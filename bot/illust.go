@@ -0,0 +1,413 @@
+package bot
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/storage"
+	"github.com/microcosm-cc/bluemonday"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+var htmlPolicy = newHTMLPolicy()
+
+func newHTMLPolicy() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	policy.AllowStandardURLs()
+	policy.AllowAttrs("href").OnElements("a")
+	policy.AllowNoAttrs().OnElements(
+		"b", "i", "u", "s",
+		"strong", "em", "ins", "strike", "del",
+		"code", "pre",
+	)
+	return policy
+}
+
+func fixString(input string) string {
+	return strings.ReplaceAll(input, "<br />", "\n")
+}
+
+func (b *Bot) getLinkedChat(orig *tb.Chat) *tb.Chat {
+	chat, err := b.cache.chatByID(fmt.Sprintf("%d", orig.ID))
+	if err != nil {
+		return nil
+	}
+	if chat.LinkedChatID == 0 {
+		return nil
+	}
+	chat, err = b.cache.chatByID(fmt.Sprintf("%d", chat.LinkedChatID))
+	if err != nil {
+		return nil
+	}
+	return chat
+}
+
+type titleWithURL struct {
+	title string
+	url   string
+}
+
+type tagData struct {
+	titleWithURL
+	translation string
+	canonical   string
+}
+
+type extractedInfo struct {
+	artwork titleWithURL
+	author  titleWithURL
+	tags    []tagData
+}
+
+func (info titleWithURL) getLink(format string) string {
+	if format == "#" {
+		return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.title)
+	}
+	return fmt.Sprintf("<a href=\"%s\"><%s>%s</%s></a>", info.url, format, info.title, format)
+}
+
+func isAscii(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			return false
+		}
+	}
+	return true
+}
+
+func (info tagData) get() string {
+	if info.translation != "" {
+		if isAscii(info.translation) {
+			return fmt.Sprintf("<a href=\"%s\">#%s</a> <i>%s</i>", info.url, info.title, info.translation)
+		}
+		return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.translation)
+	}
+	return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.title)
+}
+
+// hashtag returns the plain hashtag of the tag in the given style, it is not
+// wrapped in a link so telegram can index it
+func (info tagData) hashtag(style string) string {
+	name := info.title
+	switch style {
+	case TAG_STYLE_CANONICAL:
+		if info.canonical != "" {
+			name = info.canonical
+		} else if info.translation != "" {
+			name = info.translation
+		}
+	case TAG_STYLE_TRANSLATION:
+		if info.translation != "" {
+			name = info.translation
+		}
+	}
+	return "#" + html.EscapeString(hashtagify(name))
+}
+
+// display renders the tag in the given style
+func (info tagData) display(style string) string {
+	if style == "" || style == TAG_STYLE_AUTO {
+		return info.get()
+	}
+	return info.hashtag(style)
+}
+
+func (b *Bot) extractPixiv(details *pixiv.DetailsApi) (info extractedInfo) {
+	info.artwork.title = details.IllustDetails.Title
+	info.artwork.url = "https://www.pixiv.net/artworks/" + details.IllustDetails.ID
+	info.author.title = details.AuthorDetails.UserName
+	info.author.url = "https://www.pixiv.net/users/" + details.AuthorDetails.UserID
+	tags := details.IllustDetails.DisplayTags
+	info.tags = make([]tagData, len(tags))
+	for i := 0; i < len(tags); i++ {
+		tag := tags[i]
+		info.tags[i] = tagData{
+			titleWithURL: titleWithURL{
+				title: tag.Tag,
+				url:   fmt.Sprintf("https://www.pixiv.net/tags/%s/artworks", tag.Tag),
+			},
+			translation: tag.Translation,
+			canonical:   b.Tags.canonical(tag.Tag, tag.Translation),
+		}
+	}
+	return
+}
+
+func (b *Bot) getPhoto(req *request, extracted extractedInfo, details *pixiv.DetailsApi) (*tb.Photo, error) {
+	caption, err := getCaption(req, extracted, details)
+	if err != nil {
+		return nil, err
+	}
+	file, err := b.Images.FetchImage(req.ctx, details.IllustDetails)
+	if err != nil {
+		return nil, err
+	}
+	return &tb.Photo{File: file, Caption: caption}, nil
+}
+
+func (b *Bot) getAlbum(req *request, extracted extractedInfo, details *pixiv.DetailsApi) (album tb.Album, err error) {
+	pages := details.IllustDetails.MangaA
+	count := len(pages)
+	if count > 10 {
+		count = 10
+	}
+	album = make(tb.Album, count)
+	caption, err := getCaption(req, extracted, details)
+	if err != nil {
+		return
+	}
+	for i, page := range pages[:count] {
+		file, err := b.Images.FetchImage(req.ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		album[i] = &tb.Photo{File: file}
+	}
+	album[0].(*tb.Photo).Caption = caption
+	return
+}
+
+func (b *Bot) getPhotoResult(req *request, extracted extractedInfo, details *pixiv.DetailsApi) (result tb.Result, err error) {
+	ourl, err := b.Inline.GetImageUrl(details.IllustDetails)
+	if err != nil {
+		return
+	}
+	caption, err := getCaption(req, extracted, details)
+	if err != nil {
+		return
+	}
+	result = &tb.PhotoResult{
+		URL:         ourl,
+		ParseMode:   tb.ModeHTML,
+		ThumbURL:    ourl,
+		Description: extracted.author.title,
+		Title:       extracted.artwork.title,
+		Caption:     caption,
+	}
+	result.SetResultID(details.IllustDetails.ID)
+	return
+}
+
+// illust links are parsed by the pixiv package, which the cli shares
+var (
+	parseIllustUrl = pixiv.ParseIllustUrl
+	parseIllustId  = pixiv.ParseIllustId
+)
+
+func parseUserUrl(input string) (result int, err error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "https" || (u.Host != "www.pixiv.net" && u.Host != "pixiv.net") {
+		return 0, fmt.Errorf("not a pixiv link")
+	}
+	path := u.Path
+	if strings.HasPrefix(path, "/en/") {
+		path = path[len("/en"):]
+	}
+	_, err = fmt.Sscanf(path, "/users/%d", &result)
+	if err == nil {
+		return
+	}
+	if u.Path == "/member.php" {
+		return strconv.Atoi(u.Query().Get("id"))
+	}
+	err = fmt.Errorf("not a user link")
+	return
+}
+
+func parseUserId(input string) (result int, err error) {
+	result, err = strconv.Atoi(input)
+	if err == nil {
+		return
+	}
+	result, err = parseUserUrl(input)
+	return
+}
+
+// makePixiv sends the preview of the work to chat, the settings and locale of
+// the request are used to render the caption
+func (b *Bot) makePixiv(req *request, chat *tb.Chat, id int, reply *tb.Message) (err error) {
+	req = req.with("illust", id, "target", chat.ID)
+	defer func() { req.done("preview", err) }()
+	defer b.jobs.begin(req, "preview", id, chat.ID)()
+	hashes := b.hashPost(req, chat)
+	req.notify(b.Telegram, chat, tb.UploadingPhoto)
+	details, err := b.Details.GetDetails(req.ctx, id, req.lang)
+	if err != nil {
+		return
+	}
+	err = b.checkBlocked(req, details)
+	if err != nil {
+		return
+	}
+	extracted := b.extractPixiv(details)
+	photo, err := b.getPhoto(req, extracted, details)
+	if err != nil {
+		return
+	}
+	options := []interface{}{&tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               reply,
+	}}
+	if chat.Type != tb.ChatChannel && chat.Type != tb.ChatChannelPrivate {
+		options = append(options, makeMenu(req, extracted, details, len(b.getDestinations(chat)) > 0, b.canBookmark(req)))
+	}
+	sent, err := b.Telegram.Send(chat, photo, options...)
+	if err != nil {
+		return
+	}
+	b.recordPost(req, chat, id, false, photo.Caption, *sent)
+	b.archivePost(req, chat, details)
+	b.indexPost(req, hashes)
+	return
+}
+
+// recordPost adds the sent messages to the post history, failures are only
+// logged as the messages are already sent
+func (b *Bot) recordPost(req *request, chat *tb.Chat, illust int, album bool, caption string, messages ...tb.Message) {
+	post := storage.Post{
+		Illust:  illust,
+		Chat:    chat.ID,
+		Album:   album,
+		Time:    b.Clock.Now(),
+		Caption: caption,
+	}
+	for _, message := range messages {
+		post.Messages = append(post.Messages, message.ID)
+	}
+	if req.user != nil {
+		post.User = req.user.ID
+	}
+	if req.chat != nil {
+		post.Origin = req.chat.ID
+	}
+	post.Lang = req.lang
+	if err := b.Store.AddPost(post); err != nil {
+		req.log.Warn("failed to record post", "error", err)
+	}
+}
+
+// makeMenu builds the buttons under the preview, the post buttons are only
+// shown when the chat has destinations and the bookmark buttons to who can
+// bookmark
+func makeMenu(req *request, extracted extractedInfo, details *pixiv.DetailsApi, post bool, bookmark bool) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	var rows []tb.Row
+	if post {
+		rows = append(rows, menu.Row(menu.Data(req.tr(POST_TO_CHANNEL), "post", details.IllustDetails.ID)))
+		if len(details.IllustDetails.MangaA) > 1 {
+			rows = append(rows, menu.Row(menu.Data(req.tr(POST_ALBUM_TO_CHANNEL, len(details.IllustDetails.MangaA)), "post-multi", details.IllustDetails.ID)))
+		}
+	}
+	if bookmark {
+		illust := atoi(details.IllustDetails.ID)
+		rows = append(rows, menu.Row(
+			menu.Data(req.tr(BUTTON_BOOKMARK), "bookmark", bookmarkTarget{illust: illust}.String()),
+			menu.Data(req.tr(BUTTON_BOOKMARK_HIDE), "bookmark", bookmarkTarget{illust: illust, private: true}.String()),
+		))
+	}
+	rows = append(rows,
+		menu.Row(menu.URL(req.tr(BUTTON_ARTWORK, extracted.artwork.title), extracted.artwork.url)),
+		menu.Row(menu.URL(req.tr(BUTTON_AUTHOR, extracted.author.title), extracted.author.url)),
+		menu.Row(menu.URL(req.tr(BUTTON_DOWNLOAD), details.IllustDetails.URLOriginal)),
+		menu.Row(
+			menu.Data(req.tr(BUTTON_RELATED), "related", details.IllustDetails.ID),
+			menu.Data(req.tr(BUTTON_COMMENTS), "comments", commentsPage{illust: atoi(details.IllustDetails.ID), author: details.AuthorDetails.UserID}.String()),
+		),
+	)
+	if series := details.IllustDetails.SeriesNavData; series != nil && series.ID != "" {
+		var buttons []tb.Btn
+		if series.Prev != nil {
+			buttons = append(buttons, menu.Data("◀", "preview", series.Prev.ID))
+		}
+		buttons = append(buttons, menu.Data(req.tr(BUTTON_SERIES), "series", series.ID))
+		if series.Next != nil {
+			buttons = append(buttons, menu.Data("▶", "preview", series.Next.ID))
+		}
+		rows = append(rows, menu.Row(buttons...))
+	}
+	menu.Inline(rows...)
+	return menu
+}
+
+func (b *Bot) makeAlbum(req *request, chat *tb.Chat, id int) (err error) {
+	req = req.with("illust", id, "target", chat.ID)
+	defer func() { req.done("album", err) }()
+	defer b.jobs.begin(req, "album", id, chat.ID)()
+	hashes := b.hashPost(req, chat)
+	req.notify(b.Telegram, chat, tb.UploadingPhoto)
+	details, err := b.Details.GetDetails(req.ctx, id, req.lang)
+	if err != nil {
+		return
+	}
+	err = b.checkBlocked(req, details)
+	if err != nil {
+		return
+	}
+	extracted := b.extractPixiv(details)
+	album, err := b.getAlbum(req, extracted, details)
+	if err != nil {
+		return
+	}
+	sent, err := b.Telegram.SendAlbum(chat, album, &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+	})
+	if err != nil {
+		return
+	}
+	b.recordPost(req, chat, id, true, album[0].(*tb.Photo).Caption, sent...)
+	b.archivePost(req, chat, details)
+	b.indexPost(req, hashes)
+	return
+}
+
+func (b *Bot) isAdmin(req *request, chat *tb.Chat, user *tb.User) (bool, error) {
+	if chat.Type == tb.ChatPrivate {
+		return true, nil
+	}
+	members, err := b.cache.adminsOf(chat)
+	if err != nil {
+		return false, req.wrapf(err, NO_ADMIN)
+	}
+	for _, member := range members {
+		if member.User.ID == user.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// callbackChat returns the chat where the preview of the callback is sent
+func callbackChat(c *tb.Callback) *tb.Chat {
+	if c.Message.OriginalChat != nil {
+		return c.Message.OriginalChat
+	}
+	return c.Message.Chat
+}
+
+// requireAdmin checks the sender of the command is an admin of the chat and
+// replies the reason if not
+func (b *Bot) requireAdmin(req *request, m *tb.Message) bool {
+	ok, err := b.isAdmin(req, m.Chat, m.Sender)
+	if err != nil {
+		req.send(b.Telegram, m.Chat, errorMessage(req, err))
+		return false
+	}
+	if !ok {
+		req.send(b.Telegram, m.Chat, req.tr(NOT_ADMIN))
+	}
+	return ok
+}
+
+func (b *Bot) isBotAdmin(user *tb.User) bool {
+	return user != nil && b.Admins[user.ID]
+}
@@ -0,0 +1,276 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+var limitedTotal = metrics.NewCounter("pixivbot_rate_limited_total", "Requests rejected by the rate limits by scope.", "scope")
+
+// Rate allows Count requests per Per, Count is also the burst size. The zero
+// Rate is unlimited.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses rates like 10/1m, an empty string is unlimited
+func ParseRate(s string) (rate Rate, err error) {
+	if s == "" {
+		return
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return rate, fmt.Errorf("invalid rate %q, expected count/duration", s)
+	}
+	rate.Count, err = strconv.Atoi(parts[0])
+	if err != nil || rate.Count <= 0 {
+		return rate, fmt.Errorf("invalid rate %q, expected a positive count", s)
+	}
+	rate.Per, err = time.ParseDuration(parts[1])
+	if err != nil || rate.Per <= 0 {
+		return rate, fmt.Errorf("invalid rate %q, expected a positive duration", s)
+	}
+	return
+}
+
+func (rate Rate) String() string {
+	if rate.Count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%v", rate.Count, rate.Per)
+}
+
+// Limits protect pixiv and the bot from abuse, bot admins are never limited
+type Limits struct {
+	User Rate
+	Chat Rate
+	// Downloads caps the concurrent image downloads, 0 is unlimited
+	Downloads int
+	// ZipWorks caps the works of an artist packed by /zip, ZipPartSize is
+	// the size of the zip parts, 0 uses the defaults
+	ZipWorks    int
+	ZipPartSize int64
+	// if an allow list is set, only the listed users or chats may use the
+	// bot, the deny lists are checked first
+	AllowUsers map[int]bool
+	DenyUsers  map[int]bool
+	AllowChats map[int64]bool
+	DenyChats  map[int64]bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// warned is set once the user was told to slow down, so a spammer
+	// doesn't get a reply for every message
+	warned bool
+}
+
+// limiter is a token bucket per key
+type limiter struct {
+	mutex   sync.Mutex
+	clock   Clock
+	rate    Rate
+	buckets map[int64]*bucket
+	pruned  time.Time
+}
+
+func newLimiter(clock Clock, rate Rate) *limiter {
+	return &limiter{clock: clock, rate: rate, buckets: map[int64]*bucket{}}
+}
+
+// take removes a token from the bucket of the key, if the bucket is empty it
+// returns how long to wait and whether the wait was already reported
+func (l *limiter) take(key int64) (wait time.Duration, warned bool) {
+	if l.rate.Count == 0 {
+		return 0, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	l.prune(now)
+	capacity := float64(l.rate.Count)
+	interval := l.rate.Per / time.Duration(l.rate.Count)
+	current, ok := l.buckets[key]
+	if !ok {
+		current = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = current
+	}
+	current.tokens = math.Min(capacity, current.tokens+float64(now.Sub(current.last))/float64(interval))
+	current.last = now
+	if current.tokens >= 1 {
+		current.tokens--
+		current.warned = false
+		return 0, false
+	}
+	wait = time.Duration((1 - current.tokens) * float64(interval))
+	warned = current.warned
+	current.warned = true
+	return
+}
+
+// refund gives back the token of a request rejected by another limiter
+func (l *limiter) refund(key int64) {
+	if l.rate.Count == 0 {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if current, ok := l.buckets[key]; ok {
+		current.tokens = math.Min(float64(l.rate.Count), current.tokens+1)
+	}
+}
+
+// prune drops the buckets which are full again, at most once per period
+func (l *limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.rate.Per {
+		return
+	}
+	l.pruned = now
+	for key, current := range l.buckets {
+		if now.Sub(current.last) >= l.rate.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// permitted checks the allow and deny lists
+func (limits *Limits) permitted(user *tb.User, chat *tb.Chat) bool {
+	if user != nil && limits.DenyUsers[user.ID] {
+		return false
+	}
+	if chat != nil && limits.DenyChats[chat.ID] {
+		return false
+	}
+	if len(limits.AllowUsers) == 0 && len(limits.AllowChats) == 0 {
+		return true
+	}
+	return (user != nil && limits.AllowUsers[user.ID]) || (chat != nil && limits.AllowChats[chat.ID])
+}
+
+// updateSource returns the sender and the chat of the update
+func updateSource(upd *tb.Update) (*tb.User, *tb.Chat) {
+	switch {
+	case upd.Message != nil:
+		return upd.Message.Sender, upd.Message.Chat
+	case upd.ChannelPost != nil:
+		return nil, upd.ChannelPost.Chat
+	case upd.Callback != nil:
+		if upd.Callback.Message != nil {
+			return upd.Callback.Sender, upd.Callback.Message.Chat
+		}
+		return upd.Callback.Sender, nil
+	case upd.Query != nil:
+		return &upd.Query.From, nil
+	}
+	return nil, nil
+}
+
+// allowUpdate drops the updates of denied users and chats silently
+func (b *Bot) allowUpdate(upd *tb.Update) bool {
+	user, chat := updateSource(upd)
+	if b.isBotAdmin(user) || b.Limits.permitted(user, chat) {
+		return true
+	}
+	limitedTotal.Inc("denied")
+	return false
+}
+
+// limit takes a token from the buckets of the user and the chat of the
+// request, the error asks the user to slow down and is silent if they were
+// already told
+func (b *Bot) limit(req *request) error {
+	if b.isBotAdmin(req.user) {
+		return nil
+	}
+	var wait time.Duration
+	var warned bool
+	scope := "user"
+	if req.user != nil {
+		wait, warned = b.userLimiter.take(int64(req.user.ID))
+	}
+	// private chats have the id of the user, they are only limited once
+	if wait == 0 && req.chat != nil && req.chat.Type != tb.ChatPrivate {
+		wait, warned = b.chatLimiter.take(req.chat.ID)
+		scope = "chat"
+		// the user is not charged for a request the chat limit rejects
+		if wait > 0 && req.user != nil {
+			b.userLimiter.refund(int64(req.user.ID))
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	limitedTotal.Inc(scope)
+	seconds := int(math.Ceil(wait.Seconds()))
+	return blockedError{reason: req.tr(SLOW_DOWN, seconds), silent: warned}
+}
+
+// downloadSlots caps the concurrent downloads, a nil channel is unlimited
+type downloadSlots chan struct{}
+
+// acquire waits for a free slot, release gives it back
+func (slots downloadSlots) acquire(ctx context.Context) (release func(), err error) {
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// slotReader holds the download slot until the download is closed
+type slotReader struct {
+	io.ReadCloser
+	release func()
+}
+
+func (reader slotReader) Close() error {
+	defer reader.release()
+	return reader.ReadCloser.Close()
+}
+
+// limitedImageFetcher caps the concurrent downloads of the fetcher
+type limitedImageFetcher struct {
+	fetcher ImageFetcher
+	slots   downloadSlots
+}
+
+func (fetcher limitedImageFetcher) FetchImage(ctx context.Context, source downloader.ImageSource) (tb.File, error) {
+	release, err := fetcher.slots.acquire(ctx)
+	if err != nil {
+		return tb.File{}, err
+	}
+	defer release()
+	return fetcher.fetcher.FetchImage(ctx, source)
+}
+
+// Open downloads the file within the -max-downloads cap shared with the
+// images, the slot is held until the reader is closed
+func (b *Bot) Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	release, err := b.downloads.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := downloader.Open(ctx, source)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return slotReader{ReadCloser: reader, release: release}, nil
+}
@@ -0,0 +1,218 @@
+package bot
+
+import (
+	"errors"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// REFRESH_DELAY spaces the posts checked by the periodic refresh, so a long
+// history doesn't hit the pixiv rate limits
+const REFRESH_DELAY = 2 * time.Second
+
+const (
+	REFRESH_UPDATED   = "updated"
+	REFRESH_UNCHANGED = "unchanged"
+	REFRESH_DELETED   = "deleted"
+)
+
+var refreshedTotal = metrics.NewCounter("pixivbot_posts_refreshed_total", "Posts checked against pixiv by result.", "result")
+
+// postMessage is the first message of the post, which has the caption
+func postMessage(post storage.Post) tb.StoredMessage {
+	return tb.StoredMessage{MessageID: strconv.Itoa(post.Messages[0]), ChatID: post.Chat}
+}
+
+func isNotModified(err error) bool {
+	return errors.Is(err, tb.ErrMessageNotModified) || errors.Is(err, tb.ErrSameMessageContent)
+}
+
+// updatePost saves the changes to the post in the history
+func (b *Bot) updatePost(req *request, post storage.Post, fn func(*storage.Post)) {
+	err := b.Store.UpdatePosts(post.Illust, func(current *storage.Post) {
+		if current.Chat == post.Chat && len(current.Messages) > 0 && current.Messages[0] == post.Messages[0] {
+			fn(current)
+		}
+	})
+	if err != nil {
+		req.log.Warn("failed to update post", "error", err)
+	}
+}
+
+// postRequest is a request of the chat of the post with the settings and the
+// language the caption was rendered with, which are of the origin chat
+func (b *Bot) postRequest(chat *tb.Chat, user *tb.User, post storage.Post) *request {
+	req := b.newRequest(chat, user)
+	if post.Origin != 0 && post.Origin != chat.ID {
+		req.settings = b.Store.Get(post.Origin)
+		req.lang = getLocale(req.settings, nil)
+	}
+	if post.Lang != "" {
+		req.lang = post.Lang
+	}
+	return req
+}
+
+// deletedTemplate puts the marker above the recorded caption, the caption is
+// the description so renderCaption shortens it to make room for the marker
+var deletedTemplate = template.Must(parseTemplate("{{.Title}}\n{{.Description}}"))
+
+// refreshPost renders the caption of the post again with the current stats
+// and edits the message if it changed. If the work was deleted on pixiv the
+// recorded caption is marked instead. The request must be made by
+// postRequest, so the caption keeps its template and language.
+func (b *Bot) refreshPost(req *request, post storage.Post) (result string, err error) {
+	req = req.with("illust", post.Illust, "target", post.Chat)
+	defer func() {
+		req.done("refresh", err)
+		if err == nil {
+			refreshedTotal.Inc(result)
+		}
+	}()
+	if len(post.Messages) == 0 {
+		return REFRESH_UNCHANGED, nil
+	}
+	now := b.Clock.Now()
+	details, err := b.Details.GetDetails(req.ctx, post.Illust, req.lang)
+	if errors.Is(err, pixiv.ErrDeleted) || errors.Is(err, pixiv.ErrNotFound) {
+		if post.Deleted {
+			return REFRESH_UNCHANGED, nil
+		}
+		caption := post.Caption
+		// the caption is unknown for posts recorded before captions were
+		// kept, those are only marked in the history
+		if caption != "" {
+			caption, err = renderCaption(deletedTemplate, captionData{Title: req.tr(POST_SOURCE_DELETED), Description: caption})
+			if err != nil {
+				return
+			}
+			_, err = b.Telegram.EditCaption(postMessage(post), caption, &tb.SendOptions{ParseMode: "html"})
+			if err != nil && !isNotModified(err) {
+				return
+			}
+		}
+		b.updatePost(req, post, func(current *storage.Post) {
+			current.Caption = caption
+			current.Deleted = true
+			current.Refreshed = now
+		})
+		return REFRESH_DELETED, nil
+	} else if err != nil {
+		return
+	}
+	extracted := b.extractPixiv(details)
+	caption, err := getCaption(req, extracted, details)
+	if err != nil {
+		return
+	}
+	result = REFRESH_UNCHANGED
+	if caption != post.Caption || post.Deleted {
+		options := &tb.SendOptions{ParseMode: "html"}
+		// editing drops the buttons unless they are sent again, albums and
+		// channel posts have none
+		if !post.Album && req.chat.Type != tb.ChatChannel && req.chat.Type != tb.ChatChannelPrivate {
+			options.ReplyMarkup = makeMenu(req, extracted, details, len(b.getDestinations(req.chat)) > 0, b.canBookmark(req))
+		}
+		_, err = b.Telegram.EditCaption(postMessage(post), caption, options)
+		if err != nil && !isNotModified(err) {
+			return
+		}
+		err = nil
+		result = REFRESH_UPDATED
+	}
+	b.updatePost(req, post, func(current *storage.Post) {
+		current.Caption = caption
+		current.Deleted = false
+		current.Refreshed = now
+	})
+	return
+}
+
+// RefreshPosts refreshes the channel posts sent since, waiting delay between
+// the posts. It returns how many posts were checked and edited.
+func (b *Bot) RefreshPosts(since time.Time, delay time.Duration) (checked int, edited int, err error) {
+	posts, err := b.Store.PostsSince(since)
+	if err != nil {
+		return
+	}
+	for _, post := range posts {
+		chat, err := b.cache.chatByID(strconv.FormatInt(post.Chat, 10))
+		if err != nil {
+			logging.Default.Warn("failed to get chat of post", "chat", post.Chat, "error", err)
+			continue
+		}
+		// previews in private chats and groups are not worth the requests
+		if chat.Type != tb.ChatChannel && chat.Type != tb.ChatChannelPrivate {
+			continue
+		}
+		if checked > 0 {
+			time.Sleep(delay)
+		}
+		checked++
+		result, err := b.refreshPost(b.postRequest(chat, nil, post).with("source", "refresh"), post)
+		if err == nil && result != REFRESH_UNCHANGED {
+			edited++
+		}
+	}
+	return
+}
+
+// RefreshLoop refreshes the channel posts younger than age every interval,
+// it never returns
+func (b *Bot) RefreshLoop(interval time.Duration, age time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checked, edited, err := b.RefreshPosts(b.Clock.Now().Add(-age), REFRESH_DELAY)
+		if err != nil {
+			logging.Default.Error("refreshing posts failed", "error", err)
+			continue
+		}
+		logging.Default.Info("posts refreshed", "checked", checked, "edited", edited)
+	}
+}
+
+// handleRefreshPost refreshes the post replied to, in the discussion group
+// of a channel the reply is to the automatic forward of the post
+func (b *Bot) handleRefreshPost(req *request, m *tb.Message) {
+	if !b.requireAdmin(req, m) {
+		return
+	}
+	if err := b.limit(req); err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	chatID, messageID := m.ReplyTo.Chat.ID, m.ReplyTo.ID
+	if m.ReplyTo.OriginalChat != nil {
+		chatID, messageID = m.ReplyTo.OriginalChat.ID, m.ReplyTo.OriginalMessageID
+	}
+	post, found, err := b.Store.PostByMessage(chatID, messageID)
+	if err == nil && !found {
+		err = req.errorf(POST_NOT_FOUND)
+	}
+	var chat *tb.Chat
+	if err == nil {
+		chat, err = b.cache.chatByID(strconv.FormatInt(chatID, 10))
+	}
+	var result string
+	if err == nil {
+		result, err = b.refreshPost(b.postRequest(chat, m.Sender, post), post)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	reply := map[string]string{
+		REFRESH_UPDATED:   POST_REFRESHED,
+		REFRESH_UNCHANGED: POST_UNCHANGED,
+		REFRESH_DELETED:   POST_MARKED_DELETED,
+	}[result]
+	req.send(b.Telegram, m.Chat, req.tr(reply), &tb.SendOptions{ReplyTo: m})
+}
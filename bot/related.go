@@ -0,0 +1,189 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// RELATED_LIMIT is how many recommendations are requested from pixiv
+const RELATED_LIMIT = 18
+
+const RELATED_CACHE_TTL = time.Hour
+
+// relatedPage is the callback data of the carousel, the index-th related
+// work of the origin illust
+type relatedPage struct {
+	origin int
+	index  int
+}
+
+func (page relatedPage) String() string {
+	return fmt.Sprintf("%d:%d", page.origin, page.index)
+}
+
+func parseRelatedPage(data string) (page relatedPage, err error) {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) != 2 {
+		return page, fmt.Errorf("invalid page %q", data)
+	}
+	page.origin, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	page.index, err = strconv.Atoi(parts[1])
+	return
+}
+
+// relatedDetails fills the fields of the details checked by the blocklist
+func relatedDetails(illust pixiv.RelatedIllust) *pixiv.DetailsApi {
+	details := &pixiv.DetailsApi{}
+	details.AuthorDetails.UserID = illust.UserID
+	details.IllustDetails.Tags = illust.Tags
+	return details
+}
+
+// getRelated returns the recommendations of the illust without the blocked
+// ones, the list is cached so paging doesn't request pixiv again
+func (b *Bot) getRelated(req *request, id int) ([]pixiv.RelatedIllust, error) {
+	key := fmt.Sprintf("related:%d:%s", id, req.lang)
+	var related []pixiv.RelatedIllust
+	data, ok := b.Store.CacheGet(key)
+	if !ok || json.Unmarshal(data, &related) != nil {
+		var err error
+		related, err = b.Details.GetRelated(req.ctx, id, RELATED_LIMIT, req.lang)
+		if err != nil {
+			return nil, err
+		}
+		data, _ = json.Marshal(related)
+		if err := b.Store.CachePut(key, data, RELATED_CACHE_TTL); err != nil {
+			req.log.Warn("failed to cache related works", "error", err)
+		}
+	}
+	result := make([]pixiv.RelatedIllust, 0, len(related))
+	for _, illust := range related {
+		if b.checkBlocked(req, relatedDetails(illust)) == nil {
+			result = append(result, illust)
+		}
+	}
+	return result, nil
+}
+
+func makeRelatedMenu(req *request, page relatedPage, count int, illust pixiv.RelatedIllust, post bool) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	previous := relatedPage{origin: page.origin, index: (page.index + count - 1) % count}
+	next := relatedPage{origin: page.origin, index: (page.index + 1) % count}
+	actions := []tb.Btn{menu.Data(req.tr(BUTTON_PREVIEW), "preview", illust.ID)}
+	if post {
+		actions = append(actions, menu.Data(req.tr(POST_TO_CHANNEL), "post", illust.ID))
+	}
+	menu.Inline(
+		menu.Row(
+			menu.Data("◀", "related-page", previous.String()),
+			menu.Data("▶", "related-page", next.String()),
+		),
+		menu.Row(actions...),
+		menu.Row(menu.Data(req.tr(BUTTON_BACK), "related-back", strconv.Itoa(page.origin))),
+	)
+	return menu
+}
+
+// showRelated edits the message into the page of the carousel, the index
+// wraps around
+func (b *Bot) showRelated(req *request, msg *tb.Message, page relatedPage) (err error) {
+	req = req.with("illust", page.origin, "index", page.index)
+	defer func() { req.done("related", err) }()
+	related, err := b.getRelated(req, page.origin)
+	if err != nil {
+		return
+	}
+	if len(related) == 0 {
+		return req.errorf(RELATED_EMPTY)
+	}
+	page.index = (page.index%len(related) + len(related)) % len(related)
+	illust := related[page.index]
+	file, err := b.Images.FetchImage(req.ctx, illust)
+	if err != nil {
+		return
+	}
+	caption := fmt.Sprintf(`<a href="https://www.pixiv.net/artworks/%s"><b>%s</b></a> - %s`+"\n%s",
+		illust.ID, html.EscapeString(illust.Title), html.EscapeString(illust.UserName),
+		req.tr(RELATED_POSITION, page.index+1, len(related)))
+	menu := makeRelatedMenu(req, page, len(related), illust, len(b.getDestinations(req.chat)) > 0)
+	_, err = b.Telegram.EditMedia(msg, &tb.Photo{File: file, Caption: caption}, &tb.SendOptions{ParseMode: "html"}, menu)
+	return
+}
+
+// restorePreview edits the carousel back into the preview of the illust
+func (b *Bot) restorePreview(req *request, msg *tb.Message, id int) (err error) {
+	req = req.with("illust", id)
+	defer func() { req.done("restore", err) }()
+	details, err := b.Details.GetDetails(req.ctx, id, req.lang)
+	if err != nil {
+		return
+	}
+	extracted := b.extractPixiv(details)
+	photo, err := b.getPhoto(req, extracted, details)
+	if err != nil {
+		return
+	}
+	menu := makeMenu(req, extracted, details, len(b.getDestinations(req.chat)) > 0, b.canBookmark(req))
+	_, err = b.Telegram.EditMedia(msg, photo, &tb.SendOptions{ParseMode: "html"}, menu)
+	return
+}
+
+func (b *Bot) handleRelated(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	value, err := parseIllustId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	b.respondRelated(req, c, relatedPage{origin: value})
+}
+
+func (b *Bot) handleRelatedPage(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	page, err := parseRelatedPage(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	b.respondRelated(req, c, page)
+}
+
+func (b *Bot) respondRelated(req *request, c *tb.Callback, page relatedPage) {
+	err := b.limit(req)
+	if err == nil {
+		err = b.showRelated(req, c.Message, page)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
+
+func (b *Bot) handleRelatedBack(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	value, err := parseIllustId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.restorePreview(req, c.Message, value)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
@@ -0,0 +1,151 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// request describes where a request comes from, it carries the logger with
+// the correlation id of the update
+type request struct {
+	// chat is the chat where the request comes from, its settings are used
+	chat     *tb.Chat
+	user     *tb.User
+	settings storage.ChatSettings
+	id       string
+	lang     string
+	ctx      context.Context
+	log      *logging.Logger
+	start    time.Time
+}
+
+func (b *Bot) newRequest(chat *tb.Chat, user *tb.User) *request {
+	id := logging.NewID()
+	log := logging.Default.With("rid", id)
+	if chat != nil {
+		log = log.With("chat", chat.ID)
+	}
+	if user != nil {
+		log = log.With("user", user.ID)
+	}
+	var settings storage.ChatSettings
+	if chat != nil {
+		settings = b.Store.Get(chat.ID)
+	}
+	return &request{
+		chat:     chat,
+		user:     user,
+		settings: settings,
+		id:       id,
+		lang:     getLocale(settings, user),
+		ctx:      logging.NewContext(context.Background(), log),
+		log:      log,
+		start:    time.Now(),
+	}
+}
+
+func (req *request) tr(key string, args ...interface{}) string {
+	return tr(req.lang, key, args...)
+}
+
+// with adds fields to the logger of the request
+func (req *request) with(kv ...interface{}) *request {
+	clone := *req
+	clone.log = req.log.With(kv...)
+	clone.ctx = logging.NewContext(req.ctx, clone.log)
+	return &clone
+}
+
+var (
+	updatesTotal   = metrics.NewCounter("pixivbot_updates_total", "Telegram updates by type.", "type")
+	telegramErrors = metrics.NewCounter("pixivbot_telegram_errors_total", "Failed telegram requests by action and error code.", "action", "code")
+	requestsTotal  = metrics.NewCounter("pixivbot_requests_total", "Handled previews and posts by action and result.", "action", "result")
+)
+
+// updateType classifies the update for metrics
+func updateType(upd *tb.Update) string {
+	switch {
+	case upd.Message != nil && strings.HasPrefix(upd.Message.Text, "/"):
+		return "command"
+	case upd.Message != nil && upd.Message.Text != "":
+		return "text"
+	case upd.Message != nil:
+		return "message"
+	case upd.Query != nil:
+		return "inline_query"
+	case upd.Callback != nil:
+		return "callback"
+	case upd.ChannelPost != nil:
+		return "channel_post"
+	case upd.ChatMember != nil || upd.MyChatMember != nil:
+		return "chat_member"
+	}
+	return "other"
+}
+
+func countUpdate(upd *tb.Update) bool {
+	updatesTotal.Inc(updateType(upd))
+	return true
+}
+
+// errorCode turns telegram errors into a metric label
+func errorCode(err error) string {
+	var apiError *tb.APIError
+	if errors.As(err, &apiError) {
+		return strconv.Itoa(apiError.Code)
+	}
+	return "other"
+}
+
+func (req *request) check(action string, err error) {
+	if err != nil {
+		telegramErrors.Inc(action, errorCode(err))
+		req.log.Warn("telegram request failed", "action", action, "error", err)
+	}
+}
+
+func (req *request) send(telegram Sender, to tb.Recipient, what interface{}, options ...interface{}) *tb.Message {
+	msg, err := telegram.Send(to, what, options...)
+	req.check("send", err)
+	return msg
+}
+
+func (req *request) respond(telegram Sender, c *tb.Callback, resp ...*tb.CallbackResponse) {
+	req.check("respond", telegram.Respond(c, resp...))
+}
+
+func (req *request) delete(telegram Sender, msg tb.Editable) {
+	req.check("delete", telegram.Delete(msg))
+}
+
+func (req *request) notify(telegram Sender, to tb.Recipient, action tb.ChatAction) {
+	req.check("notify", telegram.Notify(to, action))
+}
+
+func (req *request) answer(telegram Sender, q *tb.Query, resp *tb.QueryResponse) {
+	req.check("answer", telegram.Answer(q, resp))
+}
+
+func (req *request) editMarkup(telegram Sender, msg tb.Editable, markup *tb.ReplyMarkup) {
+	_, err := telegram.EditReplyMarkup(msg, markup)
+	req.check("edit markup", err)
+}
+
+// done logs the outcome of the request
+func (req *request) done(action string, err error) {
+	if err != nil {
+		requestsTotal.Inc(action, "error")
+		req.log.Error(action+" failed", "duration", time.Since(req.start), "error", err)
+		return
+	}
+	requestsTotal.Inc(action, "ok")
+	req.log.Info(action, "duration", time.Since(req.start))
+}
@@ -0,0 +1,293 @@
+package bot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const SERIES_CACHE_TTL = 10 * time.Minute
+
+// SERIES_LIST_LIMIT caps the works listed in the series message, telegram
+// messages are limited to 4096 characters
+const SERIES_LIST_LIMIT = 50
+
+func getSeriesURL(user string, series string) string {
+	return fmt.Sprintf("https://www.pixiv.net/user/%s/series/%s", user, series)
+}
+
+func parseSeriesUrl(input string) (result int, err error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "https" || (u.Host != "www.pixiv.net" && u.Host != "pixiv.net") {
+		return 0, fmt.Errorf("not a pixiv link")
+	}
+	path := u.Path
+	if strings.HasPrefix(path, "/en/") {
+		path = path[len("/en"):]
+	}
+	var user int
+	_, err = fmt.Sscanf(path, "/user/%d/series/%d", &user, &result)
+	if err != nil {
+		err = fmt.Errorf("not a series link")
+	}
+	return
+}
+
+func parseSeriesId(input string) (result int, err error) {
+	result, err = strconv.Atoi(input)
+	if err == nil {
+		return
+	}
+	result, err = parseSeriesUrl(input)
+	return
+}
+
+// getSeries returns the works of the series, the list is cached so posting
+// after listing doesn't request pixiv again
+func (b *Bot) getSeries(req *request, id int) (*pixiv.Series, error) {
+	key := fmt.Sprintf("series:%d:%s", id, req.lang)
+	series := &pixiv.Series{}
+	data, ok := b.Store.CacheGet(key)
+	if ok && json.Unmarshal(data, series) == nil {
+		return series, nil
+	}
+	series, err := b.Details.GetSeries(req.ctx, id, req.lang)
+	if err != nil {
+		return nil, err
+	}
+	data, _ = json.Marshal(series)
+	if err := b.Store.CachePut(key, data, SERIES_CACHE_TTL); err != nil {
+		req.log.Warn("failed to cache series", "error", err)
+	}
+	return series, nil
+}
+
+// formatSeries lists the works of the series with links
+func formatSeries(req *request, series *pixiv.Series) string {
+	var builder strings.Builder
+	title := fmt.Sprintf(`<a href="%s">%s</a>`, getSeriesURL(series.UserID, series.ID), html.EscapeString(series.Title))
+	builder.WriteString(req.tr(SERIES_HEADER, title, len(series.Works)))
+	for i, work := range series.Works {
+		if i == SERIES_LIST_LIMIT {
+			builder.WriteString("\n…")
+			break
+		}
+		fmt.Fprintf(&builder, "\n%d. <a href=\"https://www.pixiv.net/artworks/%s\">%s</a>", work.Order, work.ID, html.EscapeString(work.Title))
+	}
+	return builder.String()
+}
+
+// seriesTarget is the payload of the buttons in the channel picker of the
+// series
+type seriesTarget struct {
+	series int
+	chat   int64
+}
+
+func (target seriesTarget) String() string {
+	return fmt.Sprintf("%d|%d", target.series, target.chat)
+}
+
+func parseSeriesTarget(data string) (target seriesTarget, err error) {
+	_, err = fmt.Sscanf(strings.ReplaceAll(data, "|", " "), "%d %d", &target.series, &target.chat)
+	return
+}
+
+func makeSeriesMenu(req *request, series string) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	menu.Inline(menu.Row(menu.Data(req.tr(BUTTON_POST_SERIES), "series-post", series)))
+	return menu
+}
+
+func makeSeriesPicker(req *request, destinations []*tb.Chat, series int) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	rows := make([]tb.Row, 0, len(destinations)+1)
+	for _, destination := range destinations {
+		target := seriesTarget{series: series, chat: destination.ID}
+		rows = append(rows, menu.Row(menu.Data("→ "+chatName(destination), "series-to", target.String())))
+	}
+	rows = append(rows, menu.Row(menu.Data(req.tr(BUTTON_BACK), "series-back", strconv.Itoa(series))))
+	menu.Inline(rows...)
+	return menu
+}
+
+// sendSeries sends the list of the works in the series to chat, with the
+// post button if the chat has destinations
+func (b *Bot) sendSeries(req *request, chat *tb.Chat, id int, reply *tb.Message) (err error) {
+	req = req.with("series", id, "target", chat.ID)
+	defer func() { req.done("series", err) }()
+	series, err := b.getSeries(req, id)
+	if err != nil {
+		return
+	}
+	if len(series.Works) == 0 {
+		return req.errorf(SERIES_EMPTY)
+	}
+	options := []interface{}{&tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               reply,
+	}}
+	if len(b.getDestinations(chat)) > 0 {
+		options = append(options, makeSeriesMenu(req, series.ID))
+	}
+	_, err = b.Telegram.Send(chat, formatSeries(req, series), options...)
+	return
+}
+
+// postSeries sends the works of the series to chat one by one, multi page
+// works as albums. Blocked works are skipped, other errors stop the posting.
+// Every work after the first takes a token of the rate limit, so the posting
+// stops once the user is out of tokens.
+func (b *Bot) postSeries(req *request, chat *tb.Chat, series *pixiv.Series) (posted int, err error) {
+	for i, work := range series.Works {
+		id, err := strconv.Atoi(work.ID)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			if err = b.limit(req); err != nil {
+				return posted, err
+			}
+		}
+		if work.PageCount > 1 {
+			err = b.makeAlbum(req, chat, id)
+		} else {
+			err = b.makePixiv(req, chat, id, nil)
+		}
+		var blocked blockedError
+		if errors.As(err, &blocked) {
+			continue
+		} else if err != nil {
+			return posted, err
+		}
+		posted++
+	}
+	return posted, nil
+}
+
+// respondSeriesPost answers the callback before posting, as posting a long
+// series takes longer than telegram waits for the answer
+func (b *Bot) respondSeriesPost(req *request, c *tb.Callback, destination *tb.Chat, id int) {
+	req = req.with("series", id, "target", destination.ID)
+	series, err := b.getSeries(req, id)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(SERIES_POSTING, len(series.Works))})
+	req.editMarkup(b.Telegram, c.Message, makeSeriesMenu(req, series.ID))
+	posted, err := b.postSeries(req, destination, series)
+	req.done("series-post", err)
+	if err != nil {
+		b.sendError(req, c.Message.Chat, err)
+	}
+	req.send(b.Telegram, c.Message.Chat, req.tr(SERIES_POSTED, posted, len(series.Works)), &tb.SendOptions{ReplyTo: c.Message})
+}
+
+func (b *Bot) handleSeriesCommand(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	value, err := parseSeriesId(strings.TrimSpace(m.Payload))
+	if err != nil {
+		req.send(b.Telegram, m.Chat, req.tr(SERIES_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if err = b.limit(req); err == nil {
+		err = b.sendSeries(req, m.Chat, value, nil)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+		return
+	}
+	req.delete(b.Telegram, m)
+}
+
+// handleSeries lists the series of the preview as a reply to it
+func (b *Bot) handleSeries(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	value, err := parseSeriesId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	err = b.limit(req)
+	if err == nil {
+		err = b.sendSeries(req, chat, value, c.Message)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	req.respond(b.Telegram, c)
+}
+
+func (b *Bot) handleSeriesPost(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	value, err := parseSeriesId(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if err = b.limit(req); err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	destinations, err := b.allowedDestinations(req, chat, c.Sender)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	if len(destinations) > 1 {
+		req.editMarkup(b.Telegram, c.Message, makeSeriesPicker(req, destinations, value))
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(PICK_CHANNEL)})
+		return
+	}
+	b.respondSeriesPost(req, c, destinations[0], value)
+}
+
+func (b *Bot) handleSeriesTo(c *tb.Callback) {
+	chat := callbackChat(c)
+	req := b.newRequest(chat, c.Sender)
+	target, err := parseSeriesTarget(c.Data)
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(INVALID_INPUT) + ": " + err.Error(), ShowAlert: true})
+		return
+	}
+	if err = b.limit(req); err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	destination := matchDestination(b.getDestinations(chat), strconv.FormatInt(target.chat, 10))
+	if destination == nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: req.tr(CHANNEL_NOT_FOUND, target.chat), ShowAlert: true})
+		return
+	}
+	ok, err := b.canPost(req, destination, c.Sender)
+	if err == nil && !ok {
+		err = req.errorf(NO_PERMISSION)
+	}
+	if err != nil {
+		req.respond(b.Telegram, c, &tb.CallbackResponse{Text: errorMessage(req, err), ShowAlert: true})
+		return
+	}
+	b.respondSeriesPost(req, c, destination, target.series)
+}
+
+func (b *Bot) handleSeriesBack(c *tb.Callback) {
+	req := b.newRequest(callbackChat(c), c.Sender)
+	req.editMarkup(b.Telegram, c.Message, makeSeriesMenu(req, c.Data))
+	req.respond(b.Telegram, c)
+}
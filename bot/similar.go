@@ -0,0 +1,319 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/storage"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const SIMILAR_LIMIT = 5
+
+var hashedTotal = metrics.NewCounter("pixivbot_hashed_images_total", "Images added to the similarity index by result.", "result")
+
+// imagePage matches the file name of pximg urls like 1001_p2_master1200.jpg,
+// the page is missing for ugoira
+var imagePage = regexp.MustCompile(`/(\d+)(?:_p(\d+))?(?:_[a-z]+\d*)?\.[a-z]+$`)
+
+// parseImagePage finds the work and page of a pximg url
+func parseImagePage(source string) (illust int, page int, ok bool) {
+	match := imagePage.FindStringSubmatch(source)
+	if match == nil {
+		return 0, 0, false
+	}
+	illust, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		page, _ = strconv.Atoi(match[2])
+	}
+	return illust, page, true
+}
+
+type postHashesKey struct{}
+
+type pageKey struct {
+	illust int
+	page   int
+}
+
+// postHashes collects the pages fetched for a post and the hashes the upload
+// method made while decoding them, they are only indexed once the post is
+// sent
+type postHashes struct {
+	mutex   sync.Mutex
+	hashes  map[pageKey]downloader.ImageHash
+	sources map[pageKey]string
+}
+
+func withPostHashes(ctx context.Context) (context.Context, *postHashes) {
+	hashes := &postHashes{hashes: map[pageKey]downloader.ImageHash{}, sources: map[pageKey]string{}}
+	return context.WithValue(ctx, postHashesKey{}, hashes), hashes
+}
+
+func postHashesFrom(ctx context.Context) *postHashes {
+	hashes, _ := ctx.Value(postHashesKey{}).(*postHashes)
+	return hashes
+}
+
+func (hashes *postHashes) add(illust int, page int, hash downloader.ImageHash) {
+	hashes.mutex.Lock()
+	defer hashes.mutex.Unlock()
+	hashes.hashes[pageKey{illust, page}] = hash
+}
+
+func (hashes *postHashes) fetched(illust int, page int, source string) {
+	hashes.mutex.Lock()
+	defer hashes.mutex.Unlock()
+	hashes.sources[pageKey{illust, page}] = source
+}
+
+// RecordHash keeps the hash of a downloaded image for the post it is fetched
+// for, it is the OnHash of downloader.Download. Images fetched outside of a
+// post are not indexed.
+func (b *Bot) RecordHash(ctx context.Context, source string, hash downloader.ImageHash) {
+	hashes := postHashesFrom(ctx)
+	if hashes == nil {
+		return
+	}
+	if illust, page, ok := parseImagePage(source); ok {
+		hashes.add(illust, page, hash)
+	}
+}
+
+// hashingImageFetcher records the pages fetched for a post, the pages the
+// upload method didn't hash are hashed by indexPost after the send
+type hashingImageFetcher struct {
+	fetcher ImageFetcher
+}
+
+func (fetcher hashingImageFetcher) FetchImage(ctx context.Context, source downloader.ImageSource) (tb.File, error) {
+	file, err := fetcher.fetcher.FetchImage(ctx, source)
+	hashes := postHashesFrom(ctx)
+	if err != nil || hashes == nil {
+		return file, err
+	}
+	small := source.GetSmallImage()
+	if illust, page, ok := parseImagePage(small); ok {
+		hashes.fetched(illust, page, small)
+	}
+	return file, nil
+}
+
+// hashPost makes the images fetched for the request hashed, previews in
+// private chats are not indexed and nil is returned
+func (b *Bot) hashPost(req *request, chat *tb.Chat) *postHashes {
+	if chat.Type == tb.ChatPrivate {
+		return nil
+	}
+	var hashes *postHashes
+	req.ctx, hashes = withPostHashes(req.ctx)
+	return hashes
+}
+
+func (b *Bot) saveHash(req *request, key pageKey, hash downloader.ImageHash) {
+	err := b.Store.AddHash(storage.ImageHash{
+		Illust: key.illust,
+		Page:   key.page,
+		PHash:  hash.PHash,
+		DHash:  hash.DHash,
+		Time:   b.Clock.Now(),
+	})
+	if err != nil {
+		hashedTotal.Inc("error")
+		req.log.Warn("failed to save image hash", "page", key.page, "error", err)
+		return
+	}
+	hashedTotal.Inc("ok")
+}
+
+// hashSource downloads the small image within the download cap and hashes
+// it
+func (b *Bot) hashSource(req *request, source string) (downloader.ImageHash, error) {
+	reader, err := b.Open(req.ctx, source)
+	if err != nil {
+		return downloader.ImageHash{}, err
+	}
+	defer reader.Close()
+	return downloader.HashReader(reader)
+}
+
+// indexPost adds the hashes of the sent pages to the index. The pages sent by
+// url were not downloaded by the bot, they are hashed in the background.
+// Failures are only logged as the post is already sent.
+func (b *Bot) indexPost(req *request, hashes *postHashes) {
+	if hashes == nil {
+		return
+	}
+	hashes.mutex.Lock()
+	defer hashes.mutex.Unlock()
+	missing := map[pageKey]string{}
+	for key, source := range hashes.sources {
+		if _, ok := hashes.hashes[key]; !ok {
+			missing[key] = source
+		}
+	}
+	for key, hash := range hashes.hashes {
+		b.saveHash(req, key, hash)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	b.background.Add(1)
+	go func() {
+		defer b.background.Done()
+		for key, source := range missing {
+			hash, err := b.hashSource(req, source)
+			if err != nil {
+				hashedTotal.Inc("error")
+				req.log.Warn("failed to hash image", "url", source, "error", err)
+				continue
+			}
+			b.saveHash(req, key, hash)
+		}
+	}()
+}
+
+type similarMatch struct {
+	illust   int
+	page     int
+	distance int
+}
+
+// findSimilar lists the indexed works close to the hash, closest first and
+// once per work
+func (b *Bot) findSimilar(hash downloader.ImageHash) ([]similarMatch, error) {
+	hashes, err := b.Store.Hashes()
+	if err != nil {
+		return nil, err
+	}
+	best := map[int]similarMatch{}
+	for _, stored := range hashes {
+		distance := hash.Distance(downloader.ImageHash{PHash: stored.PHash, DHash: stored.DHash})
+		if distance > downloader.SIMILAR_DISTANCE {
+			continue
+		}
+		if current, ok := best[stored.Illust]; !ok || distance < current.distance {
+			best[stored.Illust] = similarMatch{illust: stored.Illust, page: stored.Page, distance: distance}
+		}
+	}
+	result := make([]similarMatch, 0, len(best))
+	for _, match := range best {
+		result = append(result, match)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].distance != result[j].distance {
+			return result[i].distance < result[j].distance
+		}
+		return result[i].illust > result[j].illust
+	})
+	return result, nil
+}
+
+// duplicateWarning checks if a work similar to the first page of the illust
+// was already posted to the destination. Nothing is downloaded before the
+// post, so only the first page is compared and only if it is indexed
+// already, that is the work was previewed or posted in a group or channel
+// before. The post is not blocked and the warning is empty when nothing was
+// found.
+func (b *Bot) duplicateWarning(req *request, destination *tb.Chat, illust int) string {
+	stored, ok, err := b.Store.Hash(illust, 0)
+	if err != nil {
+		req.log.Warn("failed to read image hash", "error", err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	matches, err := b.findSimilar(downloader.ImageHash{PHash: stored.PHash, DHash: stored.DHash})
+	if err != nil {
+		req.log.Warn("failed to search similar images", "error", err)
+		return ""
+	}
+	var found *storage.Post
+	for _, match := range matches {
+		posts, err := b.Store.Posts(match.illust)
+		if err != nil {
+			req.log.Warn("failed to read posts", "error", err)
+			return ""
+		}
+		for i := range posts {
+			if posts[i].Chat == destination.ID && (found == nil || posts[i].Time.After(found.Time)) {
+				found = &posts[i]
+			}
+		}
+	}
+	if found == nil {
+		return ""
+	}
+	return req.tr(POST_DUPLICATE, found.Illust, found.Time.Format("2006-01-02"))
+}
+
+// formatSimilar lists the matches with their similarity, the share of equal
+// bits of the hashes
+func formatSimilar(req *request, matches []similarMatch) string {
+	var builder strings.Builder
+	builder.WriteString(req.tr(SIMILAR_HEADER))
+	for i, match := range matches {
+		fmt.Fprintf(&builder, "\n%d. <a href=\"https://www.pixiv.net/artworks/%d\">%d</a> p%d (%d%%)",
+			i+1, match.illust, match.illust, match.page+1, 100-match.distance*100/64)
+	}
+	return builder.String()
+}
+
+// sendSimilar replies to the photo with the indexed works similar to it
+func (b *Bot) sendSimilar(req *request, chat *tb.Chat, photo *tb.Photo, reply *tb.Message) (err error) {
+	req = req.with("target", chat.ID)
+	defer func() { req.done("similar", err) }()
+	req.notify(b.Telegram, chat, tb.Typing)
+	reader, err := b.Telegram.GetFile(&photo.File)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	hash, err := downloader.HashReader(reader)
+	if err != nil {
+		return
+	}
+	matches, err := b.findSimilar(hash)
+	if err != nil {
+		return
+	}
+	if len(matches) == 0 {
+		return req.errorf(SIMILAR_NOT_FOUND)
+	}
+	if len(matches) > SIMILAR_LIMIT {
+		matches = matches[:SIMILAR_LIMIT]
+	}
+	menu := &tb.ReplyMarkup{}
+	menu.Inline(menu.Row(menu.Data(req.tr(BUTTON_SHOW_SOURCE), "preview", strconv.Itoa(matches[0].illust))))
+	_, err = b.Telegram.Send(chat, formatSimilar(req, matches), &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               reply,
+	}, menu)
+	return
+}
+
+// handleSimilar searches the posted works similar to the photo replied to,
+// unlike /source it only uses the local index
+func (b *Bot) handleSimilar(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if m.ReplyTo == nil || m.ReplyTo.Photo == nil {
+		req.send(b.Telegram, m.Chat, req.tr(SIMILAR_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	err := b.limit(req)
+	if err == nil {
+		err = b.sendSimilar(req, m.Chat, m.ReplyTo.Photo, m.ReplyTo)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+	}
+}
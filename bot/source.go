@@ -0,0 +1,137 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/metrics"
+	"github.com/codehz/pixivbot/source"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const SOURCE_CACHE_TTL = time.Hour
+
+// SOURCE_MIN_SIMILARITY drops the matches that are most likely unrelated
+const SOURCE_MIN_SIMILARITY = 50.0
+
+const SOURCE_LIMIT = 5
+
+var sourceSearches = metrics.NewCounter("pixivbot_source_searches_total", "Reverse image searches by result.", "result")
+
+// findSource searches the pixiv works similar to the photo, the results are
+// cached by the file so forwarded photos don't use up the search quota
+func (b *Bot) findSource(req *request, photo *tb.Photo) ([]source.Match, error) {
+	id := photo.UniqueID
+	if id == "" {
+		id = photo.FileID
+	}
+	key := "source:" + id
+	var matches []source.Match
+	data, ok := b.Store.CacheGet(key)
+	if ok && json.Unmarshal(data, &matches) == nil {
+		return matches, nil
+	}
+	reader, err := b.Telegram.GetFile(&photo.File)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	found, err := b.Sources.Find(req.ctx, reader)
+	if err != nil {
+		sourceSearches.Inc("error")
+		return nil, err
+	}
+	for _, match := range found {
+		if match.Similarity >= SOURCE_MIN_SIMILARITY && len(matches) < SOURCE_LIMIT {
+			matches = append(matches, match)
+		}
+	}
+	if len(matches) > 0 {
+		sourceSearches.Inc("found")
+	} else {
+		sourceSearches.Inc("not_found")
+	}
+	data, _ = json.Marshal(matches)
+	if err := b.Store.CachePut(key, data, SOURCE_CACHE_TTL); err != nil {
+		req.log.Warn("failed to cache source", "error", err)
+	}
+	return matches, nil
+}
+
+// formatSources lists the matches with their similarity
+func formatSources(req *request, matches []source.Match) string {
+	var builder strings.Builder
+	builder.WriteString(req.tr(SOURCE_HEADER))
+	for i, match := range matches {
+		fmt.Fprintf(&builder, "\n%d. <a href=\"https://www.pixiv.net/artworks/%d\">%s</a> - %s (%.1f%%)",
+			i+1, match.Illust, html.EscapeString(match.Title), html.EscapeString(match.Author), match.Similarity)
+	}
+	return builder.String()
+}
+
+// makeSourceMenu offers the preview of the best match
+func makeSourceMenu(req *request, matches []source.Match) *tb.ReplyMarkup {
+	menu := &tb.ReplyMarkup{}
+	menu.Inline(menu.Row(menu.Data(req.tr(BUTTON_SHOW_SOURCE), "preview", strconv.Itoa(matches[0].Illust))))
+	return menu
+}
+
+// sendSource replies to the photo with the pixiv works it may come from
+func (b *Bot) sendSource(req *request, chat *tb.Chat, photo *tb.Photo, reply *tb.Message) (err error) {
+	req = req.with("target", chat.ID)
+	defer func() { req.done("source", err) }()
+	req.notify(b.Telegram, chat, tb.Typing)
+	matches, err := b.findSource(req, photo)
+	if err != nil {
+		return
+	}
+	if len(matches) == 0 {
+		return req.errorf(SOURCE_NOT_FOUND)
+	}
+	_, err = b.Telegram.Send(chat, formatSources(req, matches), &tb.SendOptions{
+		DisableWebPagePreview: true,
+		ParseMode:             "html",
+		ReplyTo:               reply,
+	}, makeSourceMenu(req, matches))
+	return
+}
+
+// handleSource searches the source of the photo replied to
+func (b *Bot) handleSource(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	if b.Sources == nil {
+		req.send(b.Telegram, m.Chat, req.tr(SOURCE_DISABLED), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	if m.ReplyTo == nil || m.ReplyTo.Photo == nil {
+		req.send(b.Telegram, m.Chat, req.tr(SOURCE_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	err := b.limit(req)
+	if err == nil {
+		err = b.sendSource(req, m.Chat, m.ReplyTo.Photo, m.ReplyTo)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+	}
+}
+
+// handlePhoto searches the source of the photos sent in private chats, in
+// groups only /source does
+func (b *Bot) handlePhoto(m *tb.Message) {
+	if b.Sources == nil || !m.Private() || m.Photo == nil {
+		return
+	}
+	req := b.newRequest(m.Chat, m.Sender)
+	err := b.limit(req)
+	if err == nil {
+		err = b.sendSource(req, m.Chat, m.Photo, m)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+	}
+}
@@ -0,0 +1,222 @@
+package bot
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// TAG_STYLE_AUTO links the pixiv tag and shows the translation next to it
+	TAG_STYLE_AUTO = "auto"
+	// TAG_STYLE_ORIGINAL shows the pixiv tag as hashtag
+	TAG_STYLE_ORIGINAL = "original"
+	// TAG_STYLE_TRANSLATION prefers the translation provided by pixiv
+	TAG_STYLE_TRANSLATION = "translation"
+	// TAG_STYLE_CANONICAL prefers the canonical form from the dictionary
+	TAG_STYLE_CANONICAL = "canonical"
+)
+
+var tagStyles = []string{TAG_STYLE_AUTO, TAG_STYLE_ORIGINAL, TAG_STYLE_TRANSLATION, TAG_STYLE_CANONICAL}
+
+// hashtagify turns the tag into something telegram recognizes as a hashtag,
+// anything except letters, digits and underscores is replaced by underscores
+func hashtagify(tag string) string {
+	var builder strings.Builder
+	underscore := false
+	digits := true
+	for _, r := range tag {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			if underscore && builder.Len() > 0 {
+				builder.WriteByte('_')
+			}
+			underscore = false
+			digits = digits && unicode.IsDigit(r)
+			builder.WriteRune(r)
+		} else {
+			underscore = true
+		}
+	}
+	result := builder.String()
+	if result != "" && digits {
+		// hashtags consisting of only digits are not recognized
+		return "_" + result
+	}
+	return result
+}
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(hashtagify(tag))
+}
+
+// TagDictionary maps pixiv tags to canonical hashtags, the file is a json
+// object from the canonical hashtag to the list of its synonyms.
+type TagDictionary struct {
+	mutex   sync.RWMutex
+	path    string
+	entries map[string][]string
+	lookup  map[string]string
+}
+
+func NewTagDictionary() *TagDictionary {
+	return &TagDictionary{entries: map[string][]string{}, lookup: map[string]string{}}
+}
+
+func LoadTagDictionary(path string) (*TagDictionary, error) {
+	dict := &TagDictionary{path: path, entries: map[string][]string{}}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		err = json.Unmarshal(data, &dict.entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dict.rebuild()
+	return dict, nil
+}
+
+func (dict *TagDictionary) rebuild() {
+	dict.lookup = map[string]string{}
+	for canonical, synonyms := range dict.entries {
+		dict.lookup[normalizeTag(canonical)] = canonical
+		for _, synonym := range synonyms {
+			dict.lookup[normalizeTag(synonym)] = canonical
+		}
+	}
+}
+
+// Reload reads the dictionary file again
+func (dict *TagDictionary) Reload() error {
+	if dict.path == "" {
+		return nil
+	}
+	loaded, err := LoadTagDictionary(dict.path)
+	if err != nil {
+		return err
+	}
+	dict.mutex.Lock()
+	defer dict.mutex.Unlock()
+	dict.entries = loaded.entries
+	dict.lookup = loaded.lookup
+	return nil
+}
+
+func (dict *TagDictionary) save() error {
+	if dict.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(dict.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := dict.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dict.path)
+}
+
+// canonical returns the canonical hashtag of the tag, or empty string if
+// neither the tag nor its translation is in the dictionary
+func (dict *TagDictionary) canonical(tag string, translation string) string {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+	if result, ok := dict.lookup[normalizeTag(tag)]; ok {
+		return result
+	}
+	if translation == "" {
+		return ""
+	}
+	return dict.lookup[normalizeTag(translation)]
+}
+
+// add merges the synonyms into the canonical hashtag, removing them from any
+// other entry. The canonical hashtag stops being a synonym of other entries.
+func (dict *TagDictionary) add(canonical string, synonyms ...string) error {
+	dict.mutex.Lock()
+	defer dict.mutex.Unlock()
+	// synonyms like the canonical hashtag would remove its own entry
+	key := normalizeTag(canonical)
+	var added []string
+	for _, synonym := range synonyms {
+		if normalizeTag(synonym) != key {
+			added = append(added, synonym)
+		}
+	}
+	// an entry differing only by case is merged, the new spelling is kept
+	for existing, merged := range dict.entries {
+		if existing != canonical && normalizeTag(existing) == key {
+			dict.entries[canonical] = append(dict.entries[canonical], merged...)
+			delete(dict.entries, existing)
+		}
+	}
+	dict.removeSynonymLocked(canonical)
+	for _, synonym := range added {
+		dict.removeLocked(synonym)
+	}
+	dict.entries[canonical] = append(dict.entries[canonical], added...)
+	dict.rebuild()
+	return dict.save()
+}
+
+// removeSynonymLocked removes the tag from the synonyms of every entry
+func (dict *TagDictionary) removeSynonymLocked(tag string) {
+	key := normalizeTag(tag)
+	for canonical, synonyms := range dict.entries {
+		filtered := synonyms[:0]
+		for _, synonym := range synonyms {
+			if normalizeTag(synonym) != key {
+				filtered = append(filtered, synonym)
+			}
+		}
+		dict.entries[canonical] = filtered
+	}
+}
+
+func (dict *TagDictionary) removeLocked(tag string) {
+	key := normalizeTag(tag)
+	for canonical := range dict.entries {
+		if normalizeTag(canonical) == key {
+			delete(dict.entries, canonical)
+		}
+	}
+	dict.removeSynonymLocked(tag)
+}
+
+// remove deletes the tag from the dictionary, removing the whole entry if it
+// is a canonical hashtag
+func (dict *TagDictionary) remove(tag string) error {
+	dict.mutex.Lock()
+	defer dict.mutex.Unlock()
+	dict.removeLocked(tag)
+	dict.rebuild()
+	return dict.save()
+}
+
+// synonyms lists the entry which the tag belongs to
+func (dict *TagDictionary) synonyms(tag string) (string, []string) {
+	dict.mutex.RLock()
+	defer dict.mutex.RUnlock()
+	canonical, ok := dict.lookup[normalizeTag(tag)]
+	if !ok {
+		return "", nil
+	}
+	list := append([]string{}, dict.entries[canonical]...)
+	sort.Strings(list)
+	return canonical, list
+}
+
+func isTagStyle(style string) bool {
+	for _, s := range tagStyles {
+		if s == style {
+			return true
+		}
+	}
+	return false
+}
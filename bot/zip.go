@@ -0,0 +1,286 @@
+package bot
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codehz/pixivbot/archive"
+	"github.com/codehz/pixivbot/pixiv"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const ZIP_WORKS = 30
+
+// ZIP_PART_SIZE keeps the parts under the 50MB upload limit of the bot api
+const ZIP_PART_SIZE = 48 << 20
+
+const ZIP_METADATA = "metadata.json"
+
+var errZipTooLarge = errors.New("file over the zip part size")
+
+// zipMetadata is the metadata.json of a work in the zip
+type zipMetadata struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UserID      string    `json:"user_id"`
+	UserName    string    `json:"user_name"`
+	Tags        []string  `json:"tags"`
+	Uploaded    time.Time `json:"uploaded"`
+	URL         string    `json:"url"`
+	Files       []string  `json:"files"`
+}
+
+// zipEntry is a file of the zip, the originals are downloaded to path and
+// the metadata is kept in data
+type zipEntry struct {
+	name string
+	path string
+	data []byte
+	size int64
+}
+
+func (entry zipEntry) copyTo(w io.Writer) error {
+	if entry.path == "" {
+		_, err := w.Write(entry.data)
+		return err
+	}
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// zipWriter writes the works into temporary zip files of about limit bytes,
+// a new part starts when the next file doesn't fit
+type zipWriter struct {
+	dir   string
+	limit int64
+	parts []string
+	file  *os.File
+	zip   *zip.Writer
+	size  int64
+}
+
+func (writer *zipWriter) add(entries []zipEntry) error {
+	for _, entry := range entries {
+		if writer.zip != nil && writer.size+entry.size > writer.limit {
+			if err := writer.close(); err != nil {
+				return err
+			}
+		}
+		if writer.zip == nil {
+			file, err := os.CreateTemp(writer.dir, "part-*.zip")
+			if err != nil {
+				return err
+			}
+			writer.file = file
+			writer.parts = append(writer.parts, file.Name())
+			writer.zip = zip.NewWriter(file)
+		}
+		// the images are compressed already
+		w, err := writer.zip.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if err = entry.copyTo(w); err != nil {
+			return err
+		}
+		writer.size += entry.size
+	}
+	return nil
+}
+
+func (writer *zipWriter) close() error {
+	if writer.zip == nil {
+		return nil
+	}
+	err := writer.zip.Close()
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	writer.zip, writer.file, writer.size = nil, nil, 0
+	return err
+}
+
+// downloadOriginal saves the file to dir within the download cap, the
+// download stops once it is over limit
+func (b *Bot) downloadOriginal(req *request, dir string, source string, limit int64) (entry zipEntry, err error) {
+	reader, err := b.Open(req.ctx, source)
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+	file, err := os.CreateTemp(dir, "original-*")
+	if err != nil {
+		return
+	}
+	entry.path = file.Name()
+	entry.size, err = io.Copy(file, io.LimitReader(reader, limit+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && entry.size > limit {
+		err = errZipTooLarge
+	}
+	return
+}
+
+// packWork downloads the original files of the work to dir, they are put in
+// a directory per work with the metadata. A file over the part size can't be
+// uploaded and fails the work.
+func (b *Bot) packWork(req *request, dir string, id int) (entries []zipEntry, err error) {
+	details, err := b.Details.GetDetails(req.ctx, id, req.lang)
+	if err != nil {
+		return
+	}
+	if err = b.checkBlocked(req, details); err != nil {
+		return
+	}
+	illust := details.IllustDetails
+	metadata := zipMetadata{
+		ID:          illust.ID,
+		Title:       illust.Title,
+		Description: illust.Comment,
+		UserID:      illust.UserID,
+		UserName:    details.AuthorDetails.UserName,
+		Tags:        illust.Tags,
+		Uploaded:    time.Unix(int64(illust.UploadTimestamp), 0).UTC(),
+		URL:         "https://www.pixiv.net/artworks/" + illust.ID,
+	}
+	for _, source := range archive.Sources(details) {
+		name := path.Base(source)
+		entry, err := b.downloadOriginal(req, dir, source, b.Limits.ZipPartSize)
+		if errors.Is(err, errZipTooLarge) {
+			return nil, req.wrapf(err, ZIP_TOO_LARGE, name, b.Limits.ZipPartSize>>20)
+		} else if err != nil {
+			return nil, err
+		}
+		entry.name = path.Join(illust.ID, name)
+		metadata.Files = append(metadata.Files, name)
+		entries = append(entries, entry)
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return
+	}
+	entries = append(entries, zipEntry{name: path.Join(illust.ID, ZIP_METADATA), data: data, size: int64(len(data))})
+	return
+}
+
+// zipWork adds the work to the zip, its downloads are removed once they are
+// copied
+func (b *Bot) zipWork(req *request, writer *zipWriter, id int) error {
+	dir, err := os.MkdirTemp(writer.dir, "work-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	entries, err := b.packWork(req, dir, id)
+	if err != nil {
+		return err
+	}
+	return writer.add(entries)
+}
+
+// sendZip packs the works and sends the zip to chat as documents named after
+// name, in several parts if it is over the part size. Blocked, deleted and
+// too large works of an artist are skipped, other errors stop the packing.
+// Every work after the first takes a rate limit token, the works packed
+// before the limit is hit are still sent.
+func (b *Bot) sendZip(req *request, chat *tb.Chat, ids []int, name string, reply *tb.Message) (err error) {
+	req = req.with("zip", name, "target", chat.ID)
+	defer func() { req.done("zip", err) }()
+	dir, err := os.MkdirTemp("", "pixivbot-zip-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+	writer := &zipWriter{dir: dir, limit: b.Limits.ZipPartSize}
+	defer writer.close()
+	packed := 0
+	var limited error
+	for i, id := range ids {
+		if i > 0 {
+			if limited = b.limit(req); limited != nil {
+				break
+			}
+		}
+		req.notify(b.Telegram, chat, tb.UploadingDocument)
+		err := b.zipWork(req, writer, id)
+		var blocked blockedError
+		skipped := errors.As(err, &blocked) || errors.Is(err, pixiv.ErrDeleted) || errors.Is(err, pixiv.ErrNotFound) || errors.Is(err, errZipTooLarge)
+		if skipped && len(ids) > 1 {
+			continue
+		} else if err != nil {
+			return err
+		}
+		packed++
+	}
+	if err = writer.close(); err != nil {
+		return
+	}
+	if packed == 0 && limited != nil {
+		return limited
+	} else if packed == 0 {
+		return req.errorf(ZIP_EMPTY)
+	}
+	for i, part := range writer.parts {
+		document := &tb.Document{
+			File:     tb.FromDisk(part),
+			MIME:     "application/zip",
+			FileName: name + ".zip",
+			Caption:  req.tr(ZIP_CAPTION, packed),
+		}
+		if len(writer.parts) > 1 {
+			document.FileName = fmt.Sprintf("%s.part%d.zip", name, i+1)
+			document.Caption += " " + req.tr(ZIP_PART, i+1, len(writer.parts))
+		}
+		if _, err = b.Telegram.Send(chat, document, &tb.SendOptions{ReplyTo: reply}); err != nil {
+			return
+		}
+	}
+	return limited
+}
+
+func (b *Bot) handleZip(m *tb.Message) {
+	req := b.newRequest(m.Chat, m.Sender)
+	payload := strings.TrimSpace(m.Payload)
+	var ids []int
+	var name string
+	user, userErr := parseUserUrl(payload)
+	illust, illustErr := parseIllustId(payload)
+	if userErr != nil && illustErr != nil {
+		req.send(b.Telegram, m.Chat, req.tr(ZIP_USAGE), &tb.SendOptions{ReplyTo: m})
+		return
+	}
+	err := b.limit(req)
+	if err == nil && userErr == nil {
+		ids, err = b.Details.GetUserWorks(req.ctx, user, req.lang)
+		name = "pixiv-user-" + strconv.Itoa(user)
+		if err == nil && len(ids) > b.Limits.ZipWorks {
+			req.send(b.Telegram, m.Chat, req.tr(ZIP_CAPPED, b.Limits.ZipWorks, len(ids)), &tb.SendOptions{ReplyTo: m})
+			ids = ids[:b.Limits.ZipWorks]
+		}
+	} else if err == nil {
+		ids = []int{illust}
+		name = "pixiv-" + strconv.Itoa(illust)
+	}
+	if err == nil {
+		err = b.sendZip(req, m.Chat, ids, name, m)
+	}
+	if err != nil {
+		b.sendError(req, m.Chat, err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/pixiv"
+	"github.com/codehz/pixivbot/pixiv/downloader"
+	"github.com/codehz/pixivbot/storage"
+)
+
+// commands are run by `pixivbot <command> [flags]` instead of starting the bot
+var commands = map[string]func(args []string) error{
+	"backup":   runBackup,
+	"export":   runExport,
+	"fetch":    runFetch,
+	"download": runDownload,
+	"ugoira":   runUgoira,
+}
+
+// openDatabase opens the database and imports the old json settings file the
+// first time
+func openDatabase(path string, settingsPath string) (*storage.DB, error) {
+	db, err := storage.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if settingsPath == "" || len(db.Chats()) > 0 {
+		return db, nil
+	}
+	count, err := storage.ImportSettings(db, settingsPath)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", settingsPath, err)
+	}
+	logging.Default.Info("settings imported", "from", settingsPath, "chats", count)
+	return db, nil
+}
+
+// createOutput returns stdout if path is empty
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
+
+func parseDatabaseFlags(name string, args []string) (db *storage.DB, output io.WriteCloser, err error) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	path := flags.String("db", "", "Database file")
+	outputPath := flags.String("o", "", "Output file, stdout if empty")
+	flags.Parse(args)
+	if *path == "" {
+		return nil, nil, fmt.Errorf("%s: -db is required", name)
+	}
+	// the database is locked while the bot runs, use the admin api then
+	db, err = storage.Open(*path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", *path, err)
+	}
+	output, err = createOutput(*outputPath)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return
+}
+
+func runBackup(args []string) error {
+	db, output, err := parseDatabaseFlags("backup", args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Backup(output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runExport(args []string) error {
+	db, output, err := parseDatabaseFlags("export", args)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = db.Export(output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseWorkFlags parses the flags of the commands taking a work, the id or
+// link may come before the flags
+func parseWorkFlags(flags *flag.FlagSet, args []string) (id int, err error) {
+	var input string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		input = args[0]
+		err = flags.Parse(args[1:])
+	} else {
+		err = flags.Parse(args)
+		input = flags.Arg(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if input == "" {
+		return 0, fmt.Errorf("%s: the id or link of the work is required", flags.Name())
+	}
+	id, err = pixiv.ParseIllustId(input)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %q: %w", flags.Name(), input, err)
+	}
+	return
+}
+
+// parsePages parses ranges like 1-5 or 3 of the pages, which start from 1
+func parsePages(input string, count int) (first int, last int, err error) {
+	if input == "" {
+		return 1, count, nil
+	}
+	parts := strings.SplitN(input, "-", 2)
+	first, err = strconv.Atoi(parts[0])
+	last = first
+	if err == nil && len(parts) == 2 {
+		last, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || first < 1 || last < first {
+		return 0, 0, fmt.Errorf("invalid pages %q, expected a range like 1-5", input)
+	}
+	if last > count {
+		last = count
+	}
+	if first > count {
+		return 0, 0, fmt.Errorf("invalid pages %q, the work has %d pages", input, count)
+	}
+	return
+}
+
+// pages returns the pages of the work like the bot sends them
+func pages(details *pixiv.DetailsApi) []downloader.ImageSource {
+	if len(details.IllustDetails.MangaA) == 0 {
+		return []downloader.ImageSource{details.IllustDetails}
+	}
+	result := make([]downloader.ImageSource, len(details.IllustDetails.MangaA))
+	for i, page := range details.IllustDetails.MangaA {
+		result[i] = page
+	}
+	return result
+}
+
+func runFetch(args []string) error {
+	flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+	lang := flags.String("lang", "", "Language of the tag translations")
+	id, err := parseWorkFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	details, err := pixiv.GetDetils(context.Background(), id, *lang)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(details)
+}
+
+// writeDownload writes the file into dir and prints its path
+func writeDownload(dir string, name string, reader io.Reader) error {
+	target := filepath.Join(dir, name)
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		fmt.Println(target)
+	}
+	return err
+}
+
+// runDownload saves the pages as the bot would upload them, or the untouched
+// original files with -original
+func runDownload(args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	dir := flags.String("o", ".", "Output directory")
+	original := flags.Bool("original", false, "Save the original files instead of the images sent by the bot")
+	pageRange := flags.String("pages", "", "Pages to save like 1-5, all if empty")
+	lang := flags.String("lang", "", "Language of the tag translations")
+	id, err := parseWorkFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	details, err := pixiv.GetDetils(ctx, id, *lang)
+	if err != nil {
+		return err
+	}
+	sources := pages(details)
+	first, last, err := parsePages(*pageRange, len(sources))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	fetcher := downloader.ImageFetcher{UploadMethod: downloader.Download{}}
+	for _, source := range sources[first-1 : last] {
+		if *original {
+			reader, err := downloader.Open(ctx, source.GetOriginalImage())
+			if err != nil {
+				return err
+			}
+			err = writeDownload(*dir, path.Base(source.GetOriginalImage()), reader)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		file, err := fetcher.FetchImage(ctx, source)
+		if err != nil {
+			return err
+		}
+		if err = writeDownload(*dir, path.Base(source.GetSmallImage()), file.FileReader); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUgoira(args []string) error {
+	flags := flag.NewFlagSet("ugoira", flag.ExitOnError)
+	outputPath := flags.String("o", "", "Output gif, stdout if empty")
+	lang := flags.String("lang", "", "Language of the tag translations")
+	id, err := parseWorkFlags(flags, args)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	details, err := pixiv.GetDetils(ctx, id, *lang)
+	if err != nil {
+		return err
+	}
+	if details.IllustDetails.UgoiraMeta.Src == "" {
+		return fmt.Errorf("ugoira: %d is not an ugoira", id)
+	}
+	output, err := createOutput(*outputPath)
+	if err != nil {
+		return err
+	}
+	err = downloader.Ugoira(ctx, details.IllustDetails.UgoiraMeta, output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
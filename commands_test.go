@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestParsePages(t *testing.T) {
+	cases := []struct {
+		input string
+		count int
+		first int
+		last  int
+		valid bool
+	}{
+		{"", 3, 1, 3, true},
+		{"2", 3, 2, 2, true},
+		{"1-2", 3, 1, 2, true},
+		{"2-10", 3, 2, 3, true},
+		{"3-2", 3, 0, 0, false},
+		{"0", 3, 0, 0, false},
+		{"4", 3, 0, 0, false},
+		{"4-5", 3, 0, 0, false},
+		{"-1", 3, 0, 0, false},
+		{"1-", 3, 0, 0, false},
+		{"a-b", 3, 0, 0, false},
+	}
+	for _, c := range cases {
+		first, last, err := parsePages(c.input, c.count)
+		if (err == nil) != c.valid || first != c.first || last != c.last {
+			t.Errorf("%q of %d: got %d-%d %v", c.input, c.count, first, last, err)
+		}
+	}
+}
+
+func TestParseWorkFlags(t *testing.T) {
+	cases := []struct {
+		args  []string
+		id    int
+		pages string
+		valid bool
+	}{
+		{[]string{"1001"}, 1001, "", true},
+		{[]string{"https://www.pixiv.net/artworks/1001", "-pages", "2-3"}, 1001, "2-3", true},
+		{[]string{"-pages", "2", "1001"}, 1001, "2", true},
+		{[]string{"-pages", "2"}, 0, "2", false},
+		{[]string{}, 0, "", false},
+		{[]string{"nothing"}, 0, "", false},
+		{[]string{"1001", "-unknown"}, 0, "", false},
+	}
+	for _, c := range cases {
+		flags := flag.NewFlagSet("download", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		pages := flags.String("pages", "", "")
+		id, err := parseWorkFlags(flags, c.args)
+		if (err == nil) != c.valid || id != c.id || (c.valid && *pages != c.pages) {
+			t.Errorf("%q: got %d %q %v", c.args, id, *pages, err)
+		}
+	}
+}
@@ -2,7 +2,12 @@ module github.com/codehz/pixivbot
 
 go 1.17
 
-require gopkg.in/tucnak/telebot.v2 v2.4.0
+require (
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/tucnak/telebot.v2 v2.4.0
+)
+
+require golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
 
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
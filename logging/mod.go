@@ -0,0 +1,205 @@
+// Package logging is a small leveled logger writing logfmt or json lines, the
+// logger is carried in context.Context so fields like the correlation id
+// follow the request into the pixiv client and the downloader.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+func (level Level) String() string {
+	switch level {
+	case DEBUG:
+		return "debug"
+	case INFO:
+		return "info"
+	case WARN:
+		return "warn"
+	case ERROR:
+		return "error"
+	}
+	return strconv.Itoa(int(level))
+}
+
+func ParseLevel(s string) (Level, error) {
+	for level := DEBUG; level <= ERROR; level++ {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level: %s", s)
+}
+
+type Format int
+
+const (
+	LOGFMT Format = iota
+	JSON
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "logfmt", "":
+		return LOGFMT, nil
+	case "json":
+		return JSON, nil
+	}
+	return LOGFMT, fmt.Errorf("unknown log format: %s", s)
+}
+
+type output struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	format Format
+	level  Level
+}
+
+type Logger struct {
+	output *output
+	fields []interface{}
+}
+
+func New(writer io.Writer, format Format, level Level) *Logger {
+	return &Logger{output: &output{writer: writer, format: format, level: level}}
+}
+
+var Default = New(os.Stderr, LOGFMT, INFO)
+
+// With returns a logger which adds the key value pairs to every line
+func (logger *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(logger.fields)+len(kv))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, kv...)
+	return &Logger{output: logger.output, fields: fields}
+}
+
+func (logger *Logger) Enabled(level Level) bool {
+	return level >= logger.output.level
+}
+
+func (logger *Logger) Debug(msg string, kv ...interface{}) {
+	logger.log(DEBUG, msg, kv)
+}
+
+func (logger *Logger) Info(msg string, kv ...interface{}) {
+	logger.log(INFO, msg, kv)
+}
+
+func (logger *Logger) Warn(msg string, kv ...interface{}) {
+	logger.log(WARN, msg, kv)
+}
+
+func (logger *Logger) Error(msg string, kv ...interface{}) {
+	logger.log(ERROR, msg, kv)
+}
+
+func formatValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return value
+}
+
+func (logger *Logger) log(level Level, msg string, kv []interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+	pairs := make([]interface{}, 0, 6+len(logger.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	pairs = append(pairs, logger.fields...)
+	pairs = append(pairs, kv...)
+	if len(pairs)%2 == 1 {
+		pairs = append(pairs, "<missing>")
+	}
+	var buffer bytes.Buffer
+	if logger.output.format == JSON {
+		writeJSON(&buffer, pairs)
+	} else {
+		writeLogfmt(&buffer, pairs)
+	}
+	buffer.WriteByte('\n')
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.writer.Write(buffer.Bytes())
+}
+
+func writeJSON(buffer *bytes.Buffer, pairs []interface{}) {
+	buffer.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		value, err := json.Marshal(formatValue(pairs[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(pairs[i+1]))
+		}
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+}
+
+func writeLogfmt(buffer *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buffer.WriteByte(' ')
+		}
+		buffer.WriteString(fmt.Sprint(pairs[i]))
+		buffer.WriteByte('=')
+		value := fmt.Sprint(formatValue(pairs[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buffer.WriteString(value)
+	}
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of the context or Default
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+			return logger
+		}
+	}
+	return Default
+}
+
+// NewID generates a random correlation id
+func NewID() string {
+	var data [8]byte
+	rand.Read(data[:])
+	return hex.EncodeToString(data[:])
+}
@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogfmt(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := New(&buffer, LOGFMT, INFO).With("rid", "abc")
+	logger.Debug("hidden")
+	logger.Info("hello world", "chat", 1, "error", errors.New("bad thing"), "empty", "")
+	line := buffer.String()
+	if strings.Contains(line, "hidden") {
+		t.Fatalf("debug line written: %s", line)
+	}
+	if !strings.Contains(line, ` level=info msg="hello world" rid=abc chat=1 error="bad thing" empty=""`) {
+		t.Fatalf("unexpected line: %s", line)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buffer bytes.Buffer
+	ctx := NewContext(context.Background(), New(&buffer, JSON, DEBUG).With("rid", "abc"))
+	FromContext(ctx).Warn("oops", "illust", 92065303, "odd")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "warn" || entry["msg"] != "oops" || entry["rid"] != "abc" || entry["illust"] != float64(92065303) || entry["odd"] != "<missing>" {
+		t.Fatalf("unexpected entry: %v", entry)
+	}
+}
@@ -1,499 +1,322 @@
 package main
 
 import (
-	"bytes"
-	_ "embed"
+	"context"
 	"flag"
-	"fmt"
 	"log"
-	"net/url"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-	"unicode"
 
+	"github.com/codehz/pixivbot/archive"
+	"github.com/codehz/pixivbot/bot"
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
 	"github.com/codehz/pixivbot/pixiv"
 	"github.com/codehz/pixivbot/pixiv/downloader"
-	"github.com/microcosm-cc/bluemonday"
+	"github.com/codehz/pixivbot/source"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
-const (
-	INVALID_INPUT         = "无效输入"
-	NO_LINK               = "找不到关联群组"
-	NO_ADMIN              = "无法读取管理员列表: %e"
-	POST_SUCCESS          = "发送成功"
-	POST_TO_CHANNEL       = "发送到频道"
-	POST_ALBUM_TO_CHANNEL = "发送图集到频道（%d 张）"
-	NO_PERMISSION         = "用户没有发送权限"
-)
-
-var htmlPolicy bluemonday.Policy
-var imagedownloader downloader.ImageFetcher
-var altimagedownloader downloader.InlineImageFetcher
-
-func fixString(input string) string {
-	return strings.ReplaceAll(input, "<br />", "\n")
-}
-
-func getLinkedChat(bot *tb.Bot, orig *tb.Chat) *tb.Chat {
-	chat, err := bot.ChatByID(fmt.Sprintf("%d", orig.ID))
-	if err != nil {
-		return nil
-	}
-	chat, err = bot.ChatByID(fmt.Sprintf("%d", chat.LinkedChatID))
-	if err != nil {
-		return nil
-	}
-	return chat
-}
-
-type titleWithURL struct {
-	title string
-	url   string
-}
-
-type tagData struct {
-	titleWithURL
-	translation string
-}
-
-type extractedInfo struct {
-	artwork titleWithURL
-	author  titleWithURL
-	tags    []tagData
-}
-
-func (info titleWithURL) getLink(format string) string {
-	if format == "#" {
-		return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.title)
-	}
-	return fmt.Sprintf("<a href=\"%s\"><%s>%s</%s></a>", info.url, format, info.title, format)
-}
-
-func isAscii(s string) bool {
-	for _, r := range s {
-		if r > unicode.MaxASCII {
-			return false
-		}
-	}
-	return true
-}
-
-func (info tagData) get() string {
-	if info.translation != "" {
-		if isAscii(info.translation) {
-			return fmt.Sprintf("<a href=\"%s\">#%s</a> <i>%s</i>", info.url, info.title, info.translation)
+func parseIDList(input string) (result []int64, err error) {
+	for _, item := range strings.Split(input, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
 		}
-		return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.translation)
-	}
-	return fmt.Sprintf("<a href=\"%s\">#%s</a>", info.url, info.title)
-}
-
-func extractPixiv(details *pixiv.DetailsApi) (info extractedInfo) {
-	info.artwork.title = details.IllustDetails.Title
-	info.artwork.url = "https://www.pixiv.net/artworks/" + details.IllustDetails.ID
-	info.author.title = details.AuthorDetails.UserName
-	info.author.url = "https://www.pixiv.net/users/" + details.AuthorDetails.UserID
-	tags := details.IllustDetails.DisplayTags
-	info.tags = make([]tagData, len(tags))
-	for i := 0; i < len(tags); i++ {
-		tag := tags[i]
-		info.tags[i] = tagData{
-			titleWithURL: titleWithURL{
-				title: tag.Tag,
-				url:   fmt.Sprintf("https://www.pixiv.net/tags/%s/artworks", tag.Tag),
-			},
-			translation: tag.Translation,
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, err
 		}
+		result = append(result, id)
 	}
 	return
 }
 
-func getCaption(extracted extractedInfo, details *pixiv.DetailsApi) string {
-	var buffer bytes.Buffer
-	fmt.Fprintf(&buffer, "%s %s - %s的插画\n", extracted.tags[0].getLink("#"), extracted.artwork.getLink("b"), extracted.author.getLink("i"))
-	fmt.Fprintf(&buffer, "👏 %s ❤️ %d 👁️ %s\n", details.IllustDetails.RatingCount, details.IllustDetails.BookmarkUserTotal, details.IllustDetails.RatingView)
-	buffer.WriteString(htmlPolicy.Sanitize(fixString(details.IllustDetails.CommentHTML)))
-	buffer.WriteByte('\n')
-	for i := 0; i < len(extracted.tags); i++ {
-		tag := extracted.tags[i]
-		fmt.Fprintf(&buffer, "%s ", tag.get())
-	}
-	return buffer.String()
-}
-
-func getPhoto(extracted extractedInfo, details *pixiv.DetailsApi) (*tb.Photo, error) {
-	file, err := imagedownloader.FetchImage(details.IllustDetails)
+func parseUserSet(input string) (map[int]bool, error) {
+	ids, err := parseIDList(input)
 	if err != nil {
 		return nil, err
 	}
-	return &tb.Photo{File: file, Caption: getCaption(extracted, details)}, nil
-}
-
-func getAlbum(id int, extracted extractedInfo, details *pixiv.DetailsApi) (album tb.Album, err error) {
-	pages := details.IllustDetails.MangaA
-	count := len(pages)
-	if count > 10 {
-		count = 10
-	}
-	album = make(tb.Album, count)
-	caption := getCaption(extracted, details)
-	for i, page := range pages[:count] {
-		file, err := imagedownloader.FetchImage(page)
-		if err != nil {
-			return nil, err
-		}
-		album[i] = &tb.Photo{File: file}
+	result := map[int]bool{}
+	for _, id := range ids {
+		result[int(id)] = true
 	}
-	album[0].(*tb.Photo).Caption = caption
-	return
+	return result, nil
 }
 
-func getPhotoResult(extracted extractedInfo, details *pixiv.DetailsApi) (result tb.Result, err error) {
-	ourl, err := altimagedownloader.GetImageUrl(details.IllustDetails)
+func parseChatSet(input string) (map[int64]bool, error) {
+	ids, err := parseIDList(input)
 	if err != nil {
-		return
+		return nil, err
 	}
-	result = &tb.PhotoResult{
-		URL:         ourl,
-		ParseMode:   tb.ModeHTML,
-		ThumbURL:    ourl,
-		Description: extracted.author.title,
-		Title:       extracted.artwork.title,
-		Caption:     getCaption(extracted, details),
+	result := map[int64]bool{}
+	for _, id := range ids {
+		result[id] = true
 	}
-	result.SetResultID(details.IllustDetails.ID)
-	return
+	return result, nil
 }
 
-func parseIllustUrl(input string) (result int, err error) {
-	u, err := url.Parse(input)
-	if err != nil {
+func parseLimits(userLimit, chatLimit, allowUsers, denyUsers, allowChats, denyChats string) (limits bot.Limits, err error) {
+	if limits.User, err = bot.ParseRate(userLimit); err != nil {
 		return
 	}
-	if u.Scheme != "https" || (u.Host != "www.pixiv.net" && u.Host != "pixiv.net") {
-		return 0, fmt.Errorf("not a pixiv link")
+	if limits.Chat, err = bot.ParseRate(chatLimit); err != nil {
+		return
 	}
-	_, err = fmt.Sscanf(u.Path, "/artworks/%d", &result)
-	if err == nil {
+	if limits.AllowUsers, err = parseUserSet(allowUsers); err != nil {
 		return
 	}
-	if u.Path == "/member_illust.php" {
-		return strconv.Atoi(u.Query().Get("illust_id"))
+	if limits.DenyUsers, err = parseUserSet(denyUsers); err != nil {
+		return
 	}
-	err = fmt.Errorf("not a illust link")
-	return
-}
-
-func parseIllustId(input string) (result int, err error) {
-	result, err = strconv.Atoi(input)
-	if err == nil {
+	if limits.AllowChats, err = parseChatSet(allowChats); err != nil {
 		return
 	}
-	result, err = parseIllustUrl(input)
+	limits.DenyChats, err = parseChatSet(denyChats)
 	return
 }
 
-func makePixiv(bot *tb.Bot, chat *tb.Chat, id int, reply *tb.Message) (err error) {
-	bot.Notify(chat, tb.UploadingPhoto)
-	details, err := pixiv.GetDetils(id)
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	var token string
+	var proxied string
+	var localapi string
+	var proxyListen string
+	var proxyKey string
+	var proxyCache string
+	var proxyCacheSize int64
+	var settingsPath string
+	var databasePath string
+	var tagsPath string
+	var admins string
+	var cacheTTL time.Duration
+	var logFormat string
+	var logLevel string
+	var metricsListen string
+	var adminListen string
+	var adminToken string
+	var userLimit string
+	var chatLimit string
+	var maxDownloads int
+	var zipWorks int
+	var allowUsers string
+	var denyUsers string
+	var allowChats string
+	var denyChats string
+	var refreshInterval time.Duration
+	var refreshAge time.Duration
+	var archiveDir string
+	var sauceKey string
+	var sauceURL string
+	var pixivSession string
+	flag.StringVar(&token, "t", "", "Telegram token")
+	flag.StringVar(&proxied, "p", "", "i.pximg.net proxy for bypass restrict")
+	flag.StringVar(&localapi, "l", "", "Local telegram api server address")
+	flag.StringVar(&proxyListen, "proxy-listen", "", "Listen address of the built-in i.pximg.net proxy (public host is set by -p)")
+	flag.StringVar(&proxyKey, "proxy-key", "", "Secret key for signing built-in proxy urls")
+	flag.StringVar(&proxyCache, "proxy-cache", "", "Cache directory of the built-in proxy")
+	flag.Int64Var(&proxyCacheSize, "proxy-cache-size", downloader.DEFAULT_CACHE_SIZE>>20, "Most megabytes kept in the proxy cache, the oldest files are evicted first")
+	flag.StringVar(&settingsPath, "d", "", "Old json chat settings file, imported into the database")
+	flag.StringVar(&databasePath, "db", "", "Database file of settings, post history and subscriptions (defaults to the -d file with a .db extension)")
+	flag.StringVar(&tagsPath, "tags", "", "Tag dictionary file")
+	flag.StringVar(&admins, "admins", "", "Comma separated user ids of bot admins")
+	flag.DurationVar(&cacheTTL, "cache-ttl", bot.DEFAULT_CACHE_TTL, "How long chat info and admin lists are cached")
+	flag.StringVar(&logFormat, "log-format", "logfmt", "Log format (logfmt or json)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn or error)")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "Listen address of the prometheus /metrics endpoint")
+	flag.StringVar(&adminListen, "admin-listen", "", "Listen address of the health checks and admin api")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token of the admin api, the api is disabled if empty")
+	flag.StringVar(&userLimit, "user-limit", "", "Requests allowed per user, as count/duration, e.g. 10/1m (empty is unlimited)")
+	flag.StringVar(&chatLimit, "chat-limit", "", "Requests allowed per group or channel, as count/duration, e.g. 30/1m (empty is unlimited)")
+	flag.IntVar(&maxDownloads, "max-downloads", 0, "Maximum concurrent image downloads, 4 is a good start (0 is unlimited)")
+	flag.IntVar(&zipWorks, "zip-works", bot.ZIP_WORKS, "Maximum works of an artist packed by /zip")
+	flag.StringVar(&allowUsers, "allow-users", "", "Comma separated user ids allowed to use the bot, everyone if both allow lists are empty")
+	flag.StringVar(&denyUsers, "deny-users", "", "Comma separated user ids ignored by the bot")
+	flag.StringVar(&allowChats, "allow-chats", "", "Comma separated chat ids allowed to use the bot, everyone if both allow lists are empty")
+	flag.StringVar(&denyChats, "deny-chats", "", "Comma separated chat ids ignored by the bot")
+	flag.DurationVar(&refreshInterval, "refresh-interval", 0, "How often the captions of channel posts are refreshed (0 disables)")
+	flag.DurationVar(&refreshAge, "refresh-age", 72*time.Hour, "Only channel posts younger than this are refreshed")
+	flag.StringVar(&sauceKey, "saucenao-key", "", "SauceNAO api key, enables the reverse image search")
+	flag.StringVar(&sauceURL, "saucenao-url", source.DEFAULT_SAUCENAO_URL, "Base url of the SauceNAO compatible api")
+	flag.StringVar(&pixivSession, "pixiv-session", "", "PHPSESSID cookie of the pixiv account bookmarked by the bot admins (disabled if empty)")
+	flag.StringVar(&archiveDir, "archive", "", "Directory where the works posted to channels are archived (disabled if empty)")
+	flag.Parse()
+	format, err := logging.ParseFormat(logFormat)
 	if err != nil {
+		log.Fatal(err)
 		return
 	}
-	extracted := extractPixiv(details)
-	photo, err := getPhoto(extracted, details)
+	level, err := logging.ParseLevel(logLevel)
 	if err != nil {
+		log.Fatal(err)
 		return
 	}
-	channel := getLinkedChat(bot, chat)
-	if chat.Type == tb.ChatChannel || chat.Type == tb.ChatChannelPrivate {
-		_, err = bot.Send(chat, photo, &tb.SendOptions{
-			DisableWebPagePreview: true,
-			ParseMode:             "html",
-			ReplyTo:               reply,
-		})
-		return
+	logging.Default = logging.New(os.Stderr, format, level)
+	options := bot.Options{CacheTTL: cacheTTL}
+	if databasePath == "" && settingsPath != "" {
+		databasePath = strings.TrimSuffix(settingsPath, filepath.Ext(settingsPath)) + ".db"
 	}
-	menu := &tb.ReplyMarkup{}
-	btnArtwork := menu.URL("作品："+extracted.artwork.title, extracted.artwork.url)
-	btnAuthor := menu.URL("作者："+extracted.author.title, extracted.author.url)
-	btnDownload := menu.URL("下载原图", details.IllustDetails.URLOriginal)
-	if channel != nil {
-		btnPost := menu.Data(POST_TO_CHANNEL, "post", details.IllustDetails.ID)
-		if len(details.IllustDetails.MangaA) > 1 {
-			btnPostMulti := menu.Data(fmt.Sprintf(POST_ALBUM_TO_CHANNEL, len(details.IllustDetails.MangaA)), "post-multi", details.IllustDetails.ID)
-			menu.Inline(menu.Row(btnPost), menu.Row(btnPostMulti), menu.Row(btnArtwork), menu.Row(btnAuthor), menu.Row(btnDownload))
-		} else {
-			menu.Inline(menu.Row(btnPost), menu.Row(btnArtwork), menu.Row(btnAuthor), menu.Row(btnDownload))
+	if databasePath != "" {
+		db, err := openDatabase(databasePath, settingsPath)
+		if err != nil {
+			log.Fatal(err)
+			return
 		}
-	} else {
-		menu.Inline(menu.Row(btnArtwork), menu.Row(btnAuthor), menu.Row(btnDownload))
+		defer db.Close()
+		options.Store = db
 	}
-	_, err = bot.Send(chat, photo, &tb.SendOptions{
-		DisableWebPagePreview: true,
-		ParseMode:             "html",
-		ReplyTo:               reply,
-	}, menu)
-	return
-}
-
-func makeAlbum(bot *tb.Bot, chat *tb.Chat, id int) (err error) {
-	bot.Notify(chat, tb.UploadingPhoto)
-	details, err := pixiv.GetDetils(id)
+	if tagsPath != "" {
+		options.Tags, err = bot.LoadTagDictionary(tagsPath)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+	}
+	options.Admins, err = parseUserSet(admins)
 	if err != nil {
+		log.Fatal(err)
 		return
 	}
-	extracted := extractPixiv(details)
-	album, err := getAlbum(id, extracted, details)
+	options.Limits, err = parseLimits(userLimit, chatLimit, allowUsers, denyUsers, allowChats, denyChats)
 	if err != nil {
+		log.Fatal(err)
 		return
 	}
-	_, err = bot.SendAlbum(chat, album, &tb.SendOptions{
-		DisableWebPagePreview: true,
-		ParseMode:             "html",
-	})
-	return
-}
-
-func precheckInlineButton(bot *tb.Bot, c *tb.Callback) (*tb.Chat, error) {
-	ochat := c.Message.OriginalChat
-	if ochat == nil {
-		ochat = c.Message.Chat
+	options.Limits.Downloads = maxDownloads
+	options.Limits.ZipWorks = zipWorks
+	var archiver *archive.Archive
+	if archiveDir != "" {
+		archiver = archive.New(archiveDir)
+		options.Archive = archiver
 	}
-	bot.Notify(ochat, tb.Typing)
-	linked := getLinkedChat(bot, ochat)
-	if linked == nil {
-		return nil, fmt.Errorf(NO_LINK)
+	if sauceKey != "" {
+		options.Sources = source.NewSauceNAO(sauceURL, sauceKey)
 	}
-	members, err := bot.AdminsOf(linked)
-	if err != nil {
-		return nil, fmt.Errorf(NO_ADMIN, err)
+	if pixivSession != "" {
+		session, err := pixiv.NewSession(pixivSession)
+		if err != nil {
+			log.Fatal(err)
+		}
+		options.Bookmarks = session
 	}
-	for _, member := range members {
-		if member.User.ID == c.Sender.ID {
-			return linked, nil
+	var signKey []byte
+	if proxyListen != "" {
+		if proxied == "" || proxyKey == "" {
+			log.Fatal("built-in proxy requires both -p and -proxy-key")
+			return
 		}
+		signKey = []byte(proxyKey)
+		go func() {
+			log.Fatal(http.ListenAndServe(proxyListen, &downloader.ProxyServer{
+				Key:       signKey,
+				CacheDir:  proxyCache,
+				CacheSize: proxyCacheSize << 20,
+			}))
+		}()
 	}
-	return nil, fmt.Errorf(NO_PERMISSION)
-}
-
-//go:embed help.txt
-var helpMessage string
-
-func main() {
-	var token string
-	var proxied string
-	var localapi string
-	flag.StringVar(&token, "t", "", "Telegram token")
-	flag.StringVar(&proxied, "p", "", "i.pximg.net proxy for bypass restrict")
-	flag.StringVar(&localapi, "l", "", "Local telegram api server address")
-	flag.Parse()
+	// the poller only runs and the images are only downloaded after Start,
+	// when app is set
+	var app *bot.Bot
 	if localapi != "" {
-		imagedownloader = downloader.ImageFetcher{
-			UploadMethod: downloader.Download{},
-			Original:     true,
+		options.Images = downloader.ImageFetcher{
+			UploadMethod: downloader.Download{
+				OnHash: func(ctx context.Context, source string, hash downloader.ImageHash) {
+					app.RecordHash(ctx, source, hash)
+				},
+			},
+			Original: true,
 		}
 	} else if proxied != "" {
-		imagedownloader = downloader.ImageFetcher{
-			UploadMethod: downloader.ProxiedURL{ProxyHost: proxied},
+		options.Images = downloader.ImageFetcher{
+			UploadMethod: downloader.ProxiedURL{ProxyHost: proxied, Key: signKey},
 			Original:     false,
 		}
 	} else {
-		imagedownloader = downloader.ImageFetcher{
+		options.Images = downloader.ImageFetcher{
 			UploadMethod: downloader.DirectURL{},
 			Original:     false,
 		}
 	}
 	if proxied != "" {
-		altimagedownloader = downloader.InlineImageFetcher{
-			InlineImageSource: downloader.ProxiedURL{ProxyHost: proxied},
+		options.Inline = downloader.InlineImageFetcher{
+			InlineImageSource: downloader.ProxiedURL{ProxyHost: proxied, Key: signKey},
 			Original:          true,
 		}
 	} else {
-		altimagedownloader = downloader.InlineImageFetcher{
+		options.Inline = downloader.InlineImageFetcher{
 			InlineImageSource: downloader.DirectURL{},
 			Original:          false,
 		}
 	}
-	bot, err := tb.NewBot(tb.Settings{
+	if metricsListen != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Default)
+			log.Fatal(http.ListenAndServe(metricsListen, mux))
+		}()
+	}
+	poller := &tb.LongPoller{
+		Timeout: 10 * time.Second,
+		// chat_member updates are only sent when asked explicitly
+		AllowedUpdates: []string{
+			"message",
+			"channel_post",
+			"inline_query",
+			"callback_query",
+			"my_chat_member",
+			"chat_member",
+		},
+	}
+	filter := func(upd *tb.Update) bool {
+		return app.Filter(upd)
+	}
+	telegram, err := tb.NewBot(tb.Settings{
 		URL:    localapi,
 		Token:  token,
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+		Poller: tb.NewMiddlewarePoller(poller, filter),
 	})
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-
-	htmlPolicy = *bluemonday.NewPolicy()
-
-	htmlPolicy.AllowStandardURLs()
-	htmlPolicy.AllowAttrs("href").OnElements("a")
-	htmlPolicy.AllowNoAttrs().OnElements(
-		"b", "i", "u", "s",
-		"strong", "em", "ins", "strike", "del",
-		"code", "pre",
-	)
-
-	bot.Handle("/help", func(m *tb.Message) {
-		bot.Send(m.Chat, helpMessage, &tb.SendOptions{
-			DisableWebPagePreview: true,
-			ParseMode:             "html",
-			ReplyTo:               m,
-		})
-	})
-	bot.Handle("/start", func(m *tb.Message) {
-		bot.Send(m.Chat, helpMessage, &tb.SendOptions{
-			DisableWebPagePreview: true,
-			ParseMode:             "html",
-			ReplyTo:               m,
-		})
-	})
-	bot.Handle("/pixiv", func(m *tb.Message) {
-		value, err := parseIllustId(m.Payload)
-		if err != nil {
-			bot.Send(m.Chat, INVALID_INPUT)
-			return
-		}
-		err = makePixiv(bot, m.Chat, value, nil)
-		if err != nil {
-			bot.Send(m.Chat, err.Error())
-			return
-		}
-		bot.Delete(m)
-	})
-	bot.Handle("/album", func(m *tb.Message) {
-		value, err := parseIllustId(m.Payload)
-		if err != nil {
-			bot.Send(m.Chat, INVALID_INPUT)
-			return
-		}
-		err = makeAlbum(bot, m.Chat, value)
-		if err != nil {
-			bot.Send(m.Chat, err.Error())
-			return
-		}
-		bot.Delete(m)
-	})
-	bot.Handle("/post", func(m *tb.Message) {
-		value, err := parseIllustId(m.Payload)
-		if err != nil {
-			bot.Send(m.Chat, INVALID_INPUT)
-			return
-		}
-		channel := getLinkedChat(bot, m.Chat)
-		if channel == nil {
-			bot.Send(m.Chat, NO_LINK)
-			return
-		}
-		err = makePixiv(bot, channel, value, nil)
-		if err != nil {
-			bot.Send(m.Chat, err.Error())
-			return
-		}
-		bot.Delete(m)
-	})
-	bot.Handle("/postalbum", func(m *tb.Message) {
-		value, err := parseIllustId(m.Payload)
-		if err != nil {
-			bot.Send(m.Chat, INVALID_INPUT)
-			return
-		}
-		linked := getLinkedChat(bot, m.Chat)
-		if linked == nil {
-			bot.Send(m.Chat, NO_LINK)
-			return
-		}
-		err = makeAlbum(bot, linked, value)
-		if err != nil {
-			bot.Send(m.Chat, err.Error())
-			return
-		}
-		bot.Delete(m)
-	})
-	bot.Handle(&tb.InlineButton{Unique: "post"}, func(c *tb.Callback) {
-		linked, err := precheckInlineButton(bot, c)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: err.Error(), ShowAlert: true})
-			return
-		}
-		value, err := parseIllustId(c.Data)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: INVALID_INPUT + ": " + err.Error(), ShowAlert: true})
-			return
-		}
-		err = makePixiv(bot, linked, value, nil)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: err.Error(), ShowAlert: true})
-			return
-		}
-		bot.Respond(c, &tb.CallbackResponse{Text: POST_SUCCESS})
-		bot.Delete(c.Message)
-	})
-	bot.Handle(&tb.InlineButton{Unique: "post-multi"}, func(c *tb.Callback) {
-		linked, err := precheckInlineButton(bot, c)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: err.Error(), ShowAlert: true})
-			return
-		}
-		value, err := parseIllustId(c.Data)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: INVALID_INPUT + ": " + err.Error(), ShowAlert: true})
-			return
-		}
-		err = makeAlbum(bot, linked, value)
-		if err != nil {
-			bot.Respond(c, &tb.CallbackResponse{Text: err.Error(), ShowAlert: true})
-			return
-		}
-		bot.Respond(c, &tb.CallbackResponse{Text: POST_SUCCESS})
-		bot.Delete(c.Message)
-	})
-	bot.Handle(tb.OnText, func(m *tb.Message) {
-		value, err := parseIllustUrl(m.Text)
-		if err != nil {
-			return
-		}
-		err = makePixiv(bot, m.Chat, value, m)
-		if err != nil {
-			bot.Send(m.Chat, err.Error())
-			return
-		}
-	})
-	bot.Handle(tb.OnQuery, func(q *tb.Query) {
-		value, err := parseIllustId(q.Text)
-		if err != nil {
-			bot.Answer(q, &tb.QueryResponse{
-				Results:      tb.Results{},
-				CacheTime:    10,
-				SwitchPMText: INVALID_INPUT,
-			})
-			return
-		}
-		details, err := pixiv.GetDetils(value)
-		if err != nil {
-			bot.Answer(q, &tb.QueryResponse{
-				Results:      tb.Results{},
-				CacheTime:    10,
-				SwitchPMText: err.Error(),
-			})
-			return
-		}
-		extracted := extractPixiv(details)
-		result, err := getPhotoResult(extracted, details)
-		if err != nil {
-			bot.Answer(q, &tb.QueryResponse{
-				Results:      tb.Results{},
-				CacheTime:    10,
-				SwitchPMText: err.Error(),
-			})
-			return
-		}
-		bot.Answer(q, &tb.QueryResponse{
-			Results:   tb.Results{result},
-			CacheTime: 10,
-		})
-	})
-	bot.Start()
+	options.Telegram = telegram
+	options.Me = telegram.Me
+	app = bot.New(options)
+	if archiver != nil {
+		// the archive downloads count against -max-downloads too
+		archiver.Open = app.Open
+	}
+	admin := &bot.AdminServer{
+		Token: adminToken,
+		Bot:   app,
+		GetMe: func() error {
+			_, err := telegram.Raw("getMe", nil)
+			return err
+		},
+		PingPixiv: pixiv.Ping,
+	}
+	if adminListen != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(adminListen, admin.Handler()))
+		}()
+	}
+	if refreshInterval > 0 {
+		go app.RefreshLoop(refreshInterval, refreshAge)
+	}
+	go app.PruneLoop(bot.PRUNE_INTERVAL)
+	app.Register(telegram)
+	admin.SetReady()
+	telegram.Start()
 }
@@ -0,0 +1,243 @@
+// Package metrics implements the few prometheus metric types the bot needs
+// and serves them in the text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []collector
+}
+
+var Default = &Registry{}
+
+func (registry *Registry) register(c collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.collectors = append(registry.collectors, c)
+}
+
+// Write writes all metrics in the prometheus text format
+func (registry *Registry) Write(w io.Writer) {
+	registry.mutex.Lock()
+	collectors := append([]collector{}, registry.collectors...)
+	registry.mutex.Unlock()
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	buffered.Flush()
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Write(w)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type vec struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	keys   []string
+	values map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels, values: map[string][]string{}}
+}
+
+// key returns the series key of the label values, must be called locked
+func (v *vec) key(values []string) (string, bool) {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d labels, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	_, exists := v.values[key]
+	if !exists {
+		v.values[key] = append([]string{}, values...)
+		v.keys = append(v.keys, key)
+		sort.Strings(v.keys)
+	}
+	return key, exists
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// Counter is a monotonically increasing value, optionally split by labels
+type Counter struct {
+	vec
+	counts map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labels), counts: map[string]float64{}}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Add(value float64, labels ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key, _ := c.key(labels)
+	c.counts[key] += value
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Get returns the current value, mostly for tests
+func (c *Counter) Get(labels ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[strings.Join(labels, "\xff")]
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.header(w)
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, c.values[key]), formatFloat(c.counts[key]))
+	}
+}
+
+// Gauge is a value that goes up and down
+type Gauge struct {
+	vec
+	current map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labels), current: map[string]float64{}}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Add(value float64, labels ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	key, _ := g.key(labels)
+	g.current[key] += value
+}
+
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	key, _ := g.key(labels)
+	g.current[key] = value
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.header(w)
+	for _, key := range g.keys {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, g.values[key]), formatFloat(g.current[key]))
+	}
+}
+
+type histogramSeries struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	vec
+	bounds []float64
+	series map[string]*histogramSeries
+}
+
+// DurationBuckets suit network requests, in seconds
+var DurationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// SizeBuckets suit image sizes, in bytes
+var SizeBuckets = []float64{64 << 10, 256 << 10, 1 << 20, 2 << 20, 5 << 20, 10 << 20, 20 << 20, 50 << 20}
+
+func NewHistogram(name, help string, bounds []float64, labels ...string) *Histogram {
+	h := &Histogram{vec: newVec(name, help, "histogram", labels), bounds: bounds, series: map[string]*histogramSeries{}}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labels ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key, exists := h.key(labels)
+	if !exists {
+		h.series[key] = &histogramSeries{buckets: make([]uint64, len(h.bounds))}
+	}
+	series := h.series[key]
+	for i, bound := range h.bounds {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Since observes the seconds elapsed since start
+func (h *Histogram) Since(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.header(w)
+	for _, key := range h.keys {
+		series := h.series[key]
+		values := h.values[key]
+		for i, bound := range h.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatFloat(bound)), series.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), series.count)
+	}
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_requests_total", "Test requests.", "code")
+	counter.Inc("200")
+	counter.Add(2, "500")
+	gauge := NewGauge("test_inflight", "Test inflight.")
+	gauge.Add(3)
+	gauge.Add(-1)
+	histogram := NewHistogram("test_duration_seconds", "Test durations.", []float64{1, 5})
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+	var buffer bytes.Buffer
+	Default.Write(&buffer)
+	output := buffer.String()
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{code="200"} 1`,
+		`test_requests_total{code="500"} 2`,
+		"test_inflight 2",
+		`test_duration_seconds_bucket{le="1"} 1`,
+		`test_duration_seconds_bucket{le="5"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 2`,
+		"test_duration_seconds_sum 3.5",
+		"test_duration_seconds_count 2",
+	} {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, output)
+		}
+	}
+	if counter.Get("500") != 2 {
+		t.Errorf("unexpected counter value: %v", counter.Get("500"))
+	}
+}
+
+func TestLabelEscape(t *testing.T) {
+	labels := formatLabels([]string{"path"}, []string{"a\"b\\c\n"})
+	if labels != `{path="a\"b\\c\n"}` {
+		t.Errorf("unexpected labels: %s", labels)
+	}
+}
@@ -0,0 +1,200 @@
+package pixiv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BOOKMARK_TAG_LIMIT is the most tags pixiv keeps on a bookmark
+const BOOKMARK_TAG_LIMIT = 10
+
+// BOOKMARKS_PAGE_LIMIT is the most works pixiv returns per bookmarks page
+const BOOKMARKS_PAGE_LIMIT = 48
+
+var ErrInvalidSession = errors.New("invalid session")
+
+// csrfToken finds the token in the pages, it is in json which may itself be
+// escaped in a string
+var csrfToken = regexp.MustCompile(`\\?"token\\?":\\?"([0-9a-f]{16,})\\?"`)
+
+// Session is a logged in pixiv account, Cookie is the value of PHPSESSID
+// which starts with the id of the user
+type Session struct {
+	Cookie string
+	User   int
+	mutex  sync.Mutex
+	// token is the csrf token needed by the post requests, it is read from
+	// the home page once and dropped when it is refused
+	token string
+}
+
+func NewSession(cookie string) (*Session, error) {
+	prefix := strings.SplitN(cookie, "_", 2)[0]
+	user, err := strconv.Atoi(prefix)
+	if err != nil || !strings.Contains(cookie, "_") {
+		return nil, fmt.Errorf("%w: PHPSESSID should look like <user id>_<secret>", ErrInvalidSession)
+	}
+	return &Session{Cookie: cookie, User: user}, nil
+}
+
+func (session *Session) newRequest(ctx context.Context, method string, url string, body []byte, lang string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("accept-language", acceptLanguage(lang))
+	req.Header.Set("cookie", "PHPSESSID="+session.Cookie)
+	req.Header.Set("referer", "https://www.pixiv.net/")
+	return req, nil
+}
+
+// getToken returns the csrf token, the home page only has it while the
+// session is logged in
+func (session *Session) getToken(ctx context.Context) (string, error) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.token != "" {
+		return session.token, nil
+	}
+	req, err := session.newRequest(ctx, "GET", BaseURL+"/", nil, "")
+	if err != nil {
+		return "", err
+	}
+	data, _, err := doRequest(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	match := csrfToken.FindSubmatch(data)
+	if match == nil {
+		return "", &Error{Kind: ErrRestricted, Err: ErrInvalidSession}
+	}
+	session.token = string(match[1])
+	return session.token, nil
+}
+
+func (session *Session) dropToken() {
+	session.mutex.Lock()
+	session.token = ""
+	session.mutex.Unlock()
+}
+
+type bookmarkAddRequest struct {
+	IllustID string   `json:"illust_id"`
+	Restrict int      `json:"restrict"`
+	Comment  string   `json:"comment"`
+	Tags     []string `json:"tags"`
+}
+
+type BookmarkAddResponse struct {
+	IsError      bool   `json:"error"`
+	ErrorMessage string `json:"message"`
+}
+
+func (res BookmarkAddResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// AddBookmark bookmarks the illust with the tags, only the first
+// BOOKMARK_TAG_LIMIT are kept. Bookmarking again updates the bookmark.
+func (session *Session) AddBookmark(ctx context.Context, illust int, private bool, tags []string) error {
+	token, err := session.getToken(ctx)
+	if err != nil {
+		return err
+	}
+	if len(tags) > BOOKMARK_TAG_LIMIT {
+		tags = tags[:BOOKMARK_TAG_LIMIT]
+	}
+	body := bookmarkAddRequest{IllustID: strconv.Itoa(illust), Tags: tags}
+	if body.Tags == nil {
+		body.Tags = []string{}
+	}
+	if private {
+		body.Restrict = 1
+	}
+	data, _ := json.Marshal(body)
+	req, err := session.newRequest(ctx, "POST", BaseURL+"/ajax/illusts/bookmarks/add", data, "")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json; charset=utf-8")
+	req.Header.Set("x-csrf-token", token)
+	data, status, err := doRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	var result BookmarkAddResponse
+	err = decodeResponse(ctx, &result, status, data)
+	if errors.Is(err, ErrRestricted) || status == http.StatusBadRequest {
+		// the token expires with the session, it is read again next time
+		session.dropToken()
+	}
+	return err
+}
+
+// BookmarkedWork is a work in the bookmarks, works deleted or hidden since
+// they were bookmarked are masked and their id is a number
+type BookmarkedWork struct {
+	ID        json.Number `json:"id"`
+	Title     string      `json:"title"`
+	UserID    json.Number `json:"userId"`
+	UserName  string      `json:"userName"`
+	PageCount int         `json:"pageCount"`
+	Tags      []string    `json:"tags"`
+	IsMasked  bool        `json:"isMasked"`
+}
+
+type BookmarksApi struct {
+	Works []BookmarkedWork `json:"works"`
+	Total int              `json:"total"`
+}
+
+type BookmarksResponse struct {
+	IsError      bool          `json:"error"`
+	ErrorMessage string        `json:"message"`
+	Body         *BookmarksApi `json:"body"`
+}
+
+func (res BookmarksResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// GetBookmarks fetches a page of the bookmarks of the account, newest first,
+// private ones are only visible to the account itself
+func (session *Session) GetBookmarks(ctx context.Context, offset int, limit int, private bool, lang string) (*BookmarksApi, error) {
+	rest := "show"
+	if private {
+		rest = "hide"
+	}
+	url := fmt.Sprintf("%s/ajax/user/%d/illusts/bookmarks?tag=&offset=%d&limit=%d&rest=%s", BaseURL, session.User, offset, limit, rest)
+	req, err := session.newRequest(ctx, "GET", url, nil, lang)
+	if err != nil {
+		return nil, err
+	}
+	data, status, err := doRequest(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var bookmarks BookmarksResponse
+	err = decodeResponse(ctx, &bookmarks, status, data)
+	if err != nil {
+		return nil, err
+	}
+	if bookmarks.Body == nil {
+		return &BookmarksApi{}, nil
+	}
+	return bookmarks.Body, nil
+}
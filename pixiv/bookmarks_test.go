@@ -0,0 +1,85 @@
+package pixiv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBookmarks(t *testing.T) {
+	var added []bookmarkAddRequest
+	homes := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("cookie") != "PHPSESSID=123_secret" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			homes++
+			w.Write([]byte(`<meta name="global-data" content='{"token":"0123456789abcdef0123"}'>`))
+		case "/ajax/illusts/bookmarks/add":
+			if r.Header.Get("x-csrf-token") != "0123456789abcdef0123" {
+				http.Error(w, `{"error":true,"message":"invalid token"}`, http.StatusBadRequest)
+				return
+			}
+			var body bookmarkAddRequest
+			json.NewDecoder(r.Body).Decode(&body)
+			added = append(added, body)
+			w.Write([]byte(`{"error":false,"message":"","body":{"last_bookmark_id":"1"}}`))
+		case "/ajax/user/123/illusts/bookmarks":
+			if r.URL.Query().Get("rest") != "hide" || r.URL.Query().Get("offset") != "48" {
+				t.Errorf("unexpected query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"error":false,"body":{"works":[{"id":"1001","title":"夏の空","userId":"11","pageCount":1},{"id":1005,"title":"-----","isMasked":true}],"total":50}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	oldBaseURL := BaseURL
+	defer func() { BaseURL = oldBaseURL }()
+	BaseURL = server.URL
+
+	if _, err := NewSession("secret"); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("expected invalid session, got %v", err)
+	}
+	session, err := NewSession("123_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	tags := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}
+	if err := session.AddBookmark(ctx, 1001, true, tags); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.AddBookmark(ctx, 1002, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 2 || homes != 1 {
+		t.Fatalf("expected 2 bookmarks with one token, got %d and %d", len(added), homes)
+	}
+	if added[0].IllustID != "1001" || added[0].Restrict != 1 || len(added[0].Tags) != BOOKMARK_TAG_LIMIT {
+		t.Errorf("unexpected bookmark %+v", added[0])
+	}
+	if added[1].Restrict != 0 || added[1].Tags == nil {
+		t.Errorf("unexpected bookmark %+v", added[1])
+	}
+
+	bookmarks, err := session.GetBookmarks(ctx, 48, BOOKMARKS_PAGE_LIMIT, true, "ja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bookmarks.Total != 50 || len(bookmarks.Works) != 2 || bookmarks.Works[0].ID != "1001" || !bookmarks.Works[1].IsMasked {
+		t.Errorf("unexpected bookmarks %+v", bookmarks)
+	}
+
+	session.Cookie = "123_expired"
+	session.dropToken()
+	if err := session.AddBookmark(ctx, 1001, false, nil); !errors.Is(err, ErrRestricted) {
+		t.Errorf("expected login required, got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package pixiv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Comment is a comment on a work, stamps have an empty Comment and a StampID
+type Comment struct {
+	ID            string `json:"id"`
+	UserID        string `json:"userId"`
+	UserName      string `json:"userName"`
+	IsDeletedUser bool   `json:"isDeletedUser"`
+	Comment       string `json:"comment"`
+	StampID       string `json:"stampId"`
+	CommentDate   string `json:"commentDate"`
+	// ParentID is empty for root comments
+	ParentID   string `json:"commentParentId"`
+	HasReplies bool   `json:"hasReplies"`
+}
+
+type CommentsApi struct {
+	Comments []Comment `json:"comments"`
+	HasNext  bool      `json:"hasNext"`
+}
+
+type CommentsResponse struct {
+	IsError      bool         `json:"error"`
+	ErrorMessage string       `json:"message"`
+	Body         *CommentsApi `json:"body"`
+}
+
+func (res CommentsResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+func getComments(ctx context.Context, url string, lang string) (*CommentsApi, error) {
+	data, status, err := buildRequest(ctx, url, lang)
+	if err != nil {
+		return nil, err
+	}
+	var comments CommentsResponse
+	err = decodeResponse(ctx, &comments, status, data)
+	if err == nil && comments.Body == nil {
+		comments.Body = &CommentsApi{}
+	}
+	return comments.Body, err
+}
+
+// GetComments fetches the root comments of the illust, newest first
+func GetComments(ctx context.Context, id int, offset int, limit int, lang string) (*CommentsApi, error) {
+	return getComments(ctx, fmt.Sprintf("%s/ajax/illusts/comments/roots?illust_id=%d&offset=%d&limit=%d", BaseURL, id, offset, limit), lang)
+}
+
+// GetReplies fetches a page of the replies to the comment, pages start from 1
+func GetReplies(ctx context.Context, comment string, page int, lang string) (*CommentsApi, error) {
+	return getComments(ctx, fmt.Sprintf("%s/ajax/illusts/comments/replies?comment_id=%s&page=%d", BaseURL, url.QueryEscape(comment), page), lang)
+}
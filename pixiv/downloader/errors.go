@@ -0,0 +1,49 @@
+package downloader
+
+import (
+	"errors"
+	"net/http"
+)
+
+// The kinds of Error, match them with errors.Is
+var (
+	ErrNotFound     = errors.New("image not found")
+	ErrNetwork      = errors.New("network error")
+	ErrTooLarge     = errors.New("image too large")
+	ErrDecodeFailed = errors.New("failed to decode image")
+)
+
+// Error is returned when downloading or processing an image fails, Kind is
+// one of the Err* values and Err is the underlying cause
+type Error struct {
+	Kind error
+	URL  string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	text := e.Kind.Error()
+	if e.URL != "" {
+		text += " (" + e.URL + ")"
+	}
+	if e.Err != nil {
+		text += ": " + e.Err.Error()
+	}
+	return text
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func statusError(source string, status int) error {
+	kind := ErrNetwork
+	if status == http.StatusNotFound || status == http.StatusGone {
+		kind = ErrNotFound
+	}
+	return &Error{Kind: kind, URL: source, Err: upstreamError(status)}
+}
@@ -0,0 +1,107 @@
+package downloader
+
+import (
+	"image"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// ImageHash has the perceptual hashes of an image, PHash from the low
+// frequencies and DHash from the gradients. Both survive resizing and
+// recompression, so copies of an image have close hashes.
+type ImageHash struct {
+	PHash uint64
+	DHash uint64
+}
+
+// SIMILAR_DISTANCE is the largest Distance between copies of an image,
+// recompressed or resized
+const SIMILAR_DISTANCE = 10
+
+// Distance is the larger hamming distance of the two hashes, 0 for the same
+// image and up to 64
+func (hash ImageHash) Distance(other ImageHash) int {
+	p := bits.OnesCount64(hash.PHash ^ other.PHash)
+	d := bits.OnesCount64(hash.DHash ^ other.DHash)
+	if p > d {
+		return p
+	}
+	return d
+}
+
+// luminance resizes the image and returns its gray levels by row
+func luminance(img image.Image, width int, height int) []float64 {
+	resized := imaging.Resize(img, width, height, imaging.Lanczos)
+	result := make([]float64, width*height)
+	for i := range result {
+		pixel := resized.Pix[i*4 : i*4+3]
+		result[i] = 0.299*float64(pixel[0]) + 0.587*float64(pixel[1]) + 0.114*float64(pixel[2])
+	}
+	return result
+}
+
+func dHash(img image.Image) (hash uint64) {
+	gray := luminance(img, 9, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y*9+x] < gray[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return
+}
+
+const PHASH_SIZE = 32
+
+func pHash(img image.Image) (hash uint64) {
+	gray := luminance(img, PHASH_SIZE, PHASH_SIZE)
+	var cosines [8][PHASH_SIZE]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < PHASH_SIZE; x++ {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * PHASH_SIZE))
+		}
+	}
+	// only the 8x8 lowest frequencies of the dct are needed
+	coefficients := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < PHASH_SIZE; y++ {
+				for x := 0; x < PHASH_SIZE; x++ {
+					sum += gray[y*PHASH_SIZE+x] * cosines[u][x] * cosines[v][y]
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+	// the dc term is the average brightness, it is left out of the median
+	sorted := append([]float64(nil), coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	for _, coefficient := range coefficients {
+		hash <<= 1
+		if coefficient > median {
+			hash |= 1
+		}
+	}
+	return
+}
+
+func HashImage(img image.Image) ImageHash {
+	return ImageHash{PHash: pHash(img), DHash: dHash(img)}
+}
+
+// HashReader decodes the image and hashes it
+func HashReader(r io.Reader) (ImageHash, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return ImageHash{}, &Error{Kind: ErrDecodeFailed, Err: err}
+	}
+	return HashImage(img), nil
+}
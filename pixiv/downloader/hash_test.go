@@ -0,0 +1,43 @@
+package downloader
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+// blocks draws a 6x4 grid of random gray levels
+func blocks(seed int64) image.Image {
+	random := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, 300, 200))
+	for bx := 0; bx < 6; bx++ {
+		for by := 0; by < 4; by++ {
+			level := color.Gray{Y: uint8(random.Intn(256))}
+			draw.Draw(img, image.Rect(bx*50, by*50, bx*50+50, by*50+50), image.NewUniform(level), image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+func TestHashImage(t *testing.T) {
+	original := blocks(1)
+	var compressed bytes.Buffer
+	jpeg.Encode(&compressed, imaging.Resize(original, 150, 100, imaging.Lanczos), &jpeg.Options{Quality: 40})
+	copied, err := HashReader(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := HashImage(original)
+	if distance := hash.Distance(copied); distance > SIMILAR_DISTANCE {
+		t.Errorf("expected the copy to be close, got distance %d", distance)
+	}
+	if distance := hash.Distance(HashImage(blocks(2))); distance <= 2*SIMILAR_DISTANCE {
+		t.Errorf("expected a different image to be far, got distance %d", distance)
+	}
+}
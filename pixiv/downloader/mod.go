@@ -2,18 +2,31 @@ package downloader
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"image"
 	"image/jpeg"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
 	"github.com/disintegration/imaging"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 const MAX_IMG_SIZE = 10 * 1048576
 
+var (
+	downloadBytes     = metrics.NewHistogram("pixivbot_image_download_bytes", "Size of downloaded images.", metrics.SizeBuckets)
+	downloadDuration  = metrics.NewHistogram("pixivbot_image_download_duration_seconds", "Time spent downloading and compressing images.", metrics.DurationBuckets)
+	downloadErrors    = metrics.NewCounter("pixivbot_image_download_errors_total", "Failed image downloads.")
+	inflightDownloads = metrics.NewGauge("pixivbot_image_downloads_inflight", "Image downloads in progress.")
+	encodePasses      = metrics.NewHistogram("pixivbot_jpeg_encode_passes", "Quality steps needed by encodeJpeg to fit the size limit.", []float64{1, 2, 3, 4, 5, 6, 8, 10})
+)
+
 type ImageSource interface {
 	GetSmallImage() string
 	GetOriginalImage() string
@@ -34,17 +47,17 @@ type InlineImageSource interface {
 }
 
 type UploadMethod interface {
-	FromURL(source string) (tb.File, error)
+	FromURL(ctx context.Context, source string) (tb.File, error)
 }
 
-func (fetcher ImageFetcher) FetchImage(source ImageSource) (tb.File, error) {
+func (fetcher ImageFetcher) FetchImage(ctx context.Context, source ImageSource) (tb.File, error) {
 	var base string
 	if fetcher.Original {
 		base = source.GetOriginalImage()
 	} else {
 		base = source.GetSmallImage()
 	}
-	return fetcher.FromURL(base)
+	return fetcher.FromURL(ctx, base)
 }
 
 func (fetcher InlineImageFetcher) GetImageUrl(source ImageSource) (string, error) {
@@ -60,14 +73,21 @@ func (fetcher InlineImageFetcher) GetImageUrl(source ImageSource) (string, error
 type DirectURL struct{}
 type ProxiedURL struct {
 	ProxyHost string
+	// Key signs the generated urls for the built-in ProxyServer
+	Key []byte
+}
+
+// Download uploads the images itself, OnHash is called with the hash of
+// every image it decodes
+type Download struct {
+	OnHash func(ctx context.Context, source string, hash ImageHash)
 }
-type Download struct{}
 
 func (method DirectURL) TransformURL(source string) (string, error) {
 	return source, nil
 }
 
-func (method DirectURL) FromURL(source string) (tb.File, error) {
+func (method DirectURL) FromURL(ctx context.Context, source string) (tb.File, error) {
 	return tb.FromURL(source), nil
 }
 
@@ -77,10 +97,13 @@ func (method ProxiedURL) TransformURL(source string) (string, error) {
 		return "", err
 	}
 	ourl.Host = method.ProxyHost
+	if method.Key != nil {
+		ourl.RawQuery = url.Values{"s": {SignPath(method.Key, ourl.Path)}}.Encode()
+	}
 	return ourl.String(), nil
 }
 
-func (method ProxiedURL) FromURL(source string) (tb.File, error) {
+func (method ProxiedURL) FromURL(ctx context.Context, source string) (tb.File, error) {
 	base, err := method.TransformURL(source)
 	if err != nil {
 		return tb.File{}, err
@@ -110,49 +133,98 @@ func resizeImage(img image.Image) (image.Image, bool) {
 func encodeJpeg(img image.Image) ([]byte, error) {
 	var quality int = 100
 	buffer := makeFixedBuffer(MAX_IMG_SIZE)
-	for {
+	for passes := 1; ; passes++ {
 		data, err := tryEncodeJpeg(&buffer, img, quality)
 		if err != nil {
-			if _, ok := err.(tooBigError); ok {
+			if _, ok := err.(tooBigError); ok && quality > 10 {
 				quality -= 10
 				continue
+			} else if ok {
+				return nil, &Error{Kind: ErrTooLarge, Err: err}
 			}
 			return nil, err
 		}
+		encodePasses.Observe(float64(passes))
 		return data, nil
 	}
 }
 
-func compressImage(r io.Reader) ([]byte, error) {
+// compressImage returns the image to upload and the decoded image
+func compressImage(r io.Reader) ([]byte, image.Image, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return nil, nil, &Error{Kind: ErrNetwork, Err: err}
 	}
 	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return nil, err
+		return nil, nil, &Error{Kind: ErrDecodeFailed, Err: err}
 	}
 	newimg, resized := resizeImage(img)
 	if !resized && len(data) < MAX_IMG_SIZE {
-		return data, nil
+		return data, img, nil
 	}
-	return encodeJpeg(newimg)
+	data, err = encodeJpeg(newimg)
+	return data, img, err
 }
 
-func (method Download) FromURL(source string) (tb.File, error) {
-	request, err := http.NewRequest("GET", source, nil)
+type countingReader struct {
+	io.Reader
+	count int
+}
+
+func (reader *countingReader) Read(p []byte) (n int, err error) {
+	n, err = reader.Reader.Read(p)
+	reader.count += n
+	return
+}
+
+// Open requests the file from i.pximg.net with the referer it requires, the
+// caller closes the body
+func Open(ctx context.Context, source string) (io.ReadCloser, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", source, nil)
 	if err != nil {
-		return tb.File{}, err
+		return nil, err
 	}
 	request.Header.Add("Referer", "https://www.pixiv.net/")
 	response, err := http.DefaultClient.Do(request)
 	if err != nil {
+		return nil, &Error{Kind: ErrNetwork, URL: source, Err: err}
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, statusError(source, response.StatusCode)
+	}
+	return response.Body, nil
+}
+
+func (method Download) FromURL(ctx context.Context, source string) (tb.File, error) {
+	log := logging.FromContext(ctx).With("url", source)
+	start := time.Now()
+	inflightDownloads.Add(1)
+	defer inflightDownloads.Add(-1)
+	reader, err := Open(ctx, source)
+	if err != nil {
+		downloadErrors.Inc()
+		log.Warn("image download failed", "duration", time.Since(start), "error", err)
 		return tb.File{}, err
 	}
-	defer response.Body.Close()
-	data, err := compressImage(response.Body)
+	defer reader.Close()
+	body := &countingReader{Reader: reader}
+	data, img, err := compressImage(body)
 	if err != nil {
+		downloadErrors.Inc()
+		log.Warn("image processing failed", "duration", time.Since(start), "error", err)
+		var downloadError *Error
+		if errors.As(err, &downloadError) {
+			downloadError.URL = source
+		}
 		return tb.File{}, err
 	}
+	if method.OnHash != nil {
+		method.OnHash(ctx, source, HashImage(img))
+	}
+	downloadBytes.Observe(float64(body.count))
+	downloadDuration.Since(start)
+	log.Debug("image downloaded", "bytes", len(data), "duration", time.Since(start))
 	return tb.FromReader(bytes.NewReader(data)), nil
 }
@@ -0,0 +1,272 @@
+package downloader
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+)
+
+const DEFAULT_UPSTREAM = "https://i.pximg.net"
+
+// SignPath computes the signature for the given proxy path, it is appended to
+// the proxied url as the `s` query parameter.
+func SignPath(key []byte, p string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(p))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+}
+
+func verifyPath(key []byte, p string, signature string) bool {
+	return hmac.Equal([]byte(SignPath(key, p)), []byte(signature))
+}
+
+// DEFAULT_CACHE_SIZE bounds the cache directory when CacheSize is not set
+const DEFAULT_CACHE_SIZE = 1 << 30
+
+// ProxyServer is a reverse proxy of i.pximg.net, only signed paths are served
+// so it cannot be used as an open proxy.
+type ProxyServer struct {
+	Key      []byte
+	Upstream string
+	CacheDir string
+	// CacheSize is the most bytes kept in CacheDir, the oldest files are
+	// evicted first
+	CacheSize int64
+	Client    *http.Client
+	mutex     sync.Mutex
+	// fills are the downloads in progress by path, concurrent requests for
+	// the same path wait for the same download
+	fills map[string]*cacheFill
+	// cached is the size of CacheDir, it is read on the first fill
+	cached int64
+	sized  bool
+}
+
+type cacheFill struct {
+	done chan struct{}
+	err  error
+}
+
+var passHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Accept-Ranges",
+	"Last-Modified",
+	"ETag",
+}
+
+func (server *ProxyServer) upstream() string {
+	if server.Upstream != "" {
+		return server.Upstream
+	}
+	return DEFAULT_UPSTREAM
+}
+
+func (server *ProxyServer) client() *http.Client {
+	if server.Client != nil {
+		return server.Client
+	}
+	return http.DefaultClient
+}
+
+func (server *ProxyServer) fetch(p string, rng string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", server.upstream()+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Add("Referer", "https://www.pixiv.net/")
+	if rng != "" {
+		request.Header.Add("Range", rng)
+	}
+	return server.client().Do(request)
+}
+
+func (server *ProxyServer) cachePath(p string) string {
+	return filepath.Join(server.CacheDir, filepath.FromSlash(p))
+}
+
+// fillCache downloads the path into the cache unless it is cached already,
+// one download runs per path
+func (server *ProxyServer) fillCache(p string) (string, error) {
+	target := server.cachePath(p)
+	if _, err := os.Stat(target); err == nil {
+		return target, nil
+	}
+	server.mutex.Lock()
+	if fill, ok := server.fills[p]; ok {
+		server.mutex.Unlock()
+		<-fill.done
+		return target, fill.err
+	}
+	if server.fills == nil {
+		server.fills = map[string]*cacheFill{}
+	}
+	fill := &cacheFill{done: make(chan struct{})}
+	server.fills[p] = fill
+	server.mutex.Unlock()
+
+	size, err := server.download(p, target)
+	fill.err = err
+	server.mutex.Lock()
+	delete(server.fills, p)
+	if err == nil {
+		server.evictLocked(size)
+	}
+	server.mutex.Unlock()
+	close(fill.done)
+	return target, err
+}
+
+func (server *ProxyServer) download(p string, target string) (int64, error) {
+	response, err := server.fetch(p, "")
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, upstreamError(response.StatusCode)
+	}
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), TEMP_PREFIX+"*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, response.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp.Name(), target)
+}
+
+// TEMP_PREFIX names the partial downloads in the cache directory
+const TEMP_PREFIX = ".proxy-"
+
+type cachedFile struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+func (server *ProxyServer) cachedFiles() (files []cachedFile, total int64) {
+	filepath.Walk(server.CacheDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), TEMP_PREFIX) {
+			return nil
+		}
+		files = append(files, cachedFile{path: name, size: info.Size(), modified: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+	return
+}
+
+// evictLocked accounts the added file and removes the oldest files while the
+// cache is over its size
+func (server *ProxyServer) evictLocked(added int64) {
+	limit := server.CacheSize
+	if limit <= 0 {
+		limit = DEFAULT_CACHE_SIZE
+	}
+	if server.sized {
+		server.cached += added
+	}
+	if server.sized && server.cached <= limit {
+		return
+	}
+	files, total := server.cachedFiles()
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+	for _, file := range files {
+		if total <= limit {
+			break
+		}
+		if os.Remove(file.path) == nil {
+			total -= file.size
+		}
+	}
+	server.cached, server.sized = total, true
+}
+
+type upstreamError int
+
+func (code upstreamError) Error() string {
+	return "upstream returned " + http.StatusText(int(code))
+}
+
+func (server *ProxyServer) serveCached(w http.ResponseWriter, r *http.Request, p string) {
+	target, err := server.fillCache(p)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("proxy fetch failed", "path", p, "error", err)
+		if code, ok := err.(upstreamError); ok {
+			http.Error(w, err.Error(), int(code))
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, path.Base(p), stat.ModTime(), file)
+}
+
+func (server *ProxyServer) servePassthrough(w http.ResponseWriter, r *http.Request, p string) {
+	response, err := server.fetch(p, r.Header.Get("Range"))
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("proxy fetch failed", "path", p, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	for _, name := range passHeaders {
+		if value := response.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	if r.Method != "HEAD" {
+		io.Copy(w, response.Body)
+	}
+}
+
+func (server *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := path.Clean(r.URL.Path)
+	if !strings.HasPrefix(p, "/") || !verifyPath(server.Key, p, r.URL.Query().Get("s")) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if server.CacheDir != "" {
+		server.serveCached(w, r, p)
+	} else {
+		server.servePassthrough(w, r, p)
+	}
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var startTime = time.Date(2021, 8, 23, 0, 0, 0, 0, time.UTC)
+
+const testImagePath = "/img-original/img/2021/08/23/00/00/00/92065303_p0.png"
+
+func newTestUpstream() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://www.pixiv.net/" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != testImagePath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "image.png", startTime, strings.NewReader("0123456789"))
+	}))
+}
+
+func proxyGet(t *testing.T, proxy *httptest.Server, target string, rng string) (int, string) {
+	request, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rng != "" {
+		request.Header.Set("Range", rng)
+	}
+	response, err := proxy.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(data)
+}
+
+func testProxy(t *testing.T, server *ProxyServer) {
+	upstream := newTestUpstream()
+	defer upstream.Close()
+	server.Key = []byte("secret")
+	server.Upstream = upstream.URL
+	proxy := httptest.NewServer(server)
+	defer proxy.Close()
+	host, _ := url.Parse(proxy.URL)
+	signed, err := ProxiedURL{ProxyHost: host.Host, Key: server.Key}.TransformURL("https://i.pximg.net" + testImagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed = "http" + signed[len("https"):]
+
+	if code, _ := proxyGet(t, proxy, proxy.URL+testImagePath, ""); code != http.StatusForbidden {
+		t.Fatalf("unsigned request returned %d", code)
+	}
+	if code, _ := proxyGet(t, proxy, proxy.URL+"/other.png?"+url.Values{"s": {SignPath(server.Key, testImagePath)}}.Encode(), ""); code != http.StatusForbidden {
+		t.Fatalf("mismatched signature returned %d", code)
+	}
+	if code, body := proxyGet(t, proxy, signed, ""); code != http.StatusOK || body != "0123456789" {
+		t.Fatalf("unexpected response %d %q", code, body)
+	}
+	if code, body := proxyGet(t, proxy, signed, "bytes=2-4"); code != http.StatusPartialContent || body != "234" {
+		t.Fatalf("unexpected range response %d %q", code, body)
+	}
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	testProxy(t, &ProxyServer{})
+}
+
+func TestProxyCached(t *testing.T) {
+	testProxy(t, &ProxyServer{CacheDir: t.TempDir()})
+}
+
+func TestProxyCacheFill(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		<-release
+		w.Write([]byte("0123456789"))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	server := &ProxyServer{Upstream: upstream.URL, CacheDir: dir, CacheSize: 15}
+
+	// concurrent requests for the same path share the download
+	var wait sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			if _, err := server.fillCache("/a.png"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wait.Wait()
+	if requests != 1 {
+		t.Errorf("expected one download, got %d", requests)
+	}
+
+	// the oldest file is evicted once the cache is over its size
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(server.cachePath("/a.png"), old, old)
+	if _, err := server.fillCache("/b.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(server.cachePath("/a.png")); !os.IsNotExist(err) {
+		t.Errorf("expected the oldest file to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(server.cachePath("/b.png")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,79 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/codehz/pixivbot/pixiv"
+)
+
+func decodeFrame(file *zip.File) (image.Image, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	img, _, err := image.Decode(reader)
+	return img, err
+}
+
+// EncodeGif converts the frames in the ugoira zip to a looping gif, the delays
+// of the frames are in milliseconds
+func EncodeGif(w io.Writer, archive []byte, frames []pixiv.UgoiraFrame) error {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return &Error{Kind: ErrDecodeFailed, Err: err}
+	}
+	if len(frames) == 0 {
+		return &Error{Kind: ErrDecodeFailed, Err: fmt.Errorf("no frames")}
+	}
+	files := map[string]*zip.File{}
+	for _, file := range reader.File {
+		files[file.Name] = file
+	}
+	result := &gif.GIF{}
+	for _, frame := range frames {
+		file, ok := files[frame.File]
+		if !ok {
+			return &Error{Kind: ErrDecodeFailed, Err: fmt.Errorf("missing frame %s", frame.File)}
+		}
+		img, err := decodeFrame(file)
+		if err != nil {
+			return &Error{Kind: ErrDecodeFailed, Err: fmt.Errorf("%s: %w", frame.File, err)}
+		}
+		bounds := img.Bounds()
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+		result.Image = append(result.Image, paletted)
+		// gif delays are in hundredths of a second
+		result.Delay = append(result.Delay, (frame.Delay+5)/10)
+	}
+	return gif.EncodeAll(w, result)
+}
+
+// Ugoira downloads the zip of the ugoira and writes it to w as a gif
+func Ugoira(ctx context.Context, meta pixiv.UgoiraMeta, w io.Writer) error {
+	reader, err := Open(ctx, meta.Src)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return &Error{Kind: ErrNetwork, URL: meta.Src, Err: err}
+	}
+	err = EncodeGif(w, data, meta.Frames)
+	var downloadError *Error
+	if errors.As(err, &downloadError) {
+		downloadError.URL = meta.Src
+	}
+	return err
+}
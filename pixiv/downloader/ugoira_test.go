@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/codehz/pixivbot/pixiv"
+)
+
+func TestEncodeGif(t *testing.T) {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for i, fill := range []color.Color{color.White, color.Black} {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		for x := 0; x < 4; x++ {
+			for y := 0; y < 4; y++ {
+				img.Set(x, y, fill)
+			}
+		}
+		w, _ := writer.Create([]string{"000000.png", "000001.png"}[i])
+		png.Encode(w, img)
+	}
+	writer.Close()
+
+	var output bytes.Buffer
+	frames := []pixiv.UgoiraFrame{{File: "000000.png", Delay: 50}, {File: "000001.png", Delay: 100}}
+	if err := EncodeGif(&output, archive.Bytes(), frames); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := gif.DecodeAll(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Image) != 2 || decoded.Delay[0] != 5 || decoded.Delay[1] != 10 {
+		t.Errorf("unexpected gif with %d frames and delays %v", len(decoded.Image), decoded.Delay)
+	}
+
+	err = EncodeGif(&output, archive.Bytes(), []pixiv.UgoiraFrame{{File: "missing.png"}})
+	if !errors.Is(err, ErrDecodeFailed) {
+		t.Errorf("expected decode error, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package pixiv
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// The kinds of Error, match them with errors.Is
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrDeleted      = errors.New("work deleted")
+	ErrRestricted   = errors.New("login required")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrNetwork      = errors.New("network error")
+	ErrDecodeFailed = errors.New("invalid response")
+	ErrServer       = errors.New("server error")
+)
+
+// Error is returned by the api calls, Kind is one of the Err* values, Message
+// is the message returned by pixiv and Err is the underlying cause
+type Error struct {
+	Kind    error
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	text := e.Kind.Error()
+	if e.Message != "" {
+		text += ": " + e.Message
+	}
+	if e.Err != nil {
+		text += ": " + e.Err.Error()
+	}
+	return text
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+var (
+	deletedKeywords = []string{"削除", "删除", "刪除", "deleted"}
+	loginKeywords   = []string{"ログイン", "登录", "登入", "log in", "login"}
+)
+
+func containsAny(message string, keywords []string) bool {
+	message = strings.ToLower(message)
+	for _, keyword := range keywords {
+		if strings.Contains(message, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify guesses the kind from the http status and the message of pixiv,
+// the message is localized so keywords of all languages are checked
+func classify(status int, message string) error {
+	switch {
+	case containsAny(message, deletedKeywords):
+		return ErrDeleted
+	case containsAny(message, loginKeywords):
+		return ErrRestricted
+	}
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrRestricted
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return ErrServer
+}
@@ -1,46 +1,173 @@
 package pixiv
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram("pixivbot_pixiv_request_duration_seconds", "Latency of pixiv api requests.", metrics.DurationBuckets, "endpoint")
+	requestErrors   = metrics.NewCounter("pixivbot_pixiv_errors_total", "Failed pixiv api requests by error code.", "endpoint", "code")
 )
 
-func buildRequest(url string) (data []byte, err error) {
-	req, err := http.NewRequest("GET", url, nil)
+// BaseURL is where the api is requested, tests point it to a fake server
+var BaseURL = "https://www.pixiv.net"
+
+// acceptLanguage maps the locale to the accept-language header, which decides
+// the language of tag translations
+func acceptLanguage(lang string) string {
+	switch lang {
+	case "", "zh-CN":
+		return "zh-CN,zh"
+	case "zh-TW":
+		return "zh-TW,zh"
+	}
+	return lang
+}
+
+func buildRequest(ctx context.Context, url string, lang string) (data []byte, status int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create http request: %e", err)
+		return nil, 0, fmt.Errorf("failed to create http request: %w", err)
 	}
-	req.Header.Set("accept-language", "zh-CN,zh")
+	req.Header.Set("accept-language", acceptLanguage(lang))
+	return doRequest(ctx, req)
+}
+
+// doRequest sends the request and reads the response, errors are counted by
+// endpoint
+func doRequest(ctx context.Context, req *http.Request) (data []byte, status int, err error) {
+	log := logging.FromContext(ctx).With("url", req.URL.String())
+	start := time.Now()
+	endpoint := req.URL.Path
+	defer requestDuration.Since(start, endpoint)
 	response, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to request url: %e", err)
+		requestErrors.Inc(endpoint, "network")
+		log.Warn("pixiv request failed", "duration", time.Since(start), "error", err)
+		return nil, 0, &Error{Kind: ErrNetwork, Err: err}
 	}
 	defer response.Body.Close()
+	status = response.StatusCode
+	if status != http.StatusOK {
+		requestErrors.Inc(endpoint, strconv.Itoa(status))
+	}
 	data, err = io.ReadAll(response.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data: %e", err)
+		requestErrors.Inc(endpoint, "network")
+		log.Warn("pixiv response broken", "status", status, "duration", time.Since(start), "error", err)
+		return nil, status, &Error{Kind: ErrNetwork, Err: err}
 	}
+	log.Debug("pixiv request", "status", status, "bytes", len(data), "duration", time.Since(start))
 	return
 }
 
-func decodeResponse(res PixivResponse, data []byte) error {
+// maxLoggedBody limits how much of a broken response is logged
+const maxLoggedBody = 1024
+
+func decodeResponse(ctx context.Context, res PixivResponse, status int, data []byte) error {
 	err := json.Unmarshal(data, &res)
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) && res.GetError() != nil {
+		// error responses come with "body": [], the error itself is decoded
+		err = nil
+	}
+	if err != nil {
+		body := string(data)
+		if len(body) > maxLoggedBody {
+			body = body[:maxLoggedBody]
+		}
+		logging.FromContext(ctx).Warn("invalid pixiv response", "status", status, "error", err, "body", body)
+		if kind := classify(status, ""); kind != ErrServer {
+			return &Error{Kind: kind, Err: err}
+		}
+		return &Error{Kind: ErrDecodeFailed, Err: err}
+	}
+	err = res.GetError()
 	if err != nil {
-		println(string(data))
-		return fmt.Errorf("failed to parse json")
+		var apiError *Error
+		if errors.As(err, &apiError) && apiError.Kind == ErrServer {
+			apiError.Kind = classify(status, apiError.Message)
+		}
+		logging.FromContext(ctx).Warn("pixiv returned error", "status", status, "error", err)
 	}
-	return res.GetError()
+	return err
 }
 
-func GetDetils(id int) (*DetailsApi, error) {
-	url := fmt.Sprintf("https://www.pixiv.net/touch/ajax/illust/details?illust_id=%d", id)
-	data, err := buildRequest(url)
+// GetDetils fetches the details of the illust, lang is the locale used for
+// translations (e.g. "zh-CN", "en", "ja")
+func GetDetils(ctx context.Context, id int, lang string) (*DetailsApi, error) {
+	url := fmt.Sprintf("%s/touch/ajax/illust/details?illust_id=%d", BaseURL, id)
+	data, status, err := buildRequest(ctx, url, lang)
 	if err != nil {
 		return nil, err
 	}
 	var details DetailsResponse
-	err = decodeResponse(&details, data)
+	err = decodeResponse(ctx, &details, status, data)
+	if err == nil && details.Body != nil {
+		var raw struct {
+			Body json.RawMessage `json:"body"`
+		}
+		if json.Unmarshal(data, &raw) == nil {
+			details.Body.Raw = raw.Body
+		}
+	}
 	return details.Body, err
 }
+
+// Ping checks pixiv is reachable, any response below 500 counts
+func Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", BaseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return &Error{Kind: ErrNetwork, Err: err}
+	}
+	response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return &Error{Kind: ErrServer, Message: response.Status}
+	}
+	return nil
+}
+
+// ParseIllustUrl returns the id of the illust in links to artworks
+func ParseIllustUrl(input string) (result int, err error) {
+	u, err := url.Parse(input)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "https" || (u.Host != "www.pixiv.net" && u.Host != "pixiv.net") {
+		return 0, fmt.Errorf("not a pixiv link")
+	}
+	_, err = fmt.Sscanf(u.Path, "/artworks/%d", &result)
+	if err == nil {
+		return
+	}
+	if u.Path == "/member_illust.php" {
+		return strconv.Atoi(u.Query().Get("illust_id"))
+	}
+	err = fmt.Errorf("not a illust link")
+	return
+}
+
+// ParseIllustId accepts an illust id or link
+func ParseIllustId(input string) (result int, err error) {
+	result, err = strconv.Atoi(input)
+	if err == nil {
+		return
+	}
+	result, err = ParseIllustUrl(input)
+	return
+}
@@ -0,0 +1,52 @@
+package pixiv
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDecodeResponse(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		kind   error
+	}{
+		{200, `{"error": true, "message": "該当作品は削除されたか、存在しない作品IDです。"}`, ErrDeleted},
+		{200, `{"error": true, "message": "Work has been deleted or the ID does not exist."}`, ErrDeleted},
+		{403, `{"error": true, "message": "このページを閲覧するにはログインしてください"}`, ErrRestricted},
+		{404, `{"error": true, "message": ""}`, ErrNotFound},
+		{404, `{"error": true, "message": "", "body": []}`, ErrNotFound},
+		{429, `<html>Too Many Requests</html>`, ErrRateLimited},
+		{200, `<html>`, ErrDecodeFailed},
+		{500, `{"error": true, "message": "unknown"}`, ErrServer},
+	}
+	for _, c := range cases {
+		var details DetailsResponse
+		err := decodeResponse(context.Background(), &details, c.status, []byte(c.body))
+		if !errors.Is(err, c.kind) {
+			t.Errorf("%d %s: expected %v, got %v", c.status, c.body, c.kind, err)
+		}
+		var apiError *Error
+		if !errors.As(err, &apiError) {
+			t.Errorf("%d %s: expected *Error, got %T", c.status, c.body, err)
+		}
+	}
+	var details DetailsResponse
+	err := decodeResponse(context.Background(), &details, 200, []byte(`{"error": false, "body": {}}`))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRelatedImage(t *testing.T) {
+	cases := map[string]string{
+		"https://i.pximg.net/c/250x250_80_a2/img-master/img/2021/08/20/00/00/01/1001_p0_square1200.jpg":   "https://i.pximg.net/c/540x540_70/img-master/img/2021/08/20/00/00/01/1001_p0_master1200.jpg",
+		"https://i.pximg.net/c/250x250_80_a2/custom-thumb/img/2021/08/20/00/00/01/1001_p0_custom1200.jpg": "https://i.pximg.net/c/540x540_70/img-master/img/2021/08/20/00/00/01/1001_p0_master1200.jpg",
+	}
+	for url, expected := range cases {
+		if result := (RelatedIllust{URL: url}).GetSmallImage(); result != expected {
+			t.Errorf("%s: expected %s, got %s", url, expected, result)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package pixiv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RelatedIllust is an illust recommended by pixiv, with less details than
+// DetailsApi
+type RelatedIllust struct {
+	ID        string   `json:"id"`
+	Title     string   `json:"title"`
+	Type      int      `json:"illustType"`
+	XRestrict int      `json:"xRestrict"`
+	URL       string   `json:"url"`
+	Tags      []string `json:"tags"`
+	UserID    string   `json:"userId"`
+	UserName  string   `json:"userName"`
+	PageCount int      `json:"pageCount"`
+	// IsAdContainer marks the ad slots mixed into the list
+	IsAdContainer bool `json:"isAdContainer"`
+}
+
+var thumbnailPattern = regexp.MustCompile(`/c/[0-9a-z_]+/(custom-thumb|img-master)/`)
+
+// GetSmallImage returns the 540x540 master image instead of the square
+// thumbnail in URL
+func (illust RelatedIllust) GetSmallImage() string {
+	url := thumbnailPattern.ReplaceAllString(illust.URL, "/c/540x540_70/img-master/")
+	url = strings.Replace(url, "_square1200.", "_master1200.", 1)
+	return strings.Replace(url, "_custom1200.", "_master1200.", 1)
+}
+
+// GetOriginalImage is the same as GetSmallImage, the recommendations don't
+// include the original
+func (illust RelatedIllust) GetOriginalImage() string {
+	return illust.GetSmallImage()
+}
+
+type RelatedApi struct {
+	Illusts []RelatedIllust `json:"illusts"`
+	NextIds []string        `json:"nextIds"`
+}
+
+type RelatedResponse struct {
+	IsError      bool        `json:"error"`
+	ErrorMessage string      `json:"message"`
+	Body         *RelatedApi `json:"body"`
+}
+
+func (res RelatedResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// GetRelated fetches up to limit illusts recommended for the illust, the ad
+// slots are dropped
+func GetRelated(ctx context.Context, id int, limit int, lang string) ([]RelatedIllust, error) {
+	url := fmt.Sprintf("%s/ajax/illust/%d/recommend/init?limit=%d", BaseURL, id, limit)
+	data, status, err := buildRequest(ctx, url, lang)
+	if err != nil {
+		return nil, err
+	}
+	var related RelatedResponse
+	err = decodeResponse(ctx, &related, status, data)
+	if err != nil || related.Body == nil {
+		return nil, err
+	}
+	result := make([]RelatedIllust, 0, len(related.Body.Illusts))
+	for _, illust := range related.Body.Illusts {
+		if !illust.IsAdContainer && illust.ID != "" {
+			result = append(result, illust)
+		}
+	}
+	return result, nil
+}
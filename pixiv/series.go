@@ -0,0 +1,141 @@
+package pixiv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// SERIES_MAX_PAGES caps the pages requested by GetSeries, pixiv returns 12
+// works per page
+const SERIES_MAX_PAGES = 20
+
+// SeriesNavWork is the previous or next work in the series
+type SeriesNavWork struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// SeriesNavData is the position of the work in its series, part of the
+// illust details
+type SeriesNavData struct {
+	Type  string `json:"series_type"`
+	ID    string `json:"series_id"`
+	Title string `json:"title"`
+	// Order starts from 1
+	Order int            `json:"order"`
+	Prev  *SeriesNavWork `json:"prev"`
+	Next  *SeriesNavWork `json:"next"`
+}
+
+type SeriesInfo struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	Title  string `json:"title"`
+	Total  int    `json:"total"`
+}
+
+type SeriesWork struct {
+	WorkID string `json:"workId"`
+	Order  int    `json:"order"`
+}
+
+type SeriesPage struct {
+	Series []SeriesWork `json:"series"`
+	Total  int          `json:"total"`
+}
+
+type SeriesThumbnails struct {
+	Illust []RelatedIllust `json:"illust"`
+}
+
+type SeriesApi struct {
+	IllustSeries []SeriesInfo     `json:"illustSeries"`
+	Page         SeriesPage       `json:"page"`
+	Thumbnails   SeriesThumbnails `json:"thumbnails"`
+}
+
+type SeriesResponse struct {
+	IsError      bool       `json:"error"`
+	ErrorMessage string     `json:"message"`
+	Body         *SeriesApi `json:"body"`
+}
+
+func (res SeriesResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// SeriesEntry is a work of the series
+type SeriesEntry struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	Order     int    `json:"order"`
+	PageCount int    `json:"page_count"`
+}
+
+// Series is a manga series with its works in reading order
+type Series struct {
+	ID     string        `json:"id"`
+	UserID string        `json:"user_id"`
+	Title  string        `json:"title"`
+	Works  []SeriesEntry `json:"works"`
+}
+
+// GetSeriesPage fetches a page of the series, pages start from 1
+func GetSeriesPage(ctx context.Context, id int, page int, lang string) (*SeriesApi, error) {
+	url := fmt.Sprintf("%s/ajax/series/%d?p=%d", BaseURL, id, page)
+	data, status, err := buildRequest(ctx, url, lang)
+	if err != nil {
+		return nil, err
+	}
+	var series SeriesResponse
+	err = decodeResponse(ctx, &series, status, data)
+	if err == nil && series.Body == nil {
+		err = &Error{Kind: ErrDecodeFailed, Message: "empty series"}
+	}
+	return series.Body, err
+}
+
+// GetSeries fetches all works of the series, at most SERIES_MAX_PAGES pages
+func GetSeries(ctx context.Context, id int, lang string) (*Series, error) {
+	result := &Series{ID: fmt.Sprint(id)}
+	seen := map[string]bool{}
+	for page := 1; page <= SERIES_MAX_PAGES; page++ {
+		current, err := GetSeriesPage(ctx, id, page, lang)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range current.IllustSeries {
+			if info.ID == result.ID {
+				result.Title = info.Title
+				result.UserID = info.UserID
+			}
+		}
+		thumbnails := map[string]RelatedIllust{}
+		for _, illust := range current.Thumbnails.Illust {
+			thumbnails[illust.ID] = illust
+		}
+		for _, work := range current.Page.Series {
+			if seen[work.WorkID] {
+				continue
+			}
+			seen[work.WorkID] = true
+			thumbnail := thumbnails[work.WorkID]
+			result.Works = append(result.Works, SeriesEntry{
+				ID:        work.WorkID,
+				Title:     thumbnail.Title,
+				Order:     work.Order,
+				PageCount: thumbnail.PageCount,
+			})
+		}
+		if len(current.Page.Series) == 0 || len(result.Works) >= current.Page.Total {
+			break
+		}
+	}
+	sort.Slice(result.Works, func(i, j int) bool { return result.Works[i].Order < result.Works[j].Order })
+	return result, nil
+}
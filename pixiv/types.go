@@ -1,6 +1,9 @@
 package pixiv
 
-import "fmt"
+import (
+	"encoding/json"
+	"net/http"
+)
 
 type IllustImages struct {
 	IllustImageWidth  string `json:"illust_image_width"`
@@ -121,6 +124,8 @@ type IllustDetails struct {
 	RatingCount             string                  `json:"rating_count"`
 	RatingView              string                  `json:"rating_view"`
 	CommentHTML             string                  `json:"comment_html"`
+	// SeriesNavData is nil if the work is not in a series
+	SeriesNavData *SeriesNavData `json:"series_nav_data"`
 }
 
 func (details IllustDetails) GetSmallImage() string {
@@ -164,6 +169,8 @@ type AuthorDetails struct {
 type DetailsApi struct {
 	IllustDetails IllustDetails `json:"illust_details"`
 	AuthorDetails AuthorDetails `json:"author_details"`
+	// Raw is the body as pixiv returned it, with the fields not modeled here
+	Raw json.RawMessage `json:"-"`
 }
 
 type PixivResponse interface {
@@ -178,7 +185,7 @@ type DetailsResponse struct {
 
 func (res DetailsResponse) GetError() error {
 	if res.IsError {
-		return fmt.Errorf("server error: %s", res.ErrorMessage)
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
 	}
 	return nil
 }
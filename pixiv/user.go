@@ -0,0 +1,66 @@
+package pixiv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// workIds are the keys of the works in the profile, pixiv sends an empty
+// array instead of an empty object
+type workIds map[string]interface{}
+
+func (ids *workIds) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		*ids = workIds{}
+		return nil
+	}
+	return json.Unmarshal(data, (*map[string]interface{})(ids))
+}
+
+type ProfileApi struct {
+	Illusts workIds `json:"illusts"`
+	Manga   workIds `json:"manga"`
+}
+
+type ProfileResponse struct {
+	IsError      bool        `json:"error"`
+	ErrorMessage string      `json:"message"`
+	Body         *ProfileApi `json:"body"`
+}
+
+func (res ProfileResponse) GetError() error {
+	if res.IsError {
+		return &Error{Kind: classify(http.StatusOK, res.ErrorMessage), Message: res.ErrorMessage}
+	}
+	return nil
+}
+
+// GetUserWorks fetches the ids of the illusts and manga of the user, newest
+// first
+func GetUserWorks(ctx context.Context, user int, lang string) ([]int, error) {
+	url := fmt.Sprintf("%s/ajax/user/%d/profile/all", BaseURL, user)
+	data, status, err := buildRequest(ctx, url, lang)
+	if err != nil {
+		return nil, err
+	}
+	var profile ProfileResponse
+	err = decodeResponse(ctx, &profile, status, data)
+	if err != nil || profile.Body == nil {
+		return nil, err
+	}
+	result := make([]int, 0, len(profile.Body.Illusts)+len(profile.Body.Manga))
+	for _, ids := range []workIds{profile.Body.Illusts, profile.Body.Manga} {
+		for key := range ids {
+			if id, err := strconv.Atoi(key); err == nil {
+				result = append(result, id)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(result)))
+	return result, nil
+}
@@ -0,0 +1,172 @@
+// Package source finds the pixiv works an image comes from with a reverse
+// image search. SauceNAO is the only backend, other services with the same
+// api can be used by changing the base url.
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	"github.com/codehz/pixivbot/metrics"
+)
+
+const DEFAULT_SAUCENAO_URL = "https://saucenao.com"
+
+// SAUCENAO_PIXIV_INDEX is the database of pixiv works in SauceNAO
+const SAUCENAO_PIXIV_INDEX = 5
+
+const SAUCENAO_RESULTS = 8
+
+var (
+	ErrRateLimited = errors.New("too many searches")
+	ErrBackend     = errors.New("search failed")
+)
+
+var searchDuration = metrics.NewHistogram("pixivbot_source_search_duration_seconds", "Latency of the reverse image searches.", metrics.DurationBuckets)
+
+// Match is a pixiv work similar to the searched image, Similarity is a
+// percentage
+type Match struct {
+	Illust     int     `json:"illust"`
+	Title      string  `json:"title"`
+	Author     string  `json:"author"`
+	Similarity float64 `json:"similarity"`
+	Thumbnail  string  `json:"thumbnail"`
+}
+
+// Finder searches the source of an image
+type Finder interface {
+	Find(ctx context.Context, image io.Reader) ([]Match, error)
+}
+
+// SauceNAO is the Finder of the SauceNAO api, the image is uploaded so the
+// telegram file links with the bot token are never shared
+type SauceNAO struct {
+	BaseURL string
+	APIKey  string
+	Client  *http.Client
+}
+
+func NewSauceNAO(baseURL string, key string) *SauceNAO {
+	if baseURL == "" {
+		baseURL = DEFAULT_SAUCENAO_URL
+	}
+	return &SauceNAO{BaseURL: baseURL, APIKey: key, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+type sauceHeader struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type sauceResult struct {
+	Header struct {
+		// similarity is sent as a string like "92.35"
+		Similarity string `json:"similarity"`
+		Thumbnail  string `json:"thumbnail"`
+		IndexID    int    `json:"index_id"`
+	} `json:"header"`
+	Data struct {
+		PixivID    int    `json:"pixiv_id"`
+		Title      string `json:"title"`
+		MemberName string `json:"member_name"`
+	} `json:"data"`
+}
+
+type sauceResponse struct {
+	Header  sauceHeader   `json:"header"`
+	Results []sauceResult `json:"results"`
+}
+
+// Find uploads the image and returns the pixiv works found, most similar
+// first and once per work
+func (api *SauceNAO) Find(ctx context.Context, image io.Reader) ([]Match, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "image.jpg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(part, image); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	query := url.Values{
+		"output_type": {"2"},
+		"db":          {strconv.Itoa(SAUCENAO_PIXIV_INDEX)},
+		"numres":      {strconv.Itoa(SAUCENAO_RESULTS)},
+	}
+	if api.APIKey != "" {
+		query.Set("api_key", api.APIKey)
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", api.BaseURL+"/search.php?"+query.Encode(), &body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	log := logging.FromContext(ctx)
+	start := time.Now()
+	response, err := api.Client.Do(request)
+	if err != nil {
+		log.Warn("source search failed", "error", err)
+		return nil, fmt.Errorf("%w: %v", ErrBackend, err)
+	}
+	defer response.Body.Close()
+	searchDuration.Since(start)
+	if response.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
+	var decoded sauceResponse
+	err = json.NewDecoder(response.Body).Decode(&decoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBackend, response.Status)
+	}
+	// negative statuses are errors of the request, positive ones of the
+	// service
+	if decoded.Header.Status != 0 {
+		log.Warn("source search failed", "status", decoded.Header.Status, "message", decoded.Header.Message)
+		return nil, fmt.Errorf("%w: %s", ErrBackend, decoded.Header.Message)
+	}
+	var result []Match
+	for _, item := range decoded.Results {
+		if item.Data.PixivID == 0 {
+			continue
+		}
+		similarity, _ := strconv.ParseFloat(item.Header.Similarity, 64)
+		result = append(result, Match{
+			Illust:     item.Data.PixivID,
+			Title:      item.Data.Title,
+			Author:     item.Data.MemberName,
+			Similarity: similarity,
+			Thumbnail:  item.Header.Thumbnail,
+		})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Similarity > result[j].Similarity
+	})
+	// the pages of a work are matched separately, only the best one is kept
+	seen := map[int]bool{}
+	unique := result[:0]
+	for _, match := range result {
+		if !seen[match.Illust] {
+			seen[match.Illust] = true
+			unique = append(unique, match)
+		}
+	}
+	result = unique
+	log.Debug("source searched", "matches", len(result), "duration", time.Since(start))
+	return result, nil
+}
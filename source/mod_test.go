@@ -0,0 +1,62 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const sauceFixture = `{
+  "header": {"status": 0, "results_returned": 4},
+  "results": [
+    {"header": {"similarity": "61.20", "thumbnail": "https://example.com/t2", "index_id": 5}, "data": {"pixiv_id": 1002, "title": "漫画", "member_name": "漫画家"}},
+    {"header": {"similarity": "93.50", "thumbnail": "https://example.com/t1", "index_id": 5}, "data": {"pixiv_id": 1001, "title": "夏の空", "member_name": "画家"}},
+    {"header": {"similarity": "88.00", "thumbnail": "https://example.com/t1", "index_id": 5}, "data": {"pixiv_id": 1001, "title": "夏の空", "member_name": "画家"}},
+    {"header": {"similarity": "70.00", "index_id": 9}, "data": {"danbooru_id": 5}}
+  ]
+}`
+
+func TestSauceNAO(t *testing.T) {
+	limited := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"header": {"status": -2, "message": "Search Rate Too High."}}`))
+			return
+		}
+		if r.URL.Path != "/search.php" || r.URL.Query().Get("api_key") != "key" || r.URL.Query().Get("db") != "5" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		if string(data) != "image" {
+			http.Error(w, "unexpected image", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(sauceFixture))
+	}))
+	defer server.Close()
+	api := NewSauceNAO(server.URL, "key")
+
+	matches, err := api.Find(context.Background(), strings.NewReader("image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 || matches[0].Illust != 1001 || matches[0].Similarity != 93.5 || matches[1].Author != "漫画家" {
+		t.Errorf("unexpected matches %+v", matches)
+	}
+
+	limited = true
+	if _, err := api.Find(context.Background(), strings.NewReader("image")); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected rate limit, got %v", err)
+	}
+}
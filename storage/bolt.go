@@ -0,0 +1,480 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/codehz/pixivbot/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	BUCKET_META          = "meta"
+	BUCKET_SETTINGS      = "settings"
+	BUCKET_POSTS         = "posts"
+	BUCKET_SUBSCRIPTIONS = "subscriptions"
+	BUCKET_CACHE         = "cache"
+	BUCKET_MESSAGES      = "messages"
+	BUCKET_HASHES        = "hashes"
+)
+
+var versionKey = []byte("version")
+
+// migrations upgrade the schema, the version in the meta bucket is the number
+// of migrations applied. Only append to the list, released migrations must
+// never change.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: the initial buckets
+	func(tx *bolt.Tx) error {
+		for _, name := range []string{BUCKET_SETTINGS, BUCKET_POSTS, BUCKET_SUBSCRIPTIONS, BUCKET_CACHE} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: the index of the posts by their messages
+	func(tx *bolt.Tx) error {
+		messages, err := tx.CreateBucket([]byte(BUCKET_MESSAGES))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(BUCKET_POSTS)).ForEach(func(key, value []byte) error {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			return indexPost(messages, key, post)
+		})
+	},
+	// 3: the perceptual hashes of the images
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BUCKET_HASHES))
+		return err
+	},
+	// 4: the origin of the posts, older posts are refreshed with the
+	// settings of their own chat as before
+	func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_POSTS))
+		updated := map[string][]byte{}
+		err := bucket.ForEach(func(key, value []byte) error {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			if post.Origin != 0 {
+				return nil
+			}
+			post.Origin = post.Chat
+			data, err := json.Marshal(post)
+			if err != nil {
+				return err
+			}
+			updated[string(key)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, value := range updated {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// DB is the Storage backed by a bbolt database file
+type DB struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+// Open opens or creates the database and applies the pending migrations
+func Open(path string) (*DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database is locked by another process: %w", err)
+	} else if err != nil {
+		return nil, err
+	}
+	store := &DB{db: db, now: time.Now}
+	err = store.migrate()
+	if err == nil {
+		// the entries expired while the bot was stopped
+		_, err = store.PruneCache()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Version returns the number of migrations applied to the database
+func (store *DB) Version() (version int, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		version = readVersion(tx)
+		return nil
+	})
+	return
+}
+
+func readVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket([]byte(BUCKET_META))
+	if meta == nil {
+		return 0
+	}
+	value := meta.Get(versionKey)
+	if len(value) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(value))
+}
+
+func (store *DB) migrate() error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(BUCKET_META))
+		if err != nil {
+			return err
+		}
+		version := readVersion(tx)
+		if version > len(migrations) {
+			return fmt.Errorf("database version %d is newer than supported version %d", version, len(migrations))
+		}
+		for i := version; i < len(migrations); i++ {
+			if err := migrations[i](tx); err != nil {
+				return fmt.Errorf("migration %d: %w", i+1, err)
+			}
+			logging.Default.Info("database migrated", "version", i+1)
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(len(migrations)))
+		return meta.Put(versionKey, value)
+	})
+}
+
+// int64Key encodes the id so the keys sort like the numbers
+func int64Key(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id)^1<<63)
+	return key
+}
+
+func keyInt64(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key) ^ 1<<63)
+}
+
+func (store *DB) Get(chat int64) (settings ChatSettings) {
+	err := store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(BUCKET_SETTINGS)).Get(int64Key(chat))
+		if value == nil {
+			return nil
+		}
+		return json.Unmarshal(value, &settings)
+	})
+	if err != nil {
+		logging.Default.Warn("failed to read settings", "chat", chat, "error", err)
+		return ChatSettings{}
+	}
+	return
+}
+
+func (store *DB) Update(chat int64, fn func(*ChatSettings)) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_SETTINGS))
+		var current ChatSettings
+		if value := bucket.Get(int64Key(chat)); value != nil {
+			if err := json.Unmarshal(value, &current); err != nil {
+				return err
+			}
+		}
+		fn(&current)
+		value, err := json.Marshal(current)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(int64Key(chat), value)
+	})
+}
+
+func (store *DB) Chats() (result []int64) {
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_SETTINGS)).ForEach(func(key, _ []byte) error {
+			result = append(result, keyInt64(key))
+			return nil
+		})
+	})
+	if err != nil {
+		logging.Default.Warn("failed to list chats", "error", err)
+	}
+	return
+}
+
+// posts are keyed by the illust followed by a sequence number, so the posts
+// of an illust are next to each other in the order they were added
+func (store *DB) AddPost(post Post) error {
+	value, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_POSTS))
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		copy(key, int64Key(int64(post.Illust)))
+		binary.BigEndian.PutUint64(key[8:], sequence)
+		if err := bucket.Put(key, value); err != nil {
+			return err
+		}
+		return indexPost(tx.Bucket([]byte(BUCKET_MESSAGES)), key, post)
+	})
+}
+
+// messageKey is the key of the message index, the chat followed by the
+// message id
+func messageKey(chat int64, message int) []byte {
+	key := make([]byte, 16)
+	copy(key, int64Key(chat))
+	binary.BigEndian.PutUint64(key[8:], uint64(message))
+	return key
+}
+
+// indexPost maps every message of the post to the key of the post
+func indexPost(messages *bolt.Bucket, key []byte, post Post) error {
+	for _, message := range post.Messages {
+		if err := messages.Put(messageKey(post.Chat, message), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *DB) Posts(illust int) (result []Post, err error) {
+	prefix := int64Key(int64(illust))
+	err = store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(BUCKET_POSTS)).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			result = append(result, post)
+		}
+		return nil
+	})
+	return
+}
+
+func (store *DB) PostByMessage(chat int64, message int) (post Post, found bool, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket([]byte(BUCKET_MESSAGES)).Get(messageKey(chat, message))
+		if key == nil {
+			return nil
+		}
+		value := tx.Bucket([]byte(BUCKET_POSTS)).Get(key)
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &post)
+	})
+	return
+}
+
+// PostsSince scans all posts, the history is small enough for a periodic
+// job
+func (store *DB) PostsSince(since time.Time) (result []Post, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_POSTS)).ForEach(func(key, value []byte) error {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			if !post.Time.Before(since) {
+				result = append(result, post)
+			}
+			return nil
+		})
+	})
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return
+}
+
+func (store *DB) UpdatePosts(illust int, fn func(*Post)) error {
+	prefix := int64Key(int64(illust))
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_POSTS))
+		updated := map[string][]byte{}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			fn(&post)
+			data, err := json.Marshal(post)
+			if err != nil {
+				return err
+			}
+			updated[string(key)] = data
+		}
+		// written after the iteration, the cursor is invalidated by changes
+		for key, value := range updated {
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hashKey is the illust followed by the page
+func hashKey(illust int, page int) []byte {
+	key := make([]byte, 16)
+	copy(key, int64Key(int64(illust)))
+	binary.BigEndian.PutUint64(key[8:], uint64(page))
+	return key
+}
+
+func (store *DB) AddHash(hash ImageHash) error {
+	value, err := json.Marshal(hash)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_HASHES)).Put(hashKey(hash.Illust, hash.Page), value)
+	})
+}
+
+func (store *DB) Hash(illust int, page int) (hash ImageHash, found bool, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte(BUCKET_HASHES)).Get(hashKey(illust, page))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &hash)
+	})
+	return
+}
+
+func (store *DB) Hashes() (result []ImageHash, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_HASHES)).ForEach(func(_, value []byte) error {
+			var hash ImageHash
+			if err := json.Unmarshal(value, &hash); err != nil {
+				return err
+			}
+			result = append(result, hash)
+			return nil
+		})
+	})
+	return
+}
+
+func subscriptionKey(chat int64, kind string, target string) []byte {
+	return append(int64Key(chat), kind+"\x00"+target...)
+}
+
+func (store *DB) Subscribe(sub Subscription) error {
+	value, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_SUBSCRIPTIONS)).Put(subscriptionKey(sub.Chat, sub.Kind, sub.Target), value)
+	})
+}
+
+func (store *DB) Unsubscribe(chat int64, kind string, target string) (found bool, err error) {
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_SUBSCRIPTIONS))
+		key := subscriptionKey(chat, kind, target)
+		found = bucket.Get(key) != nil
+		return bucket.Delete(key)
+	})
+	return
+}
+
+func (store *DB) Subscriptions(chat int64) (result []Subscription, err error) {
+	var prefix []byte
+	if chat != 0 {
+		prefix = int64Key(chat)
+	}
+	err = store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(BUCKET_SUBSCRIPTIONS)).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var sub Subscription
+			if err := json.Unmarshal(value, &sub); err != nil {
+				return err
+			}
+			result = append(result, sub)
+		}
+		return nil
+	})
+	return
+}
+
+// cached values are prefixed by the expiry time in unix nanoseconds
+func (store *DB) CacheGet(key string) (value []byte, ok bool) {
+	store.db.View(func(tx *bolt.Tx) error {
+		entry := tx.Bucket([]byte(BUCKET_CACHE)).Get([]byte(key))
+		if len(entry) < 8 {
+			return nil
+		}
+		expires := time.Unix(0, int64(binary.BigEndian.Uint64(entry)))
+		if store.now().After(expires) {
+			return nil
+		}
+		// the entry is only valid inside the transaction
+		value, ok = append([]byte(nil), entry[8:]...), true
+		return nil
+	})
+	return
+}
+
+func (store *DB) CachePut(key string, value []byte, ttl time.Duration) error {
+	entry := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(store.now().Add(ttl).UnixNano()))
+	entry = append(entry, value...)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BUCKET_CACHE)).Put([]byte(key), entry)
+	})
+}
+
+// PruneCache deletes the expired entries and returns how many were deleted
+func (store *DB) PruneCache() (count int, err error) {
+	now := store.now()
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(BUCKET_CACHE))
+		// deleting while iterating skips entries, collect the keys first
+		var expired [][]byte
+		bucket.ForEach(func(key, entry []byte) error {
+			if len(entry) < 8 || now.After(time.Unix(0, int64(binary.BigEndian.Uint64(entry)))) {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		count = len(expired)
+		return nil
+	})
+	return
+}
+
+func (store *DB) Close() error {
+	return store.db.Close()
+}
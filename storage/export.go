@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Dump is the json export of the database, the caches are left out
+type Dump struct {
+	Version       int                    `json:"version"`
+	Settings      map[int64]ChatSettings `json:"settings"`
+	Posts         []Post                 `json:"posts"`
+	Subscriptions []Subscription         `json:"subscriptions"`
+}
+
+// Export writes the database as json, read in a single transaction so the
+// dump is consistent
+func (store *DB) Export(w io.Writer) error {
+	dump := Dump{Settings: map[int64]ChatSettings{}, Posts: []Post{}, Subscriptions: []Subscription{}}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		dump.Version = readVersion(tx)
+		err := tx.Bucket([]byte(BUCKET_SETTINGS)).ForEach(func(key, value []byte) error {
+			var settings ChatSettings
+			if err := json.Unmarshal(value, &settings); err != nil {
+				return err
+			}
+			dump.Settings[keyInt64(key)] = settings
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(BUCKET_POSTS)).ForEach(func(_, value []byte) error {
+			var post Post
+			if err := json.Unmarshal(value, &post); err != nil {
+				return err
+			}
+			dump.Posts = append(dump.Posts, post)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(BUCKET_SUBSCRIPTIONS)).ForEach(func(_, value []byte) error {
+			var sub Subscription
+			if err := json.Unmarshal(value, &sub); err != nil {
+				return err
+			}
+			dump.Subscriptions = append(dump.Subscriptions, sub)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+// Backup writes a consistent copy of the database file, it is safe while the
+// bot is running
+func (store *DB) Backup(w io.Writer) (size int64, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		size, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// ImportSettings copies the settings of the old json settings file into the
+// store and returns the number of chats imported
+func ImportSettings(store Storage, path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var chats map[int64]ChatSettings
+	err = json.Unmarshal(data, &chats)
+	if err != nil {
+		return 0, err
+	}
+	for id, settings := range chats {
+		settings := settings
+		err = store.Update(id, func(current *ChatSettings) {
+			*current = settings
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(chats), nil
+}
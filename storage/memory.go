@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// Memory keeps everything in maps, the state is lost on restart
+type Memory struct {
+	mutex         sync.RWMutex
+	chats         map[int64]ChatSettings
+	posts         map[int][]Post
+	hashes        map[int]map[int]ImageHash
+	subscriptions map[int64][]Subscription
+	cache         map[string]cacheEntry
+	now           func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		chats:         map[int64]ChatSettings{},
+		posts:         map[int][]Post{},
+		hashes:        map[int]map[int]ImageHash{},
+		subscriptions: map[int64][]Subscription{},
+		cache:         map[string]cacheEntry{},
+		now:           time.Now,
+	}
+}
+
+func (store *Memory) Get(chat int64) ChatSettings {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.chats[chat]
+}
+
+func (store *Memory) Update(chat int64, fn func(*ChatSettings)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	current := store.chats[chat]
+	fn(&current)
+	store.chats[chat] = current
+	return nil
+}
+
+func (store *Memory) Chats() []int64 {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	result := make([]int64, 0, len(store.chats))
+	for id := range store.chats {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+func (store *Memory) AddPost(post Post) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.posts[post.Illust] = append(store.posts[post.Illust], post)
+	return nil
+}
+
+func (store *Memory) Posts(illust int) ([]Post, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return append([]Post(nil), store.posts[illust]...), nil
+}
+
+func (store *Memory) PostByMessage(chat int64, message int) (Post, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for _, posts := range store.posts {
+		for _, post := range posts {
+			if post.Chat != chat {
+				continue
+			}
+			for _, id := range post.Messages {
+				if id == message {
+					return post, true, nil
+				}
+			}
+		}
+	}
+	return Post{}, false, nil
+}
+
+func (store *Memory) PostsSince(since time.Time) ([]Post, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var result []Post
+	for _, posts := range store.posts {
+		for _, post := range posts {
+			if !post.Time.Before(since) {
+				result = append(result, post)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time.Before(result[j].Time) })
+	return result, nil
+}
+
+func (store *Memory) UpdatePosts(illust int, fn func(*Post)) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for i := range store.posts[illust] {
+		fn(&store.posts[illust][i])
+	}
+	return nil
+}
+
+func (store *Memory) AddHash(hash ImageHash) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if store.hashes[hash.Illust] == nil {
+		store.hashes[hash.Illust] = map[int]ImageHash{}
+	}
+	store.hashes[hash.Illust][hash.Page] = hash
+	return nil
+}
+
+func (store *Memory) Hash(illust int, page int) (ImageHash, bool, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	hash, ok := store.hashes[illust][page]
+	return hash, ok, nil
+}
+
+func (store *Memory) Hashes() ([]ImageHash, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var result []ImageHash
+	for _, pages := range store.hashes {
+		for _, hash := range pages {
+			result = append(result, hash)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Illust != result[j].Illust {
+			return result[i].Illust < result[j].Illust
+		}
+		return result[i].Page < result[j].Page
+	})
+	return result, nil
+}
+
+func (store *Memory) Subscribe(sub Subscription) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	list := store.subscriptions[sub.Chat]
+	for i, item := range list {
+		if item.Kind == sub.Kind && item.Target == sub.Target {
+			list[i] = sub
+			return nil
+		}
+	}
+	store.subscriptions[sub.Chat] = append(list, sub)
+	return nil
+}
+
+func (store *Memory) Unsubscribe(chat int64, kind string, target string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	list := store.subscriptions[chat]
+	for i, item := range list {
+		if item.Kind == kind && item.Target == target {
+			store.subscriptions[chat] = append(list[:i:i], list[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (store *Memory) Subscriptions(chat int64) ([]Subscription, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	if chat != 0 {
+		return append([]Subscription(nil), store.subscriptions[chat]...), nil
+	}
+	chats := make([]int64, 0, len(store.subscriptions))
+	for id := range store.subscriptions {
+		chats = append(chats, id)
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i] < chats[j] })
+	var result []Subscription
+	for _, id := range chats {
+		result = append(result, store.subscriptions[id]...)
+	}
+	return result, nil
+}
+
+func (store *Memory) CacheGet(key string) ([]byte, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	entry, ok := store.cache[key]
+	if !ok || store.now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (store *Memory) CachePut(key string, value []byte, ttl time.Duration) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.cache[key] = cacheEntry{value: value, expires: store.now().Add(ttl)}
+	return nil
+}
+
+func (store *Memory) PruneCache() (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := store.now()
+	count := 0
+	for key, entry := range store.cache {
+		if now.After(entry.expires) {
+			delete(store.cache, key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (store *Memory) Close() error {
+	return nil
+}
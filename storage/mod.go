@@ -0,0 +1,104 @@
+// Package storage persists the state of the bot: the settings of chats, the
+// history of posts, subscriptions and caches. DB is backed by an embedded
+// bbolt database, Memory is used when no database is configured.
+package storage
+
+import (
+	"time"
+)
+
+type ChatSettings struct {
+	Template string `json:"template,omitempty"`
+	Locale   string `json:"locale,omitempty"`
+	TagStyle string `json:"tag_style,omitempty"`
+	// BlockedTags and BlockedUsers are filtered before posting
+	BlockedTags  []string `json:"blocked_tags,omitempty"`
+	BlockedUsers []string `json:"blocked_users,omitempty"`
+	BlockSilent  bool     `json:"block_silent,omitempty"`
+	// Channels are extra destinations besides the linked channel
+	Channels []int64 `json:"channels,omitempty"`
+}
+
+// Post records an illust sent by the bot
+type Post struct {
+	Illust int   `json:"illust"`
+	Chat   int64 `json:"chat"`
+	// Messages are the ids of the sent messages, one per page of an album
+	Messages []int `json:"messages"`
+	Album    bool  `json:"album,omitempty"`
+	// User is who asked for the post, 0 if it was not a telegram user
+	User int `json:"user,omitempty"`
+	// Origin is the chat whose settings rendered the caption and Lang the
+	// language, a group posting to its channel is the origin of the post
+	Origin int64     `json:"origin,omitempty"`
+	Lang   string    `json:"lang,omitempty"`
+	Time   time.Time `json:"time"`
+	// Caption is the html caption of the first message as last sent or
+	// edited
+	Caption string `json:"caption,omitempty"`
+	// Deleted is set once the work was found deleted on pixiv
+	Deleted bool `json:"deleted,omitempty"`
+	// Refreshed is when the caption was last checked against pixiv
+	Refreshed time.Time `json:"refreshed,omitempty"`
+}
+
+// ImageHash is the perceptual hash of a page of a work the bot downloaded or
+// posted
+type ImageHash struct {
+	Illust int       `json:"illust"`
+	Page   int       `json:"page"`
+	PHash  uint64    `json:"phash"`
+	DHash  uint64    `json:"dhash"`
+	Time   time.Time `json:"time"`
+}
+
+// Subscription makes the bot watch a pixiv user or tag for a chat
+type Subscription struct {
+	Chat   int64  `json:"chat"`
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	// Last is the id of the newest illust already sent
+	Last    int       `json:"last,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Storage is implemented by DB and Memory. The settings methods never fail
+// on reads so the handlers can use them directly, read errors are logged and
+// the zero settings are returned.
+type Storage interface {
+	Get(chat int64) ChatSettings
+	Update(chat int64, fn func(*ChatSettings)) error
+	// Chats lists the chats which have settings
+	Chats() []int64
+
+	AddPost(post Post) error
+	// Posts returns the posts of the illust, oldest first
+	Posts(illust int) ([]Post, error)
+	// PostByMessage finds the post which includes the message
+	PostByMessage(chat int64, message int) (Post, bool, error)
+	// PostsSince returns the posts sent at or after since
+	PostsSince(since time.Time) ([]Post, error)
+	// UpdatePosts calls fn with each post of the illust and saves the changes
+	UpdatePosts(illust int, fn func(*Post)) error
+
+	// AddHash saves the hash of the page, replacing the previous one
+	AddHash(hash ImageHash) error
+	Hash(illust int, page int) (ImageHash, bool, error)
+	// Hashes returns every hash, ordered by illust and page
+	Hashes() ([]ImageHash, error)
+
+	Subscribe(sub Subscription) error
+	// Unsubscribe reports whether the subscription existed
+	Unsubscribe(chat int64, kind string, target string) (bool, error)
+	// Subscriptions lists the subscriptions of the chat, or of all chats if
+	// chat is 0
+	Subscriptions(chat int64) ([]Subscription, error)
+
+	// CacheGet returns the cached value unless it is missing or expired
+	CacheGet(key string) ([]byte, bool)
+	CachePut(key string, value []byte, ttl time.Duration) error
+	// PruneCache deletes the expired entries and returns how many were deleted
+	PruneCache() (int, error)
+
+	Close() error
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testStorage(t *testing.T, store Storage, now *time.Time) {
+	if len(store.Chats()) != 0 {
+		t.Fatalf("expected no chats, got %v", store.Chats())
+	}
+	err := store.Update(-1001, func(s *ChatSettings) { s.Locale = "ja" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Update(-1001, func(s *ChatSettings) { s.Channels = append(s.Channels, -1002) })
+	store.Update(42, func(s *ChatSettings) { s.TagStyle = "original" })
+	settings := store.Get(-1001)
+	if settings.Locale != "ja" || !reflect.DeepEqual(settings.Channels, []int64{-1002}) {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+	if chats := store.Chats(); !reflect.DeepEqual(chats, []int64{-1001, 42}) {
+		t.Errorf("unexpected chats %v", chats)
+	}
+
+	posted := time.Unix(1600000000, 0).UTC()
+	store.AddPost(Post{Illust: 1001, Chat: -1002, Messages: []int{5}, User: 42, Time: posted})
+	store.AddPost(Post{Illust: 1002, Chat: -1002, Messages: []int{6, 7}, Album: true, Time: posted})
+	store.AddPost(Post{Illust: 1001, Chat: 42, Messages: []int{8}, Time: posted})
+	posts, err := store.Posts(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 2 || posts[0].Chat != -1002 || posts[1].Chat != 42 || !posts[0].Time.Equal(posted) {
+		t.Errorf("unexpected posts %+v", posts)
+	}
+	if posts, _ := store.Posts(1003); len(posts) != 0 {
+		t.Errorf("unexpected posts %+v", posts)
+	}
+	post, found, err := store.PostByMessage(-1002, 7)
+	if err != nil || !found || post.Illust != 1002 {
+		t.Errorf("unexpected post %+v %v %v", post, found, err)
+	}
+	if _, found, _ := store.PostByMessage(42, 7); found {
+		t.Errorf("expected no post for another chat")
+	}
+	store.AddPost(Post{Illust: 1003, Chat: -1002, Messages: []int{9}, Time: posted.Add(time.Hour)})
+	if posts, _ := store.PostsSince(posted.Add(time.Minute)); len(posts) != 1 || posts[0].Illust != 1003 {
+		t.Errorf("unexpected recent posts %+v", posts)
+	}
+	err = store.UpdatePosts(1001, func(post *Post) {
+		if post.Chat == 42 {
+			post.Deleted = true
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if posts, _ := store.Posts(1001); len(posts) != 2 || posts[0].Deleted || !posts[1].Deleted {
+		t.Errorf("unexpected updated posts %+v", posts)
+	}
+
+	store.AddHash(ImageHash{Illust: 1002, Page: 1, PHash: 1 << 63, DHash: 2})
+	store.AddHash(ImageHash{Illust: 1001, Page: 0, PHash: 3, DHash: 4})
+	store.AddHash(ImageHash{Illust: 1002, Page: 0, PHash: 5, DHash: 6})
+	store.AddHash(ImageHash{Illust: 1001, Page: 0, PHash: 7, DHash: 8})
+	hashes, err := store.Hashes()
+	if err != nil || len(hashes) != 3 || hashes[0].PHash != 7 || hashes[2].Page != 1 || hashes[2].PHash != 1<<63 {
+		t.Errorf("unexpected hashes %+v %v", hashes, err)
+	}
+	if hash, found, _ := store.Hash(1002, 0); !found || hash.DHash != 6 {
+		t.Errorf("unexpected hash %+v %v", hash, found)
+	}
+	if _, found, _ := store.Hash(1003, 0); found {
+		t.Errorf("expected no hash")
+	}
+
+	store.Subscribe(Subscription{Chat: -1001, Kind: "user", Target: "11"})
+	store.Subscribe(Subscription{Chat: -1001, Kind: "tag", Target: "風景"})
+	store.Subscribe(Subscription{Chat: 42, Kind: "user", Target: "11"})
+	store.Subscribe(Subscription{Chat: -1001, Kind: "user", Target: "11", Last: 1001})
+	subs, _ := store.Subscriptions(-1001)
+	if len(subs) != 2 {
+		t.Errorf("unexpected subscriptions %+v", subs)
+	}
+	for _, sub := range subs {
+		if sub.Kind == "user" && sub.Last != 1001 {
+			t.Errorf("subscription not updated %+v", sub)
+		}
+	}
+	found, _ = store.Unsubscribe(-1001, "tag", "風景")
+	if !found {
+		t.Errorf("expected subscription to exist")
+	}
+	found, _ = store.Unsubscribe(-1001, "tag", "風景")
+	if found {
+		t.Errorf("expected subscription to be removed")
+	}
+	if subs, _ := store.Subscriptions(0); len(subs) != 2 || subs[0].Chat != -1001 || subs[1].Chat != 42 {
+		t.Errorf("unexpected subscriptions %+v", subs)
+	}
+
+	store.CachePut("chat:1", []byte("cached"), time.Minute)
+	if value, ok := store.CacheGet("chat:1"); !ok || string(value) != "cached" {
+		t.Errorf("unexpected cache entry %q %v", value, ok)
+	}
+	*now = now.Add(2 * time.Minute)
+	if _, ok := store.CacheGet("chat:1"); ok {
+		t.Errorf("expected cache entry to expire")
+	}
+	if count, err := store.PruneCache(); err != nil || count != 1 {
+		t.Errorf("expected 1 pruned entry, got %d %v", count, err)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	store := NewMemory()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	testStorage(t, store, &now)
+}
+
+func TestDB(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	testStorage(t, store, &now)
+}
+
+func TestPruneOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CachePut("expired", []byte("value"), time.Nanosecond)
+	store.CachePut("kept", []byte("value"), time.Hour)
+	store.Close()
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if count, err := store.PruneCache(); err != nil || count != 0 {
+		t.Errorf("expected the expired entry to be pruned on open, got %d %v", count, err)
+	}
+	if _, ok := store.CacheGet("kept"); !ok {
+		t.Errorf("expected the entry to be kept")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Update(1, func(s *ChatSettings) { s.Locale = "en" })
+	store.AddPost(Post{Illust: 1001, Chat: -1002, Messages: []int{5}})
+	version, _ := store.Version()
+	if version != len(migrations) {
+		t.Errorf("expected version %d, got %d", len(migrations), version)
+	}
+	store.Close()
+
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Get(1).Locale != "en" {
+		t.Errorf("settings lost after reopening")
+	}
+	store.Close()
+
+	// the message index is rebuilt by migration 2
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, 1)
+		tx.DeleteBucket([]byte(BUCKET_MESSAGES))
+		return tx.Bucket([]byte(BUCKET_META)).Put(versionKey, value)
+	})
+	db.Close()
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := store.PostByMessage(-1002, 5); !found {
+		t.Errorf("message index not rebuilt")
+	}
+	// posts without an origin get their own chat by migration 4
+	if posts, _ := store.Posts(1001); len(posts) != 1 || posts[0].Origin != -1002 {
+		t.Errorf("origin not filled: %+v", posts)
+	}
+	store.Close()
+
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(len(migrations)+1))
+		return tx.Bucket([]byte(BUCKET_META)).Put(versionKey, value)
+	})
+	db.Close()
+	_, err = Open(path)
+	if err == nil {
+		t.Errorf("expected newer database to be rejected")
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "settings.json")
+	os.WriteFile(legacy, []byte(`{"-1001": {"locale": "ja", "channels": [-1002]}, "42": {"tag_style": "original"}}`), 0644)
+	store, err := Open(filepath.Join(dir, "bot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	count, err := ImportSettings(store, legacy)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 imported chats, got %d %v", count, err)
+	}
+	store.AddPost(Post{Illust: 1001, Chat: -1002, Messages: []int{5}})
+
+	var buffer bytes.Buffer
+	err = store.Export(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dump Dump
+	err = json.Unmarshal(buffer.Bytes(), &dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dump.Version != len(migrations) || dump.Settings[-1001].Locale != "ja" || dump.Settings[42].TagStyle != "original" || len(dump.Posts) != 1 {
+		t.Errorf("unexpected dump %+v", dump)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	file, _ := os.Create(backup)
+	_, err = store.Backup(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if restored.Get(-1001).Locale != "ja" {
+		t.Errorf("settings missing from backup")
+	}
+}